@@ -1,89 +1,90 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
-
-	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/batch"
+	"github.com/AKarbas/cse138-kuber-grader/internal/cli"
 	"github.com/AKarbas/cse138-kuber-grader/internal/kvs3"
 )
 
 func main() {
-	groupName := os.Getenv("GROUP")
-	if groupName == "" {
-		fmt.Println("failed: expected group name in environment variable GROUP")
-		os.Exit(1)
-	}
-	log := logrus.New().WithFields(logrus.Fields{
-		"group": groupName,
+	cli.Main(cli.Grader{
+		Image: func(env cli.Env, team batch.Team) string { return testConfig(env, team).Image() },
+		Tests: tests,
+		Intro: []string{
+			"Graded using github.com/AKarbas/cse138-kuber-grader",
+			"All tests that expect a non-500 status code were done after waiting for the eventual consistency " +
+				"period, or the partition that receives the request has the entire causal history of the request.",
+			"After each view change or network heal, your system had 11 seconds to ensure consistency.",
+			"All data operations were done with a time-out of 21 seconds, and \"context deadline exceeded\" means " +
+				"longer waits.",
+		},
+		FullScore: 1,
 	})
-	log.Info("Graded using github.com/AKarbas/cse138-kuber-grader")
-	log.Info("All tests that expect a non-500 status code were done after waiting for the eventual consistency period, " +
-		"or the partition that receives the request has the entire causal history of the request.")
-	log.Info("After each view change or network heal, your system had 11 seconds to ensure consistency.")
-	log.Info("All data operations were done with a time-out of 21 seconds, and \"context deadline exceeded\" means longer waits.")
-	twoNodePerBatch := kvs3.TestConfig{
-		Registry:  "localhost:32000",
-		ImageTag:  "cse138-hw3-v1.0",
-		Namespace: "default",
-		GroupName: groupName,
-		NumNodes:  2,
-		NumKeys:   10,
-	}
-	threeNodePerBatch := kvs3.TestConfig{
-		Registry:  "localhost:32000",
-		ImageTag:  "cse138-hw3-v1.0",
-		Namespace: "default",
-		GroupName: groupName,
-		NumNodes:  3,
-		NumKeys:   10,
-	}
+}
 
-	extraCredit := 1
-	scores := make([]int, 5)
-	maxes := []int{
-		kvs3.BasicKVMaxScore,
-		kvs3.PartitionedTotalOrderMaxScore,
-		kvs3.BasicViewChangeMaxScore,
-		kvs3.PartitionedViewChangeMaxScore,
-		kvs3.AvailabilityMaxScore,
-	}
-	weights := []int{3, 3, 3, 1, 3}
-	tests := []kvs3.TestFunc{
-		kvs3.BasicKVTest,
-		kvs3.PartitionedTotalOrderTest,
-		kvs3.BasicViewChangeTest,
-		kvs3.PartitionedViewChangeTest,
-		kvs3.AvailabilityTest,
-	}
-	configs := []kvs3.TestConfig{
-		threeNodePerBatch,
-		twoNodePerBatch,
-		twoNodePerBatch,
-		twoNodePerBatch,
-		threeNodePerBatch,
+// testConfig is the config to grade team with in env, with two nodes per batch.
+func testConfig(env cli.Env, team batch.Team) kvs3.TestConfig {
+	return kvs3.TestConfig{
+		Registry:    "localhost:32000",
+		ImageTag:    "cse138-hw3-v1.0",
+		ImageDigest: env.ImageDigest,
+		Namespace:   env.Namespace,
+		GroupName:   team.Slug,
+		ImageRef:    team.Image,
+		NumNodes:    2,
+		NumKeys:     10,
+		Backend:     env.Backend,
+		Logger:      env.Logger,
+		ArtifactDir: env.ArtifactDir,
 	}
+}
 
-	for idx, testFunc := range tests {
-		log.Infof("Starting test %d", idx+1)
-		scores[idx] = testFunc(configs[idx])
-		if scores[idx] < maxes[idx] {
-			log.WithFields(logrus.Fields{
-				"expected": maxes[idx],
-				"got":      scores[idx],
-			}).Warnf("test %d did not finish with the full score.", idx+1)
-		}
-	}
+// tests returns all tests to grade team with.
+func tests(env cli.Env, team batch.Team) ([]cli.Test, error) {
+	twoNodePerBatch := testConfig(env, team)
+	threeNodePerBatch := twoNodePerBatch
+	threeNodePerBatch.NumNodes = 3
 
-	sum := 0.0
-	sumWeights := 0.0
-	for idx, score := range scores {
-		sum += float64(score) / float64(maxes[idx]) * float64(weights[idx])
-		sumWeights += float64(weights[idx])
+	test := func(f kvs3.TestFunc, conf kvs3.TestConfig) func(ctx context.Context) (int, error) {
+		return func(ctx context.Context) (int, error) { return f(ctx, conf) }
 	}
-	sumWeights -= float64(extraCredit)
-	res := sum / sumWeights
-
-	log.Infof("Final score overall: %.2f", res)
+	return []cli.Test{
+		{
+			Run:         test(kvs3.BasicKVTest, threeNodePerBatch),
+			Description: fmt.Sprintf("basicKV test with %d nodes per batch (weight=3)", threeNodePerBatch.NumNodes),
+			MaxScore:    kvs3.BasicKVMaxScore,
+			Weight:      3,
+		},
+		{
+			Run: test(kvs3.PartitionedTotalOrderTest, twoNodePerBatch),
+			Description: fmt.Sprintf("partitioned total order test with %d nodes per batch (weight=3)",
+				twoNodePerBatch.NumNodes),
+			MaxScore: kvs3.PartitionedTotalOrderMaxScore,
+			Weight:   3,
+		},
+		{
+			Run: test(kvs3.BasicViewChangeTest, twoNodePerBatch),
+			Description: fmt.Sprintf("basic view change test with %d nodes per batch (weight=3)",
+				twoNodePerBatch.NumNodes),
+			MaxScore: kvs3.BasicViewChangeMaxScore,
+			Weight:   3,
+		},
+		{
+			Run: test(kvs3.PartitionedViewChangeTest, twoNodePerBatch),
+			Description: fmt.Sprintf("partitioned view change test with %d nodes per batch (weight=1, extraCredit=1)",
+				twoNodePerBatch.NumNodes),
+			MaxScore:    kvs3.PartitionedViewChangeMaxScore,
+			Weight:      1,
+			ExtraCredit: 1,
+		},
+		{
+			Run:         test(kvs3.AvailabilityTest, threeNodePerBatch),
+			Description: fmt.Sprintf("availability test with %d nodes per batch (weight=3)", threeNodePerBatch.NumNodes),
+			MaxScore:    kvs3.AvailabilityMaxScore,
+			Weight:      3,
+		},
+	}, nil
 }
@@ -1,54 +1,73 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
-
-	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/batch"
+	"github.com/AKarbas/cse138-kuber-grader/internal/cli"
+	"github.com/AKarbas/cse138-kuber-grader/internal/config"
 	"github.com/AKarbas/cse138-kuber-grader/internal/kvs4"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 )
 
-type Test struct {
-	Run         TestFunc
-	Description string
-	MaxScore    int
-	Weight      int
+func main() {
+	cli.Main(cli.Grader{
+		Image: func(env cli.Env, team batch.Team) string { return testConfig(env, team).Image() },
+		Tests: tests,
+		Intro: []string{
+			"multiple tests are executed with different weights.",
+			"when a test logs an Error it fail-stops, but when a test logs a Warning the test continues (but " +
+				"you don't get the points for the part where the warning was logged.",
+			"all data operations were done with a time-out of >=20 seconds; and \"context deadline exceeded\" " +
+				"means longer waits.",
+			"all tests that expect a non-500 status code were done after waiting for the eventual consistency " +
+				"period, or the partition that receives the request has the entire causal history of the request.",
+			"after each view change or network heal, your system had >=10 seconds to ensure consistency.",
+		},
+		FullScore: 10,
+	})
 }
 
-type TestFunc func() int
+// testConfig is the config to grade team with in env.
+func testConfig(env cli.Env, team batch.Team) kvs4.TestConfig {
+	return kvs4.TestConfig{
+		Registry:    "localhost:32000",
+		GroupName:   team.Slug,
+		ImageRef:    team.Image,
+		ImageTag:    "cse138-hw4-v1.0",
+		ImageDigest: env.ImageDigest,
+		Namespace:   env.Namespace,
+		Backend:     env.Backend,
+		Logger:      env.Logger,
+		ArtifactDir: env.ArtifactDir,
+	}
+}
 
-func main() {
-	groupName := os.Getenv("GROUP")
-	if groupName == "" {
-		fmt.Println("failed: expected group name in environment variable GROUP")
-		os.Exit(1)
+// tests returns all tests to grade team with, including the ones in EXTRA_TESTS.
+func tests(env cli.Env, team batch.Team) ([]cli.Test, error) {
+	extraTests, err := config.ExtraTests()
+	if err != nil {
+		return nil, err
 	}
-	log := logrus.New().WithFields(logrus.Fields{
-		"group": groupName,
-	})
-	conf := kvs4.TestConfig{
-		Registry:  "localhost:32000",
-		GroupName: groupName,
-		ImageTag:  "cse138-hw4-v1.0",
-		Namespace: "default",
+	if kc, ok := env.Backend.(*k8s.Client); ok {
+		if extraTests[config.CrashRejoinTest] && !kc.StableAddresses && !kc.Proxied {
+			return nil, fmt.Errorf("the %s test needs STABLE_ADDRESSES or PROXY_NODES on the k8s backend",
+				config.CrashRejoinTest)
+		}
+		// Before the pool creates any pods.
+		kc.Freezable = extraTests[config.FreezeTest]
 	}
+	conf := testConfig(env, team)
 
-	log.Info("multiple tests are executed with different weights.")
-	log.Info("when a test logs an Error it fail-stops, but when a test logs a Warning the test continues (but " +
-		"you don't get the points for the part where the warning was logged.")
-	log.Info("all data operations were done with a time-out of >=20 seconds; and \"context deadline exceeded\" " +
-		"means longer waits.")
-	log.Info("all tests that expect a non-500 status code were done after waiting for the eventual consistency " +
-		"period, or the partition that receives the request has the entire causal history of the request.")
-	log.Info("after each view change or network heal, your system had >=10 seconds to ensure consistency.")
-
-	var tests []Test
+	var res []cli.Test
 
 	for s := 1; s <= 2; s++ {
 		s := s
-		tests = append(tests, Test{
-			Run:         func() int { return kvs4.BasicKvTest(conf, kvs4.ViewConfig{NumNodes: 4, NumShards: s}) },
+		res = append(res, cli.Test{
+			Run: func(ctx context.Context) (int, error) {
+				return kvs4.BasicKvTest(ctx, conf, kvs4.ViewConfig{NumNodes: 4, NumShards: s})
+			},
 			Description: fmt.Sprintf("(basicKV test with 4 nodes and %d shard(s) (weight=2)", s),
 			MaxScore:    kvs4.BasicKVMaxScore,
 			Weight:      2,
@@ -58,14 +77,55 @@ func main() {
 	for s := 2; s <= 3; s++ {
 		n := 6
 		s := s
-		tests = append(tests, Test{
-			Run:         func() int { return kvs4.AvailabilityTest(conf, kvs4.ViewConfig{NumNodes: n, NumShards: s}) },
+		res = append(res, cli.Test{
+			Run: func(ctx context.Context) (int, error) {
+				return kvs4.AvailabilityTest(ctx, conf, kvs4.ViewConfig{NumNodes: n, NumShards: s})
+			},
 			Description: fmt.Sprintf("availability test with %d nodes and %d shards (weight=4)", n, s),
 			MaxScore:    kvs4.AvailabilityMaxScore,
 			Weight:      4,
 		})
 	}
 
+	if extraTests[config.AsymmetricPartitionTest] {
+		for _, v := range []kvs4.ViewConfig{{NumNodes: 6, NumShards: 2}} {
+			v := v
+			res = append(res, cli.Test{
+				Run: func(ctx context.Context) (int, error) { return kvs4.AsymmetricPartitionTest(ctx, conf, v) },
+				Description: fmt.Sprintf("asymmetric partition test with %d nodes and %d shards (weight=3)",
+					v.NumNodes, v.NumShards),
+				MaxScore: kvs4.AsymmetricPartitionMaxScore,
+				Weight:   3,
+			})
+		}
+	}
+
+	if extraTests[config.CrashRejoinTest] {
+		for _, v := range []kvs4.ViewConfig{{NumNodes: 6, NumShards: 2}} {
+			v := v
+			res = append(res, cli.Test{
+				Run: func(ctx context.Context) (int, error) { return kvs4.CrashRejoinTest(ctx, conf, v) },
+				Description: fmt.Sprintf("crash-rejoin test with %d nodes and %d shards (weight=3)",
+					v.NumNodes, v.NumShards),
+				MaxScore: kvs4.CrashRejoinMaxScore,
+				Weight:   3,
+			})
+		}
+	}
+
+	if extraTests[config.FreezeTest] {
+		for _, v := range []kvs4.ViewConfig{{NumNodes: 6, NumShards: 3}} {
+			v := v
+			res = append(res, cli.Test{
+				Run: func(ctx context.Context) (int, error) { return kvs4.FreezeTest(ctx, conf, v) },
+				Description: fmt.Sprintf("freeze test with %d nodes and %d shards (weight=3)",
+					v.NumNodes, v.NumShards),
+				MaxScore: kvs4.FreezeMaxScore,
+				Weight:   3,
+			})
+		}
+	}
+
 	viewConfigPairs := [][2]kvs4.ViewConfig{
 		{kvs4.ViewConfig{NumNodes: 4, NumShards: 2}, kvs4.ViewConfig{NumNodes: 4, NumShards: 3}},
 		{kvs4.ViewConfig{NumNodes: 4, NumShards: 2}, kvs4.ViewConfig{NumNodes: 5, NumShards: 3}},
@@ -75,8 +135,10 @@ func main() {
 
 	for _, vcPair := range viewConfigPairs {
 		vcPair := vcPair
-		tests = append(tests, Test{
-			Run:         func() int { return kvs4.ViewChangeTest(conf, vcPair[0], vcPair[1], false) },
+		res = append(res, cli.Test{
+			Run: func(ctx context.Context) (int, error) {
+				return kvs4.ViewChangeTest(ctx, conf, vcPair[0], vcPair[1], false)
+			},
 			Description: fmt.Sprintf("viewChange test (killNodes=false) (weight=3)"),
 			MaxScore:    kvs4.ViewChangeMaxScore,
 			Weight:      3,
@@ -85,50 +147,26 @@ func main() {
 
 	for _, vcPair := range viewConfigPairs {
 		vcPair := vcPair
-		tests = append(tests, Test{
-			Run:         func() int { return kvs4.ViewChangeTest(conf, vcPair[0], vcPair[1], true) },
+		res = append(res, cli.Test{
+			Run: func(ctx context.Context) (int, error) {
+				return kvs4.ViewChangeTest(ctx, conf, vcPair[0], vcPair[1], true)
+			},
 			Description: fmt.Sprintf("viewChange test (killNodes=true) (weight=4)"),
 			MaxScore:    kvs4.ViewChangeMaxScore,
 			Weight:      4,
 		})
 	}
 
-	extraCredit := 0
 	for n1 := 6; n1 <= 7; n1++ {
 		n1 := n1
-		tests = append(tests, Test{
-			Run: func() int { return kvs4.KeyDistTest(conf, n1, 2000) },
+		res = append(res, cli.Test{
+			Run: func(ctx context.Context) (int, error) { return kvs4.KeyDistTest(ctx, conf, n1, 2000) },
 			Description: fmt.Sprintf("keyDistribution test with n1=%d, n2=%d (weight=5, extraCredit=%d)",
 				n1, n1+1, kvs4.KeyDistExtraCredits),
-			MaxScore: kvs4.KeyDistMaxScore,
-			Weight:   5,
+			MaxScore:    kvs4.KeyDistMaxScore,
+			Weight:      5,
+			ExtraCredit: kvs4.KeyDistExtraCredits,
 		})
-		extraCredit += kvs4.KeyDistExtraCredits
-	}
-
-	log.Infof("running a total of %d tests", len(tests))
-	scores := make([]int, len(tests))
-	for idx, t := range tests {
-		log.Infof("starting test %d: %s", idx+1, t.Description)
-		scores[idx] = t.Run()
-		log.Infof("finished test %d with score %d/%d", idx+1, scores[idx], t.MaxScore)
-		if scores[idx] < t.MaxScore {
-			log.Warnf("test %d did not finish with full score (%d/%d) (test description: %s)",
-				idx+1, scores[idx], t.MaxScore, t.Description)
-		}
-	}
-
-	log.Info("all tests done, printing scores again")
-
-	sum := 0.0
-	sumWeights := 0.0
-	for idx, score := range scores {
-		log.Infof("test %d: score=%d/%d, weight=%d", idx+1, score, tests[idx].MaxScore, tests[idx].Weight)
-		sum += float64(score) / float64(tests[idx].MaxScore) * float64(tests[idx].Weight)
-		sumWeights += float64(tests[idx].Weight)
 	}
-	sumWeights -= float64(extraCredit)
-	res := sum / sumWeights
-
-	log.Infof("Final score overall: %.1f/10", res*10.0)
+	return res, nil
 }
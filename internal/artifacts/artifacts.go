@@ -0,0 +1,140 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+// FollowLogs saves the logs of the group's nodes for the rest of a test to files in a directory of its own under dir,
+// one per node, named after the pod, its batch, index and IP. Once a node is restarted, the logs of each later run go
+// to a file of their own, numbered by the run (e.g. name_b1_i2_ip.1.log). It returns a function that stops following.
+// With no dir, the logs are logged at the end of the test instead. Following stops early if ctx is done.
+func FollowLogs(
+	ctx context.Context, cluster k8s.ClusterBackend, ns, groupName, dir, test string, log *logrus.Entry,
+) func() {
+	if dir == "" {
+		return func() { dumpLogs(cluster, ns, groupName, log) }
+	}
+	testDir, err := newTestDir(dir, test)
+	if err != nil {
+		log.Warnf("failed to create the directory for your process logs (logging them instead): %v", err)
+		return func() { dumpLogs(cluster, ns, groupName, log) }
+	}
+	open := func(name string, details k8s.PodMetaDetails, run int) (io.WriteCloser, error) {
+		file := fmt.Sprintf("%s_b%d_i%d_%s", name, details.Batch, details.Index, details.Ip)
+		if run > 0 {
+			file += fmt.Sprintf(".%d", run)
+		}
+		return os.Create(filepath.Join(testDir, file+".log"))
+	}
+	stop, err := cluster.FollowPodLogs(ctx, ns, k8s.GroupLabels(groupName), open)
+	if err != nil {
+		log.Warnf("failed to follow your process logs (logging them instead): %v", err)
+		return func() { dumpLogs(cluster, ns, groupName, log) }
+	}
+	return func() {
+		if err := stop(); err != nil {
+			log.Warnf("some of your process logs may be incomplete: %v", err)
+		}
+		log.Infof("Your process logs (for finding what went wrong...) are in %s", testDir)
+	}
+}
+
+// newTestDir creates <dir>/<test>-<n> for the first n that is not taken, since a test may run more than once.
+func newTestDir(dir, test string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	for n := 1; ; n++ {
+		res := filepath.Join(dir, fmt.Sprintf("%s-%d", test, n))
+		err := os.Mkdir(res, 0o755)
+		if err == nil {
+			return res, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+func dumpLogs(cluster k8s.ClusterBackend, ns, groupName string, log *logrus.Entry) {
+	log.Info("Here are your process logs (for finding what went wrong...)")
+	// The test may have been stopped, but its logs are still wanted.
+	ctx, cancel := k8s.CleanupContext()
+	defer cancel()
+	logs, err := cluster.GetPodLogs(ctx, ns, k8s.GroupLabels(groupName))
+	if err != nil {
+		log.Errorf("failed to get pods' logs: %v", err)
+		return
+	}
+	for idx, l := range logs {
+		log.Infof("log idx=%d (indices not stable): %s", idx, l)
+	}
+}
+
+// Bundle packs dir into a gzipped tarball at dir.tar.gz and removes dir. It does nothing if dir does not exist.
+func Bundle(dir string) (string, error) {
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "", nil
+	}
+	tarPath := dir + ".tar.gz"
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	base := filepath.Dir(dir)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return tarPath, os.RemoveAll(dir)
+}
@@ -0,0 +1,160 @@
+package batch
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GradeFunc grades one team, logging to log, and returns its final score.
+type GradeFunc func(team Team, log *logrus.Logger) (Grade, error)
+
+// Grade is what grading a group comes to.
+type Grade struct {
+	Score float64
+	// Image is the image the group was graded with, pinned to its digest when it has one.
+	Image string
+	// Events are what happened to the group's nodes during the tests, e.g. crashes, prefixed with the test.
+	Events []string
+}
+
+type Result struct {
+	Team     Team
+	Score    float64
+	Image    string
+	Events   []string
+	Err      error
+	Duration time.Duration
+}
+
+// Run grades teams with workers of them at a time. Each team logs to its own file, <slug>.log in logDir. The
+// results are in the same order as teams.
+func Run(teams []Team, workers int, logDir string, grade GradeFunc) ([]Result, error) {
+	if err := os.MkdirAll(logDir, 0o755); err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]Result, len(teams))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = gradeOne(teams[i], logDir, grade)
+				logrus.WithFields(logrus.Fields{
+					"group":    teams[i].Name,
+					"score":    results[i].Score,
+					"duration": results[i].Duration.Round(time.Second),
+				}).Info("graded")
+				if results[i].Err != nil {
+					logrus.WithField("group", teams[i].Name).Errorf("grading failed: %v", results[i].Err)
+				}
+			}
+		}()
+	}
+	for i := range teams {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results, nil
+}
+
+func gradeOne(team Team, logDir string, grade GradeFunc) (res Result) {
+	res.Team = team
+	start := time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
+	f, err := os.Create(filepath.Join(logDir, team.Slug+".log"))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer f.Close()
+	log := logrus.New()
+	log.SetOutput(f)
+
+	// A test that panics fails its own group, not the whole batch.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("grader panicked: %v", r)
+			res.Err = fmt.Errorf("grader panicked: %v", r)
+		}
+	}()
+	var g Grade
+	g, res.Err = grade(team, log)
+	res.Score, res.Image, res.Events = g.Score, g.Image, g.Events
+	return res
+}
+
+// WriteGradebook writes results to w as CSV, with a header row. Members are separated by semicolons, and events by
+// semicolons and spaces.
+func WriteGradebook(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	header := []string{"group", "score", "error", "duration_seconds", "image", "slug", "members", "events"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range results {
+		errStr := ""
+		if r.Err != nil {
+			errStr = r.Err.Error()
+		}
+		row := []string{
+			r.Team.Name, fmt.Sprintf("%.2f", r.Score), errStr, fmt.Sprintf("%.0f", r.Duration.Seconds()), r.Image,
+			r.Team.Slug, strings.Join(r.Team.Members, ";"), strings.Join(r.Events, "; "),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// GradeRoster grades every team in the roster file at path, and writes the gradebook to out and to gradebook.csv in
+// logDir. It fails if any group could not be graded.
+func GradeRoster(path string, workers int, logDir string, grade GradeFunc, out io.Writer) error {
+	teams, err := ReadRoster(path)
+	if err != nil {
+		return err
+	}
+	results, err := Run(teams, workers, logDir, grade)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(logDir, "gradebook.csv"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := WriteGradebook(io.MultiWriter(f, out), results); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d groups could not be graded", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package batch
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// maxSlugLen leaves room in the names built from a slug (e.g. <slug>-b1-p10-<run ID> as a pod's host name) for them
+// to stay within the 63 characters of a DNS label.
+const maxSlugLen = 40
+
+// Team is a group to grade, as the roster has it.
+type Team struct {
+	// Name is how the team calls itself, e.g. "Data Bros"; it is only shown.
+	Name string
+	// Slug is Name made into a DNS-1123 label, e.g. "data-bros". The team's pods, network policies and labels are named
+	// after it, and so are its log files.
+	Slug string
+	// Image is the team's image; empty means the image the grader builds from the slug.
+	Image string
+	// Members are the students in the team, for exporting grades.
+	Members []string
+}
+
+// NewTeam makes a team named name, with the slug derived from the name.
+func NewTeam(name string) (Team, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Team{}, fmt.Errorf("team with no name")
+	}
+	t := Team{Name: name, Slug: Slug(name)}
+	if errs := validation.IsDNS1123Label(t.Slug); len(errs) > 0 {
+		return Team{}, fmt.Errorf("bad slug %q for team %q: %s", t.Slug, name, strings.Join(errs, "; "))
+	}
+	return t, nil
+}
+
+// Slug makes name into a DNS-1123 label: lowercase letters, digits and dashes, starting and ending with a letter or
+// digit. Everything else becomes a dash. Names that are too long are cut short and, like names with nothing left,
+// get a hash of the name appended so that they stay apart.
+func Slug(name string) string {
+	b := strings.Builder{}
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	res := b.String()
+	if res != "" && len(res) <= maxSlugLen {
+		return res
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:8]
+	if res == "" {
+		return "team-" + hash
+	}
+	return strings.TrimRight(res[:maxSlugLen-len(hash)-1], "-") + "-" + hash
+}
+
+// ReadRoster reads the teams to grade from path. A .csv file has a header row naming its columns: name (required),
+// image and members (separated by semicolons). Any other file has one team name per line, skipping empty lines and
+// lines starting with #. No two teams can share a name or a slug.
+func ReadRoster(path string) ([]Team, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var teams []Team
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		teams, err = readCsvRoster(f)
+	} else {
+		teams, err = readTextRoster(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	slugs := make(map[string]string)
+	for _, t := range teams {
+		if names[t.Name] {
+			return nil, fmt.Errorf("group %s is in the roster twice", t.Name)
+		}
+		names[t.Name] = true
+		if other, ok := slugs[t.Slug]; ok {
+			return nil, fmt.Errorf("groups %s and %s would both be named %s", other, t.Name, t.Slug)
+		}
+		slugs[t.Slug] = t.Name
+	}
+	return teams, nil
+}
+
+func readTextRoster(r io.Reader) ([]Team, error) {
+	var teams []Team
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := NewTeam(line)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, scanner.Err()
+}
+
+func readCsvRoster(r io.Reader) ([]Team, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the roster's header: %w", err)
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch h {
+		case "name", "image", "members":
+			cols[h] = i
+		default:
+			return nil, fmt.Errorf("unknown column %q in the roster (expected name, image and members)", h)
+		}
+	}
+	if _, ok := cols["name"]; !ok {
+		return nil, fmt.Errorf("the roster has no name column")
+	}
+	field := func(row []string, col string) string {
+		if i, ok := cols[col]; ok {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var teams []Team
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return teams, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		t, err := NewTeam(field(row, "name"))
+		if err != nil {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("roster line %d: %w", line, err)
+		}
+		t.Image = field(row, "image")
+		for _, m := range strings.Split(field(row, "members"), ";") {
+			if m = strings.TrimSpace(m); m != "" {
+				t.Members = append(t.Members, m)
+			}
+		}
+		teams = append(teams, t)
+	}
+}
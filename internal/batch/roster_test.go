@@ -0,0 +1,55 @@
+package batch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// nameHash is the hash Slug appends to name.
+func nameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+func TestSlug(t *testing.T) {
+	long := strings.Repeat("a", maxSlugLen+5)
+	dashAtCut := strings.Repeat("a", maxSlugLen-10) + " " + strings.Repeat("b", 20)
+	tests := []struct {
+		name, want string
+	}{
+		{"Data Bros", "data-bros"},
+		{"  --Data__Bros!! ", "data-bros"},
+		{"Team 42", "team-42"},
+		{"Ünïcödé", "n-c-d"},
+		{"", "team-" + nameHash("")},
+		{"!!!", "team-" + nameHash("!!!")},
+		{strings.Repeat("a", maxSlugLen), strings.Repeat("a", maxSlugLen)},
+		{long, strings.Repeat("a", maxSlugLen-9) + "-" + nameHash(long)},
+		// The cut falls right after the dash, which is dropped rather than doubled.
+		{dashAtCut, strings.Repeat("a", maxSlugLen-10) + "-" + nameHash(dashAtCut)},
+	}
+	for _, tt := range tests {
+		got := Slug(tt.name)
+		if got != tt.want {
+			t.Errorf("Slug(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if len(got) > maxSlugLen {
+			t.Errorf("Slug(%q) = %q is longer than %d", tt.name, got, maxSlugLen)
+		}
+		if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+			t.Errorf("Slug(%q) = %q is not a DNS-1123 label: %s", tt.name, got, strings.Join(errs, "; "))
+		}
+	}
+}
+
+func TestSlugKeepsLongNamesApart(t *testing.T) {
+	a := strings.Repeat("x", maxSlugLen) + "a"
+	b := strings.Repeat("x", maxSlugLen) + "b"
+	if Slug(a) == Slug(b) {
+		t.Errorf("Slug(%q) = Slug(%q) = %q", a, b, Slug(a))
+	}
+}
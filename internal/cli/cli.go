@@ -0,0 +1,277 @@
+// Package cli is the command line the graders share: the rbac, reap and preflight commands, and grading one group or a
+// roster of them with a grader's tests.
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/batch"
+	"github.com/AKarbas/cse138-kuber-grader/internal/config"
+	"github.com/AKarbas/cse138-kuber-grader/internal/interrupt"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
+	"github.com/AKarbas/cse138-kuber-grader/internal/preflight"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+// Env is where a group is graded.
+type Env struct {
+	Backend   k8s.ClusterBackend
+	Namespace string
+	// ArtifactDir is where the group's process logs go.
+	ArtifactDir string
+	// ImageDigest, if set, is the build of the group's image to grade.
+	ImageDigest string
+	Logger      *logrus.Logger
+}
+
+// Test is one of a grader's tests, which has Weight in the final score.
+type Test struct {
+	Run         func(ctx context.Context) (int, error)
+	Description string
+	MaxScore    int
+	Weight      int
+	// ExtraCredit is how much of Weight doesn't count towards a full score.
+	ExtraCredit int
+}
+
+// Grader is what sets one homework's grader apart from the others.
+type Grader struct {
+	// Image returns the image to grade team with in env, pinned to env.ImageDigest if it is set.
+	Image func(env Env, team batch.Team) string
+	// Tests returns the tests to grade team with in env. It is called before any of the group's pods are created.
+	Tests func(env Env, team batch.Team) ([]Test, error)
+	// Intro is logged before the tests run.
+	Intro []string
+	// FullScore is the final score of a group that gets every point.
+	FullScore float64
+}
+
+// Main runs the command in the arguments, or grades the group in GROUP, or every group in ROSTER, with g.
+func Main(g Grader) {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [rbac | reap [run ID] | preflight]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "without a command, grades GROUP, or every team in ROSTER")
+	}
+	flag.Parse()
+	switch {
+	case flag.Arg(0) == "rbac" && flag.NArg() == 1:
+		manifest, err := k8s.RbacYaml(config.Namespace(), "cse138-grader")
+		if err != nil {
+			fmt.Printf("failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(string(manifest))
+		return
+	case flag.Arg(0) == "reap" && flag.NArg() <= 2:
+		if err := runReap(flag.Arg(1)); err != nil {
+			fmt.Printf("failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case flag.Arg(0) == "preflight" && flag.NArg() == 1, flag.NArg() == 0:
+	default:
+		fmt.Printf("failed: unexpected arguments %q\n", flag.Args())
+		flag.Usage()
+		os.Exit(2)
+	}
+	interrupt.Handle()
+	ctx := interrupt.Context()
+	if flag.Arg(0) == "preflight" {
+		team, err := groupTeam()
+		if err != nil {
+			fmt.Printf("failed: %v\n", err)
+			os.Exit(1)
+		}
+		if err := runPreflight(ctx, g, team); err != nil {
+			fmt.Printf("failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	bc, err := config.Batch()
+	if err != nil {
+		fmt.Printf("failed: %v\n", err)
+		os.Exit(1)
+	}
+	if bc.Roster != "" {
+		grade := func(team batch.Team, logger *logrus.Logger) (batch.Grade, error) {
+			return gradeGroup(ctx, g, team, logger)
+		}
+		if err := batch.GradeRoster(bc.Roster, bc.Workers, bc.LogDir, grade, os.Stdout); err != nil {
+			fmt.Printf("failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	team, err := groupTeam()
+	if err != nil {
+		fmt.Printf("failed: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := gradeGroup(ctx, g, team, logrus.New()); err != nil {
+		fmt.Printf("failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// groupTeam returns the team named in the GROUP environment variable.
+func groupTeam() (batch.Team, error) {
+	if os.Getenv("GROUP") == "" {
+		return batch.Team{}, errors.New("expected group name in environment variable GROUP or a roster in ROSTER")
+	}
+	return batch.NewTeam(os.Getenv("GROUP"))
+}
+
+// setup returns the environment to grade team in; done cleans up after grading.
+func setup(ctx context.Context, team batch.Team) (env Env, done func(), err error) {
+	cluster, err := config.Cluster()
+	if err != nil {
+		return env, nil, err
+	}
+	namespace, done, err := config.RunNamespace(ctx, cluster, team.Slug)
+	if err != nil {
+		return env, nil, err
+	}
+	env = Env{
+		Backend:     cluster,
+		Namespace:   namespace,
+		ArtifactDir: config.Artifacts().GroupDir(team.Slug),
+	}
+	return env, config.Interruptible(cluster, namespace, done), nil
+}
+
+// runReap deletes the grader's expired resources in all namespaces, or all of runId's if it is set.
+func runReap(runId string) error {
+	cluster, err := config.Cluster()
+	if err != nil {
+		return err
+	}
+	kc, ok := cluster.(*k8s.Client)
+	if !ok {
+		return fmt.Errorf("reap only applies to the k8s backend")
+	}
+	reaped, err := kc.Reap(context.Background(), time.Now(), runId)
+	for _, r := range reaped {
+		fmt.Printf("deleted %s\n", r)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted %d resources\n", len(reaped))
+	return nil
+}
+
+func runPreflight(ctx context.Context, g Grader, team batch.Team) error {
+	env, done, err := setup(ctx, team)
+	if err != nil {
+		return err
+	}
+	defer done()
+	kc, ok := env.Backend.(*k8s.Client)
+	if !ok {
+		return fmt.Errorf("preflight only applies to the k8s backend")
+	}
+	if !preflight.Run(ctx, kc, env.Namespace, g.Image(env, team), os.Stdout) {
+		return fmt.Errorf("preflight checks did not pass")
+	}
+	return nil
+}
+
+// gradeGroup runs all of g's tests against team and returns its final score.
+func gradeGroup(ctx context.Context, g Grader, team batch.Team, logger *logrus.Logger) (batch.Grade, error) {
+	testTimeout, err := config.TestTimeout()
+	if err != nil {
+		return batch.Grade{}, err
+	}
+	env, done, err := setup(ctx, team)
+	if err != nil {
+		return batch.Grade{}, err
+	}
+	defer done()
+	env.Logger = logger
+	// Fail before creating any pods if the image is missing, and grade the same build throughout.
+	if env.ImageDigest, err = config.ImageDigest(env.Backend, g.Image(env, team)); err != nil {
+		return batch.Grade{}, err
+	}
+	image := g.Image(env, team)
+	tests, err := g.Tests(env, team)
+	if err != nil {
+		return batch.Grade{}, err
+	}
+	closePool, err := config.Pool(ctx, env.Backend, env.Namespace, team.Slug, image)
+	if err != nil {
+		return batch.Grade{}, err
+	}
+	defer closePool()
+
+	log := logger.WithFields(logrus.Fields{
+		"group": team.Name,
+	})
+	if kc, ok := env.Backend.(*k8s.Client); ok {
+		log.Infof("run ID %s, namespace %s", kc.RunId, env.Namespace)
+		log.Infof("grading image %s", image)
+	}
+	if config.Artifacts().Tar {
+		defer func() {
+			if path, err := artifacts.Bundle(env.ArtifactDir); err != nil {
+				log.Warnf("failed to pack your process logs: %v", err)
+			} else if path != "" {
+				log.Infof("Your process logs are packed in %s", path)
+			}
+		}()
+	}
+	for _, line := range g.Intro {
+		log.Info(line)
+	}
+
+	log.Infof("running a total of %d tests", len(tests))
+	scores := make([]int, len(tests))
+	var events []string
+	for idx, t := range tests {
+		if ctx.Err() != nil {
+			return batch.Grade{}, ctx.Err()
+		}
+		log.Infof("starting test %d: %s", idx+1, t.Description)
+		testCtx, cancel := context.WithTimeout(ctx, testTimeout)
+		testCtx, report := monitor.WithReport(testCtx)
+		scores[idx], err = t.Run(testCtx)
+		if errors.Is(testCtx.Err(), context.DeadlineExceeded) {
+			log.Errorf("test %d ran out of time after %v and was stopped", idx+1, testTimeout)
+		}
+		cancel()
+		for _, e := range report.Events() {
+			events = append(events, fmt.Sprintf("test %d: %s", idx+1, e))
+		}
+		if err != nil {
+			log.Errorf("test %d could not be graded, so the group is not graded either: %v", idx+1, err)
+			return batch.Grade{Events: events}, fmt.Errorf("test %d: %w", idx+1, err)
+		}
+		log.Infof("finished test %d with score %d/%d", idx+1, scores[idx], t.MaxScore)
+		if scores[idx] < t.MaxScore {
+			log.Warnf("test %d did not finish with full score (%d/%d) (test description: %s)",
+				idx+1, scores[idx], t.MaxScore, t.Description)
+		}
+	}
+
+	log.Info("all tests done, printing scores again")
+
+	sum := 0.0
+	sumWeights := 0.0
+	for idx, score := range scores {
+		log.Infof("test %d: score=%d/%d, weight=%d", idx+1, score, tests[idx].MaxScore, tests[idx].Weight)
+		sum += float64(score) / float64(tests[idx].MaxScore) * float64(tests[idx].Weight)
+		sumWeights += float64(tests[idx].Weight - tests[idx].ExtraCredit)
+	}
+	res := sum / sumWeights * g.FullScore
+
+	log.Infof("Final score overall: %.2f/%g", res, g.FullScore)
+	return batch.Grade{Score: res, Image: image, Events: events}, nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+type ArtifactConfig struct {
+	// Dir is where each group's process logs go, in a directory named after the group.
+	Dir string
+	// Tar packs each group's directory into a tarball once it is graded.
+	Tar bool
+}
+
+// Artifacts reads where to save process logs: ARTIFACT_DIR (default artifacts) and ARTIFACT_TAR (set to anything to
+// pack them).
+func Artifacts() ArtifactConfig {
+	ac := ArtifactConfig{
+		Dir: os.Getenv("ARTIFACT_DIR"),
+		Tar: os.Getenv("ARTIFACT_TAR") != "",
+	}
+	if ac.Dir == "" {
+		ac.Dir = "artifacts"
+	}
+	return ac
+}
+
+// GroupDir is the directory for groupName's artifacts.
+func (ac ArtifactConfig) GroupDir(groupName string) string {
+	return filepath.Join(ac.Dir, groupName)
+}
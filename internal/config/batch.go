@@ -0,0 +1,34 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type BatchConfig struct {
+	// Roster is the file with the groups to grade, one per line; empty means grading the single group in GROUP.
+	Roster  string
+	Workers int
+	LogDir  string
+}
+
+// Batch reads the batch grading settings: ROSTER, WORKERS (default 4) and LOG_DIR (default grader-logs).
+func Batch() (BatchConfig, error) {
+	bc := BatchConfig{
+		Roster:  os.Getenv("ROSTER"),
+		Workers: 4,
+		LogDir:  os.Getenv("LOG_DIR"),
+	}
+	if bc.LogDir == "" {
+		bc.LogDir = "grader-logs"
+	}
+	if w := os.Getenv("WORKERS"); w != "" {
+		n, err := strconv.Atoi(w)
+		if err != nil || n < 1 {
+			return bc, fmt.Errorf("bad number of workers %q in environment variable WORKERS", w)
+		}
+		bc.Workers = n
+	}
+	return bc, nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/internal/interrupt"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+// Interruptible makes an interrupted grader delete what the run has in ns and then call done, as grading would have.
+// The returned function is done, and also undoes that.
+func Interruptible(cluster k8s.ClusterBackend, ns string, done func()) func() {
+	unregister := interrupt.Register(func() {
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		var err error
+		if kc, ok := cluster.(*k8s.Client); ok {
+			err = kc.DeleteRun(ctx, ns)
+		} else {
+			err = cluster.DeletePods(ctx, ns, nil)
+		}
+		if err != nil {
+			logrus.Errorf("failed to clean up namespace %s: %v", ns, err)
+		}
+		done()
+	})
+	return func() {
+		unregister()
+		done()
+	}
+}
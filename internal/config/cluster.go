@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/local"
+)
+
+// Cluster builds the backend selected by the BACKEND environment variable: "k8s" (the default) or "local". The local
+// backend runs LOCAL_COMMAND (split on whitespace) in LOCAL_DIR for every node, behind fault-injecting proxies if
+// LOCAL_PROXY is set. The k8s backend lets the comma-separated GRADER_CIDRS (and, if GRADER_DETECT_IP is set, the
+// grader's address as seen by the pods) through its network policies, and reaches pods through port-forwarding if
+// PORT_FORWARD is set. With PROXY_NODES set, it partitions and shapes the nodes' traffic with proxies listening on
+// PROXY_HOST, the grader's IP as the nodes see it, instead. With STABLE_ADDRESSES set, it gives nodes DNS names that
+// survive restarts. Its resources are scoped to the run ID in RUN_ID, or to a fresh one. Nodes get the CPU and memory
+// in CPU_REQUEST, CPU_LIMIT, MEMORY_REQUEST and MEMORY_LIMIT (e.g. "500m" and "256Mi"); RUN_AS_NON_ROOT and
+// READ_ONLY_ROOT_FS lock them down further. Nodes can't connect anywhere but their own group unless ALLOW_EGRESS is
+// set. What it creates may be reaped after RESOURCE_TTL (default 6h). Both backends wait up to READY_TIMEOUT (e.g.
+// "90s") for nodes to start. Deleted pods get DELETE_GRACE_PERIOD (e.g. "0s") to shut down.
+func Cluster() (k8s.ClusterBackend, error) {
+	readyTimeout, err := duration("READY_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	switch backend := os.Getenv("BACKEND"); backend {
+	case "", "k8s":
+		cidrs, err := graderCidrs(os.Getenv("GRADER_CIDRS"))
+		if err != nil {
+			return nil, err
+		}
+		runId := os.Getenv("RUN_ID")
+		if runId == "" {
+			runId = k8s.NewRunId()
+		} else if errs := validation.IsDNS1123Label(runId); len(errs) > 0 {
+			return nil, fmt.Errorf("bad run ID %q in environment variable RUN_ID: %s", runId, strings.Join(errs, "; "))
+		}
+		grace, err := gracePeriod("DELETE_GRACE_PERIOD")
+		if err != nil {
+			return nil, err
+		}
+		resources, err := nodeResources()
+		if err != nil {
+			return nil, err
+		}
+		ttl, err := duration("RESOURCE_TTL")
+		if err != nil {
+			return nil, err
+		}
+		proxied := os.Getenv("PROXY_NODES") != ""
+		proxyHost := os.Getenv("PROXY_HOST")
+		if proxied && net.ParseIP(proxyHost) == nil {
+			return nil, fmt.Errorf("PROXY_NODES needs the grader's IP in environment variable PROXY_HOST, got %q", proxyHost)
+		}
+		if proxied && os.Getenv("PORT_FORWARD") != "" {
+			return nil, fmt.Errorf("PROXY_NODES needs the grader to reach the nodes directly, which rules out PORT_FORWARD")
+		}
+		return &k8s.Client{
+			GracePeriodSeconds:     grace,
+			RunId:                  runId,
+			GraderCidrs:            cidrs,
+			DetectGraderIp:         os.Getenv("GRADER_DETECT_IP") != "",
+			PortForward:            os.Getenv("PORT_FORWARD") != "",
+			StableAddresses:        os.Getenv("STABLE_ADDRESSES") != "",
+			Resources:              resources,
+			RunAsNonRoot:           os.Getenv("RUN_AS_NON_ROOT") != "",
+			ReadOnlyRootFilesystem: os.Getenv("READ_ONLY_ROOT_FS") != "",
+			DenyEgress:             os.Getenv("ALLOW_EGRESS") == "",
+			Proxied:                proxied,
+			ProxyHost:              proxyHost,
+			ReadyTimeout:           readyTimeout,
+			TTL:                    ttl,
+		}, nil
+	case "local":
+		return &local.Cluster{
+			Command:      strings.Fields(os.Getenv("LOCAL_COMMAND")),
+			Dir:          os.Getenv("LOCAL_DIR"),
+			Proxied:      os.Getenv("LOCAL_PROXY") != "",
+			ReadyTimeout: readyTimeout,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q in environment variable BACKEND (expected k8s or local)", backend)
+	}
+}
+
+// graderCidrs parses a comma-separated list of CIDRs; plain IPs are taken as /32.
+func graderCidrs(list string) ([]string, error) {
+	var res []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			s += "/32"
+		}
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return nil, fmt.Errorf("bad CIDR %q in environment variable GRADER_CIDRS: %w", s, err)
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// nodeResources reads the nodes' CPU and memory requests and limits; unset ones are left out.
+func nodeResources() (v1.ResourceRequirements, error) {
+	res := v1.ResourceRequirements{Requests: v1.ResourceList{}, Limits: v1.ResourceList{}}
+	for _, r := range []struct {
+		env  string
+		list v1.ResourceList
+		name v1.ResourceName
+	}{
+		{"CPU_REQUEST", res.Requests, v1.ResourceCPU},
+		{"CPU_LIMIT", res.Limits, v1.ResourceCPU},
+		{"MEMORY_REQUEST", res.Requests, v1.ResourceMemory},
+		{"MEMORY_LIMIT", res.Limits, v1.ResourceMemory},
+	} {
+		v := os.Getenv(r.env)
+		if v == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(v)
+		if err != nil || q.Sign() <= 0 {
+			return res, fmt.Errorf("bad quantity %q in environment variable %s", v, r.env)
+		}
+		r.list[r.name] = q
+	}
+	return res, nil
+}
+
+// duration parses the environment variable env as a duration; unset means zero.
+func duration(env string) (time.Duration, error) {
+	v := os.Getenv(env)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad duration %q in environment variable %s", v, env)
+	}
+	return d, nil
+}
+
+// gracePeriod parses the environment variable env as a duration in whole seconds; unset means nil.
+func gracePeriod(env string) (*int64, error) {
+	v := os.Getenv(env)
+	if v == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("bad duration %q in environment variable %s", v, env)
+	}
+	seconds := int64(d.Seconds())
+	return &seconds, nil
+}
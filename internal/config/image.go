@@ -0,0 +1,27 @@
+package config
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/registry"
+)
+
+// ImageDigest looks up the digest image has in its registry, so that a run's pods all get the same build even if the
+// tag is pushed again halfway through. It fails if the image is not there. Images the grader is not allowed to see
+// (the cluster may have credentials the grader lacks) are graded by their tag, with a warning. The local backend runs
+// no images, so it gets an empty digest.
+func ImageDigest(cluster k8s.ClusterBackend, image string) (string, error) {
+	if _, ok := cluster.(*k8s.Client); !ok {
+		return "", nil
+	}
+	digest, err := registry.ResolveDigest(image)
+	if errors.Is(err, registry.ErrUnauthorized) {
+		logrus.Warnf("not pinning image %s to a digest, so a push during the run may change what is graded: %v",
+			image, err)
+		return "", nil
+	}
+	return digest, err
+}
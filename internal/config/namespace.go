@@ -0,0 +1,47 @@
+package config
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Namespace returns the namespace to grade in: the NAMESPACE environment variable, else the grader's own namespace
+// when it runs in a pod, else "default".
+func Namespace() string {
+	if ns := os.Getenv("NAMESPACE"); ns != "" {
+		return ns
+	}
+	if ns, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return "default"
+}
+
+// RunNamespace returns the namespace to grade groupName in, and a function to call once grading it is done. If
+// NAMESPACE_PER_RUN is set and the backend is k8s, the namespace is created for the group in this run (named
+// cse138-grader-<group>-<run ID>) and the returned function deletes it, so groups graded together don't lose their
+// namespace when another one finishes; otherwise it is Namespace() and the function does nothing.
+func RunNamespace(ctx context.Context, cluster k8s.ClusterBackend, groupName string) (string, func(), error) {
+	kc, ok := cluster.(*k8s.Client)
+	if !ok || os.Getenv("NAMESPACE_PER_RUN") == "" {
+		return Namespace(), func() {}, nil
+	}
+	ns, err := kc.CreateRunNamespace(ctx, "cse138-grader-"+groupName)
+	if err != nil {
+		return "", nil, err
+	}
+	return ns, func() {
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		if err := kc.DeleteNamespace(ctx, ns); err != nil {
+			logrus.Errorf("failed to delete namespace %s: %v", ns, err)
+		}
+	}, nil
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+// Pool starts a pool of POOL_SIZE spare pods running image for the group, if it is set and the backend is k8s, and
+// returns a function that deletes what is left of it once grading is done; otherwise the function does nothing.
+func Pool(ctx context.Context, cluster k8s.ClusterBackend, ns, groupName, image string) (func(), error) {
+	v := os.Getenv("POOL_SIZE")
+	kc, ok := cluster.(*k8s.Client)
+	if !ok || v == "" {
+		return func() {}, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("bad pool size %q in environment variable POOL_SIZE", v)
+	}
+	if size == 0 {
+		return func() {}, nil
+	}
+	pool, err := kc.StartPool(ctx, ns, groupName, image, size)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		if err := pool.Close(ctx); err != nil {
+			logrus.Errorf("failed to delete the pod pool of group %s: %v", groupName, err)
+		}
+	}, nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AsymmetricPartitionTest names the hw4 test that blocks connections in one direction only, which the assignment
+// does not ask nodes to cope with.
+const AsymmetricPartitionTest = "asymmetric-partition"
+
+// CrashRejoinTest names the hw4 test that restarts nodes and puts them back into the view, which needs them to keep
+// their addresses (see k8s.Client.StableAddresses).
+const CrashRejoinTest = "crash-rejoin"
+
+// FreezeTest names the hw4 test that freezes nodes, which needs the nodes' containers to share one process namespace
+// (see k8s.Client.Freezable).
+const FreezeTest = "freeze"
+
+// extraTests are the tests that only run when they are listed in EXTRA_TESTS.
+var extraTests = []string{AsymmetricPartitionTest, CrashRejoinTest, FreezeTest}
+
+// ExtraTests returns the opt-in tests listed (comma-separated) in EXTRA_TESTS; see the constants above for their
+// names.
+func ExtraTests() (map[string]bool, error) {
+	res := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("EXTRA_TESTS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, t := range extraTests {
+			known = known || t == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown test %q in environment variable EXTRA_TESTS (known: %s)",
+				name, strings.Join(extraTests, ", "))
+		}
+		res[name] = true
+	}
+	return res, nil
+}
@@ -0,0 +1,16 @@
+package config
+
+import "time"
+
+// DefaultTestTimeout is how long a single test may run when TEST_TIMEOUT is not set.
+const DefaultTestTimeout = 15 * time.Minute
+
+// TestTimeout returns how long a single test may run before it is stopped and scored as far as it got: TEST_TIMEOUT
+// (e.g. "20m"), or DefaultTestTimeout if that is not set.
+func TestTimeout() (time.Duration, error) {
+	timeout, err := duration("TEST_TIMEOUT")
+	if err != nil || timeout != 0 {
+		return timeout, err
+	}
+	return DefaultTestTimeout, nil
+}
@@ -0,0 +1,75 @@
+package interrupt
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mu       sync.Mutex
+	next     int
+	cleanups = make(map[int]func())
+	once     sync.Once
+
+	ctx, cancel = context.WithCancel(context.Background())
+)
+
+// Context returns a context that is cancelled as soon as the grader is interrupted (see Handle), so that whatever it
+// is doing gives up before the registered functions clean up after it.
+func Context() context.Context {
+	return ctx
+}
+
+// Register makes f run if the grader is interrupted with SIGINT or SIGTERM (see Handle). The returned function
+// unregisters it, for when f is no longer needed.
+func Register(f func()) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	id := next
+	next++
+	cleanups[id] = f
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(cleanups, id)
+	}
+}
+
+// Handle starts waiting for SIGINT and SIGTERM. On the first one, it cancels Context, runs every registered function
+// at once, and exits once they return; a second signal exits right away.
+func Handle() {
+	once.Do(func() {
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			logrus.Warnf("got %s; cleaning up before exiting (send it again to exit right away)", sig)
+			go func() {
+				<-signals
+				os.Exit(130)
+			}()
+			cancel()
+			mu.Lock()
+			var fs []func()
+			for _, f := range cleanups {
+				fs = append(fs, f)
+			}
+			mu.Unlock()
+			wg := sync.WaitGroup{}
+			for _, f := range fs {
+				wg.Add(1)
+				go func(f func()) {
+					defer wg.Done()
+					f()
+				}(f)
+			}
+			wg.Wait()
+			os.Exit(130)
+		}()
+	})
+}
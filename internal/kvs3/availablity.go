@@ -1,11 +1,13 @@
 package kvs3
 
 import (
-	"sort"
+	"context"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs3client"
 )
@@ -14,8 +16,8 @@ const (
 	AvailabilityMaxScore = 10
 )
 
-func AvailabilityTest(conf TestConfig) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func AvailabilityTest(ctx context.Context, conf TestConfig) (int, error) {
+	log := conf.logger().WithFields(logrus.Fields{
 		"test":     "Availability",
 		"group":    conf.GroupName,
 		"numNodes": conf.NumNodes,
@@ -24,27 +26,28 @@ func AvailabilityTest(conf TestConfig) int {
 	log.Infof("this test isolates each node and ensures that it's writable; and that "+
 		"after partitions are healed, all nodes contain all of the data. max score in test: %d",
 		AvailabilityMaxScore)
-	k8sClient := k8s.Client{}
+	cluster := conf.cluster()
 
 	score := 0
 	defer func(s *int) {
 		log.Infof("final score: %d", *s)
 	}(&score)
 
-	if err := k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed when awaiting deletion of pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeleteNetPolicies(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete network policies: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
-	if err := k8sClient.CreatePods(
+	if err := cluster.CreatePods(
+		ctx,
 		conf.Namespace,
 		conf.GroupName,
 		conf.Image(),
@@ -52,45 +55,53 @@ func AvailabilityTest(conf TestConfig) int {
 		conf.NumNodes,
 	); err != nil {
 		log.Errorf("could not create nodes: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	defer func() {
-		k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName))
-		k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	}() // cleanup
+	defer artifacts.FollowLogs(ctx, cluster, conf.Namespace, conf.GroupName, conf.ArtifactDir, "Availability", log)()
+	defer monitor.Start(ctx, cluster, conf.Namespace, conf.GroupName, log)()
 
-	time.Sleep(10 * time.Second)
+	if err := cluster.AwaitReady(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+		log.Errorf("nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
-	addresses, err := k8sClient.ListPodAddresses(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	addrMappings, err := cluster.ListAddressGroupIndexMappings(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	if err != nil {
 		log.Errorf("failed when listing node addresses: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	sort.Strings(addresses)
+	addresses := k8s.PodAddrsFromMappings(addrMappings)
 
-	statusCode, err := kvs3client.PutView(addresses[0], addresses)
+	statusCode, err := kvs3client.PutView(ctx, addresses[0], addresses)
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
 			"expected": 200,
 			"received": statusCode,
 		}).Error("bad status code for put view")
-		return score
+		return score, nil
 	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
-	for i := 0; i < conf.NumNodes; i++ {
-		err = k8sClient.IsolatePod(conf.Namespace, conf.GroupName, i+1)
-		if err != nil {
-			log.Errorf("failed to isolate pod idx=%d: %v", i+1, err)
-			return score
-		}
+	err = k8s.ApplyPartition(ctx, cluster, conf.Namespace, conf.GroupName, k8s.EachAlone(addresses), addrMappings)
+	if err != nil {
+		log.Errorf("failed to isolate pods: %v", err)
+		return score, infraError(err)
 	}
-	defer k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	defer k8s.HealPartition(ctx, cluster, conf.Namespace, conf.GroupName, nil)
 
 	partitionCms := make([]kvs3client.CausalMetadata, conf.NumNodes)
 
@@ -99,6 +110,7 @@ func AvailabilityTest(conf TestConfig) int {
 		for i := 0; i < conf.NumNodes; i++ {
 			partitionId := (i + k) % conf.NumNodes
 			partitionCms[partitionId], statusCode, err = kvs3client.PutKeyVal(
+				ctx,
 				addresses[partitionId],
 				key(k),
 				val(k, i),
@@ -106,7 +118,7 @@ func AvailabilityTest(conf TestConfig) int {
 			)
 			if err != nil {
 				log.Errorf("failed to put key-val: %v", err)
-				return score
+				return score, nil
 			}
 			if statusCode != 201 && statusCode != 200 {
 				log.WithFields(logrus.Fields{
@@ -118,21 +130,28 @@ func AvailabilityTest(conf TestConfig) int {
 		}
 	}
 
-	k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	if err = k8s.HealPartition(ctx, cluster, conf.Namespace, conf.GroupName, addrMappings); err != nil {
+		log.Errorf("failed to heal partition: %v", err)
+		return score, infraError(err)
+	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	for k := 0; k < conf.NumKeys; k++ {
 		for i := 0; i < conf.NumNodes; i++ {
 			var value string
 			value, _, statusCode, err = kvs3client.GetKey(
+				ctx,
 				addresses[(i+k+1)%conf.NumNodes],
 				key(k),
 				nil,
 			)
 			if err != nil {
 				log.Errorf("failed to get key: %v", err)
-				return score
+				return score, nil
 			}
 			if statusCode != 200 {
 				log.WithFields(logrus.Fields{
@@ -155,5 +174,5 @@ func AvailabilityTest(conf TestConfig) int {
 		log.Info("score +10 - gets from new nodes after partition heal successful")
 	}
 
-	return score
+	return score, nil
 }
@@ -1,12 +1,15 @@
 package kvs3
 
 import (
+	"context"
 	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"k8s.io/utils/strings/slices"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs3client"
 )
@@ -15,8 +18,8 @@ const (
 	BasicKVMaxScore = 80
 )
 
-func BasicKVTest(conf TestConfig) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func BasicKVTest(ctx context.Context, conf TestConfig) (int, error) {
+	log := conf.logger().WithFields(logrus.Fields{
 		"test":     "BasicKeyVal",
 		"group":    conf.GroupName,
 		"numNodes": conf.NumNodes,
@@ -25,27 +28,28 @@ func BasicKVTest(conf TestConfig) int {
 	log.Infof("this test runs on a healthy network and checks "+
 		"if simple view and data operations are successful. "+
 		"max score in test: %d", BasicKVMaxScore)
-	k8sClient := k8s.Client{}
+	cluster := conf.cluster()
 
 	score := 0
 	defer func(s *int) {
 		log.Infof("final score: %d", *s)
 	}(&score)
 
-	if err := k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed when awaiting deletion of pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeleteNetPolicies(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete network policies: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
-	if err := k8sClient.CreatePods(
+	if err := cluster.CreatePods(
+		ctx,
 		conf.Namespace,
 		conf.GroupName,
 		conf.Image(),
@@ -53,27 +57,34 @@ func BasicKVTest(conf TestConfig) int {
 		conf.NumNodes,
 	); err != nil {
 		log.Errorf("could not create nodes: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	defer func() {
-		k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName))
-		k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	}() // cleanup
+	defer artifacts.FollowLogs(ctx, cluster, conf.Namespace, conf.GroupName, conf.ArtifactDir, "BasicKeyVal", log)()
+	defer monitor.Start(ctx, cluster, conf.Namespace, conf.GroupName, log)()
 
-	time.Sleep(10 * time.Second)
+	if err := cluster.AwaitReady(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+		log.Errorf("nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
 	success := true
-	addresses, err := k8sClient.ListPodAddresses(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	addresses, err := cluster.ListPodAddresses(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	if err != nil {
 		log.Errorf("failed when listing node addresses: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	sort.Strings(addresses)
 
-	statusCode, err := kvs3client.PutView(addresses[0], addresses)
+	statusCode, err := kvs3client.PutView(ctx, addresses[0], addresses)
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -87,13 +98,16 @@ func BasicKVTest(conf TestConfig) int {
 		log.Info("score +10 - put view successful")
 	}
 
-	time.Sleep(10 * time.Second)
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	success = true
-	view, statusCode, err := kvs3client.GetView(addresses[conf.NumNodes-1])
+	view, statusCode, err := kvs3client.GetView(ctx, addresses[conf.NumNodes-1])
 	if err != nil {
 		log.Errorf("failed to get view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -121,13 +135,14 @@ func BasicKVTest(conf TestConfig) int {
 	success = true
 	for i := 0; i < conf.NumKeys; i++ {
 		_, cm, statusCode, err = kvs3client.GetKey(
+			ctx,
 			addresses[i%conf.NumNodes],
 			key(i),
 			cm,
 		)
 		if err != nil {
 			log.Errorf("failed to get key: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 404 {
 			log.WithFields(logrus.Fields{
@@ -145,6 +160,7 @@ func BasicKVTest(conf TestConfig) int {
 	success = true
 	for i := 0; i < conf.NumKeys; i++ {
 		cm, statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			addresses[(i+1)%conf.NumNodes],
 			key(i),
 			val(i, 0),
@@ -152,7 +168,7 @@ func BasicKVTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 201 {
 			log.WithFields(logrus.Fields{
@@ -171,13 +187,14 @@ func BasicKVTest(conf TestConfig) int {
 	for i := 0; i < conf.NumKeys; i++ {
 		var value string
 		value, cm, statusCode, err = kvs3client.GetKey(
+			ctx,
 			addresses[(i+2)%conf.NumNodes],
 			key(i),
 			cm,
 		)
 		if err != nil {
 			log.Errorf("failed to get key: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 200 {
 			log.WithFields(logrus.Fields{
@@ -203,6 +220,7 @@ func BasicKVTest(conf TestConfig) int {
 	success = true
 	for i := 0; i < conf.NumKeys; i++ {
 		cm, statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			addresses[(i+3)%conf.NumNodes],
 			key(i),
 			val(i, 1),
@@ -210,7 +228,7 @@ func BasicKVTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 200 {
 			log.WithFields(logrus.Fields{
@@ -229,13 +247,14 @@ func BasicKVTest(conf TestConfig) int {
 	for i := 0; i < conf.NumKeys; i++ {
 		var value string
 		value, cm, statusCode, err = kvs3client.GetKey(
+			ctx,
 			addresses[(i+4)%conf.NumNodes],
 			key(i),
 			cm,
 		)
 		if err != nil {
 			log.Errorf("failed to get key: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 200 {
 			log.WithFields(logrus.Fields{
@@ -261,10 +280,10 @@ func BasicKVTest(conf TestConfig) int {
 	success = true
 	var keyCount int
 	var keys []string
-	keyCount, keys, cm, statusCode, err = kvs3client.GetKeyList(addresses[0], cm)
+	keyCount, keys, cm, statusCode, err = kvs3client.GetKeyList(ctx, addresses[0], cm)
 	if err != nil {
 		log.Errorf("failed to get key list: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -294,5 +313,5 @@ func BasicKVTest(conf TestConfig) int {
 		log.Info("score +10 - key list valid")
 	}
 
-	return score
+	return score, nil
 }
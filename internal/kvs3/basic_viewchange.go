@@ -1,11 +1,14 @@
 package kvs3
 
 import (
+	"context"
 	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs3client"
 )
@@ -14,8 +17,8 @@ const (
 	BasicViewChangeMaxScore = 10
 )
 
-func BasicViewChangeTest(conf TestConfig) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func BasicViewChangeTest(ctx context.Context, conf TestConfig) (int, error) {
+	log := conf.logger().WithFields(logrus.Fields{
 		"test":     "BasicViewChange",
 		"group":    conf.GroupName,
 		"numNodes": 2 * conf.NumNodes,
@@ -24,27 +27,28 @@ func BasicViewChangeTest(conf TestConfig) int {
 	log.Infof("this test changes the view in a healthy network "+
 		"and checks that the data are readable in the new nodes after the "+
 		"view change. max score in test: %d", BasicViewChangeMaxScore)
-	k8sClient := k8s.Client{}
+	cluster := conf.cluster()
 
 	score := 0
 	defer func(s *int) {
 		log.Infof("final score: %d", *s)
 	}(&score)
 
-	if err := k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed when awaiting deletion of pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeleteNetPolicies(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete network policies: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
-	if err := k8sClient.CreatePods(
+	if err := cluster.CreatePods(
+		ctx,
 		conf.Namespace,
 		conf.GroupName,
 		conf.Image(),
@@ -52,32 +56,39 @@ func BasicViewChangeTest(conf TestConfig) int {
 		conf.NumNodes,
 	); err != nil {
 		log.Errorf("could not create nodes: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	defer func() {
-		k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName))
-		k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	}() // cleanup
+	defer artifacts.FollowLogs(ctx, cluster, conf.Namespace, conf.GroupName, conf.ArtifactDir, "BasicViewChange", log)()
+	defer monitor.Start(ctx, cluster, conf.Namespace, conf.GroupName, log)()
 
-	time.Sleep(10 * time.Second)
+	if err := cluster.AwaitReady(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+		log.Errorf("nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
 	success := true
 	var err error
 	batches := make([][]string, 2)
 	for b := 0; b < 2; b++ {
-		batches[b], err = k8sClient.ListPodAddresses(conf.Namespace, k8s.BatchLabels(conf.GroupName, b+1))
+		batches[b], err = cluster.ListPodAddresses(ctx, conf.Namespace, k8s.BatchLabels(conf.GroupName, b+1))
 		if err != nil {
 			log.Errorf("failed when listing node addresses: %v", err)
-			return score
+			return score, infraError(err)
 		}
 		sort.Strings(batches[b])
 	}
 	all := append(batches[0], batches[1]...)
 
-	statusCode, err := kvs3client.PutView(batches[0][0], batches[0])
+	statusCode, err := kvs3client.PutView(ctx, batches[0][0], batches[0])
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -87,12 +98,16 @@ func BasicViewChangeTest(conf TestConfig) int {
 		success = false
 	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	var cm kvs3client.CausalMetadata = nil
 
 	for i := 0; i < conf.NumKeys; i++ {
 		cm, statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			batches[0][i%conf.NumNodes],
 			key(i),
 			val(i, 0),
@@ -100,7 +115,7 @@ func BasicViewChangeTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 201 {
 			log.WithFields(logrus.Fields{
@@ -111,12 +126,15 @@ func BasicViewChangeTest(conf TestConfig) int {
 		}
 	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
-	statusCode, err = kvs3client.PutView(batches[0][0], all)
+	statusCode, err = kvs3client.PutView(ctx, batches[0][0], all)
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -126,18 +144,22 @@ func BasicViewChangeTest(conf TestConfig) int {
 		success = false
 	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	for i := 0; i < conf.NumKeys; i++ {
 		var value string
 		value, cm, statusCode, err = kvs3client.GetKey(
+			ctx,
 			batches[1][i%conf.NumNodes],
 			key(i),
 			cm,
 		)
 		if err != nil {
 			log.Errorf("failed to get key: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 200 {
 			log.WithFields(logrus.Fields{
@@ -160,5 +182,5 @@ func BasicViewChangeTest(conf TestConfig) int {
 		log.Info("score +10 - gets from new nodes successful")
 	}
 
-	return score
+	return score, nil
 }
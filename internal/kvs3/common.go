@@ -1,8 +1,36 @@
 package kvs3
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"time"
 
-type TestFunc func(config TestConfig) int
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+// TestFunc runs a test and returns its score; the error is only set if the grading environment failed the test (see
+// k8s.InfraError), in which case the score says nothing about the tested code.
+type TestFunc func(ctx context.Context, config TestConfig) (int, error)
+
+// infraError returns err if the grading environment is to blame for it, and nil otherwise.
+func infraError(err error) error {
+	if k8s.IsInfraError(err) {
+		return err
+	}
+	return nil
+}
+
+// sleep waits for d, or until ctx is done, in which case it returns ctx's error.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
 
 func key(i int) string {
 	return fmt.Sprintf("Key-%d", i)
@@ -1,19 +1,61 @@
 package kvs3
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/registry"
+)
 
 type TestConfig struct {
-	Registry  string
-	ImageTag  string
-	Namespace string
-	GroupName string
-	NumNodes  int
-	NumKeys   int
+	Registry string
+	ImageTag string
+	// ImageRef, if set, is the nodes' image instead of the one made of Registry, GroupName and ImageTag.
+	ImageRef string
+	// ImageDigest, if set, pins the nodes' image to that build of the tag (see registry.ResolveDigest).
+	ImageDigest string
+	Namespace   string
+	GroupName   string
+	NumNodes    int
+	NumKeys     int
+	// Backend runs the nodes; a Kubernetes client is used when nil.
+	Backend k8s.ClusterBackend
+	// Logger configures where and how the tests log; they log to stderr when nil.
+	Logger *logrus.Logger
+	// ArtifactDir is where the tests save process logs, in a directory per test; they are logged when empty.
+	ArtifactDir string
 }
 
 func (tc TestConfig) Image() string {
+	image := fmt.Sprintf("%s/%s:%s", tc.Registry, tc.GroupName, tc.ImageTag)
 	if tc.Registry == "" {
-		return fmt.Sprintf("%s:%s", tc.GroupName, tc.ImageTag)
+		image = fmt.Sprintf("%s:%s", tc.GroupName, tc.ImageTag)
+	}
+	if tc.ImageRef != "" {
+		image = tc.ImageRef
+	}
+	if tc.ImageDigest != "" {
+		return registry.Pin(image, tc.ImageDigest)
+	}
+	return image
+}
+
+func (tc TestConfig) logger() *logrus.Logger {
+	// Each test gets a logger of its own, which it can add hooks to.
+	res := logrus.New()
+	if tc.Logger != nil {
+		res.SetOutput(tc.Logger.Out)
+		res.SetFormatter(tc.Logger.Formatter)
+		res.SetLevel(tc.Logger.Level)
+	}
+	return res
+}
+
+func (tc TestConfig) cluster() k8s.ClusterBackend {
+	if tc.Backend == nil {
+		return &k8s.Client{}
 	}
-	return fmt.Sprintf("%s/%s:%s", tc.Registry, tc.GroupName, tc.ImageTag)
+	return tc.Backend
 }
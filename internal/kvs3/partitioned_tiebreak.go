@@ -1,12 +1,15 @@
 package kvs3
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs3client"
 )
@@ -15,8 +18,8 @@ const (
 	PartitionedTotalOrderMaxScore = 40
 )
 
-func PartitionedTotalOrderTest(conf TestConfig) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func PartitionedTotalOrderTest(ctx context.Context, conf TestConfig) (int, error) {
+	log := conf.logger().WithFields(logrus.Fields{
 		"test":     "PartitionedTieBreak",
 		"group":    conf.GroupName,
 		"numNodes": 2 * conf.NumNodes,
@@ -26,27 +29,28 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		"into two parts; inserts to both parts; heals the partition; and expects "+
 		"the results to be the same from all nodes, including causal ordering and "+
 		"tie breaking. max score in test: %d", PartitionedTotalOrderMaxScore)
-	k8sClient := k8s.Client{}
+	cluster := conf.cluster()
 
 	score := 0
 	defer func(s *int) {
 		log.Infof("final score: %d", *s)
 	}(&score)
 
-	if err := k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed when awaiting deletion of pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeleteNetPolicies(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete network policies: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
-	if err := k8sClient.CreatePods(
+	if err := cluster.CreatePods(
+		ctx,
 		conf.Namespace,
 		conf.GroupName,
 		conf.Image(),
@@ -54,27 +58,34 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		conf.NumNodes,
 	); err != nil {
 		log.Errorf("could not create nodes: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	defer func() {
-		k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName))
-		k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	}() // cleanup
+	defer artifacts.FollowLogs(ctx, cluster, conf.Namespace, conf.GroupName, conf.ArtifactDir, "PartitionedTieBreak", log)()
+	defer monitor.Start(ctx, cluster, conf.Namespace, conf.GroupName, log)()
 
-	time.Sleep(10 * time.Second)
+	if err := cluster.AwaitReady(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+		log.Errorf("nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
-	addresses, err := k8sClient.ListPodAddresses(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	addrMappings, err := cluster.ListAddressGroupIndexMappings(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	if err != nil {
 		log.Errorf("failed when listing node addresses: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	sort.Strings(addresses)
+	addresses := k8s.PodAddrsFromMappings(addrMappings)
 
 	success := true
-	statusCode, err := kvs3client.PutView(addresses[0], addresses)
+	statusCode, err := kvs3client.PutView(ctx, addresses[0], addresses)
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -86,24 +97,25 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 
 	batches := make([][]string, 2)
 	for b := 0; b < 2; b++ {
-		batches[b], err = k8sClient.ListPodAddresses(conf.Namespace, k8s.BatchLabels(conf.GroupName, b+1))
+		batches[b], err = cluster.ListPodAddresses(ctx, conf.Namespace, k8s.BatchLabels(conf.GroupName, b+1))
 		if err != nil {
 			log.Errorf("failed when listing node addresses: %v", err)
-			return score
+			return score, infraError(err)
 		}
 		sort.Strings(batches[b])
 	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
-	for b := 0; b < 2; b++ {
-		err = k8sClient.IsolateBatch(conf.Namespace, conf.GroupName, b+1)
-		if err != nil {
-			log.Errorf("failed to isolate batch idx=%d: %v", b+1, err)
-			return score
-		}
+	err = k8s.ApplyPartition(ctx, cluster, conf.Namespace, conf.GroupName, k8s.Partition{Groups: batches}, addrMappings)
+	if err != nil {
+		log.Errorf("failed to isolate batches: %v", err)
+		return score, infraError(err)
 	}
-	defer k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	defer k8s.HealPartition(ctx, cluster, conf.Namespace, conf.GroupName, nil)
 
 	partitionCms := make([]kvs3client.CausalMetadata, 2)
 
@@ -111,6 +123,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 	for i := 0; i < conf.NumKeys; i++ {
 		batchId := i % 2
 		partitionCms[batchId], statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			batches[batchId][i%conf.NumNodes],
 			key(i),
 			val(i, 0),
@@ -118,7 +131,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 201 {
 			log.WithFields(logrus.Fields{
@@ -132,6 +145,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 	// first batch of non-causal puts (CM = {})
 	for i := conf.NumKeys; i < 2*conf.NumKeys; i++ {
 		_, statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			batches[i%2][i%conf.NumNodes],
 			key(i),
 			val(i, 0),
@@ -139,7 +153,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 201 {
 			log.WithFields(logrus.Fields{
@@ -154,6 +168,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 	for i := 0; i < conf.NumKeys; i++ {
 		batchId := (i + 1) % 2
 		partitionCms[batchId], statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			batches[(i+1)%2][i%conf.NumNodes],
 			key(i),
 			val(i, 1),
@@ -161,7 +176,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 200 && statusCode != 201 {
 			log.WithFields(logrus.Fields{
@@ -175,6 +190,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 	// Second batch of non-causal puts (CM = {})
 	for i := conf.NumKeys; i < 2*conf.NumKeys; i++ {
 		_, statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			batches[(i+1)%2][i%conf.NumNodes],
 			key(i),
 			val(i, 1),
@@ -182,7 +198,7 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 200 && statusCode != 201 {
 			log.WithFields(logrus.Fields{
@@ -205,13 +221,14 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 			i := conf.NumKeys - 1
 			var value string
 			value, _, statusCode, err = kvs3client.GetKey(
+				ctx,
 				batches[b][i%conf.NumNodes],
 				key(i),
 				partitionCms[cmIdx],
 			)
 			if err != nil {
 				log.Errorf("failed to get key: %v", err)
-				return score
+				return score, nil
 			}
 			if b == cmIdx && statusCode != 200 {
 				log.WithFields(logrus.Fields{
@@ -244,19 +261,22 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 	}
 
 	// Heal and wait
-	err = k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	err = k8s.HealPartition(ctx, cluster, conf.Namespace, conf.GroupName, addrMappings)
 	if err != nil {
 		log.Errorf("failed to heal partition: %v", err)
-		return score
+		return score, infraError(err)
+	}
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
 	}
-	time.Sleep(11 * time.Second)
 
 	success = true
 	var keyCount int
-	keyCount, _, _, statusCode, err = kvs3client.GetKeyList(addresses[0], nil)
+	keyCount, _, _, statusCode, err = kvs3client.GetKeyList(ctx, addresses[0], nil)
 	if err != nil {
 		log.Errorf("failed to get key list: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -284,13 +304,14 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		for b := 0; b < 2; b++ {
 			var value string
 			value, _, statusCode, err = kvs3client.GetKey(
+				ctx,
 				batches[(b+i)%2][0],
 				key(i),
 				nil,
 			)
 			if err != nil {
 				log.Errorf("failed to get key: %v", err)
-				return score
+				return score, nil
 			}
 			if statusCode != 200 {
 				log.WithFields(logrus.Fields{
@@ -330,5 +351,5 @@ func PartitionedTotalOrderTest(conf TestConfig) int {
 		log.Info("score +10 - tie-breaking after network heal successful")
 	}
 
-	return score
+	return score, nil
 }
@@ -1,11 +1,14 @@
 package kvs3
 
 import (
+	"context"
 	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs3client"
 )
@@ -14,8 +17,8 @@ const (
 	PartitionedViewChangeMaxScore = 10
 )
 
-func PartitionedViewChangeTest(conf TestConfig) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func PartitionedViewChangeTest(ctx context.Context, conf TestConfig) (int, error) {
+	log := conf.logger().WithFields(logrus.Fields{
 		"test":     "PartitionedViewChange",
 		"group":    conf.GroupName,
 		"numNodes": 3 * conf.NumNodes,
@@ -25,27 +28,28 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 		"heals the network and waits; and checks that the data are readable in "+
 		"the new nodes after the view change. max score in test: %d",
 		PartitionedViewChangeMaxScore)
-	k8sClient := k8s.Client{}
+	cluster := conf.cluster()
 
 	score := 0
 	defer func(s *int) {
 		log.Infof("final score: %d", *s)
 	}(&score)
 
-	if err := k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed when awaiting deletion of pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	if err := k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+	if err := cluster.DeleteNetPolicies(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
 		log.Errorf("failed to delete network policies: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
-	if err := k8sClient.CreatePods(
+	if err := cluster.CreatePods(
+		ctx,
 		conf.Namespace,
 		conf.GroupName,
 		conf.Image(),
@@ -53,22 +57,29 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 		conf.NumNodes,
 	); err != nil {
 		log.Errorf("could not create nodes: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	defer func() {
-		k8sClient.DeletePods(conf.Namespace, k8s.GroupLabels(conf.GroupName))
-		k8sClient.AwaitDeletion(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		cluster.DeletePods(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
+		cluster.AwaitDeletion(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
 	}() // cleanup
+	defer artifacts.FollowLogs(ctx, cluster, conf.Namespace, conf.GroupName, conf.ArtifactDir, "PartitionedViewChange", log)()
+	defer monitor.Start(ctx, cluster, conf.Namespace, conf.GroupName, log)()
 
-	time.Sleep(10 * time.Second)
+	if err := cluster.AwaitReady(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName)); err != nil {
+		log.Errorf("nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
 	var err error
 	batches := make([][]string, 3)
 	for b := 0; b < 3; b++ {
-		batches[b], err = k8sClient.ListPodAddresses(conf.Namespace, k8s.BatchLabels(conf.GroupName, b+1))
+		batches[b], err = cluster.ListPodAddresses(ctx, conf.Namespace, k8s.BatchLabels(conf.GroupName, b+1))
 		if err != nil {
 			log.Errorf("failed when listing node addresses: %v", err)
-			return score
+			return score, infraError(err)
 		}
 		sort.Strings(batches[b])
 	}
@@ -76,10 +87,10 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 	firstAndThird := append(batches[0], batches[2]...)
 
 	success := true
-	statusCode, err := kvs3client.PutView(batches[0][0], firstTwo)
+	statusCode, err := kvs3client.PutView(ctx, batches[0][0], firstTwo)
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -89,21 +100,28 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 		success = false
 	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
-	for b := 0; b < 3; b++ {
-		err = k8sClient.IsolateBatch(conf.Namespace, conf.GroupName, b+1)
-		if err != nil {
-			log.Errorf("failed to isolate batch idx=%d: %v", b+1, err)
-			return score
-		}
+	addrMappings, err := cluster.ListAddressGroupIndexMappings(ctx, conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	if err != nil {
+		log.Errorf("failed when listing node addresses: %v", err)
+		return score, infraError(err)
 	}
-	defer k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	err = k8s.ApplyPartition(ctx, cluster, conf.Namespace, conf.GroupName, k8s.Partition{Groups: batches}, addrMappings)
+	if err != nil {
+		log.Errorf("failed to isolate batches: %v", err)
+		return score, infraError(err)
+	}
+	defer k8s.HealPartition(ctx, cluster, conf.Namespace, conf.GroupName, nil)
 
 	var cm kvs3client.CausalMetadata = nil
 
 	for i := 0; i < conf.NumKeys; i++ {
 		cm, statusCode, err = kvs3client.PutKeyVal(
+			ctx,
 			firstTwo[i%len(firstTwo)],
 			key(i),
 			val(i, 0),
@@ -111,7 +129,7 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 		)
 		if err != nil {
 			log.Errorf("failed to put key-val: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 201 {
 			log.WithFields(logrus.Fields{
@@ -122,14 +140,20 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 		}
 	}
 
-	k8sClient.DeleteNetPolicies(conf.Namespace, k8s.GroupLabels(conf.GroupName))
+	if err = k8s.HealPartition(ctx, cluster, conf.Namespace, conf.GroupName, addrMappings); err != nil {
+		log.Errorf("failed to heal partition: %v", err)
+		return score, infraError(err)
+	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
-	statusCode, err = kvs3client.PutView(batches[0][0], firstAndThird)
+	statusCode, err = kvs3client.PutView(ctx, batches[0][0], firstAndThird)
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
@@ -139,18 +163,22 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 		success = false
 	}
 
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	for i := 0; i < conf.NumKeys; i++ {
 		var value string
 		value, cm, statusCode, err = kvs3client.GetKey(
+			ctx,
 			batches[2][i%conf.NumNodes],
 			key(i),
 			cm,
 		)
 		if err != nil {
 			log.Errorf("failed to get key: %v", err)
-			return score
+			return score, nil
 		}
 		if statusCode != 200 {
 			log.WithFields(logrus.Fields{
@@ -173,5 +201,5 @@ func PartitionedViewChangeTest(conf TestConfig) int {
 		log.Info("score +10 - gets from new nodes after partition heal successful")
 	}
 
-	return score
+	return score, nil
 }
@@ -0,0 +1,217 @@
+package kvs4
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs4client"
+)
+
+const AsymmetricPartitionMaxScore = 50
+
+func AsymmetricPartitionTest(ctx context.Context, c TestConfig, v ViewConfig) (int, error) {
+	log := c.logger().WithFields(logrus.Fields{
+		"test":  "asymmetricPartition",
+		"group": c.GroupName,
+	})
+	log.WithField("viewConfig", v.String()).Info(
+		"starting test. Steps: " +
+			"1. create a cluster (launch processes; wait until they answer; PUT view; wait 10s); " +
+			"2. get the view from all nodes and expect consistency; " +
+			"3. split the nodes into sides A and B (each with 1+ node from each shard) so that A can reach B but B" +
+			" cannot reach A; " +
+			"4. do causally-dependent writes (use CM received after first req in second and so on) sprayed across" +
+			" side A (keys [1, N]); " +
+			"5. do reads on writes of step 4 (from side B, all with reused CM) and expect latest values or stall-fails; " +
+			"6. do non-causally-dependent writes (all with CM={}) sprayed across side B (keys [N+1, 2N]); " +
+			"7. heal the network and wait for eventual consistency (11s); " +
+			"8. do reads on writes of step 4 and 6 (from all nodes, all with CM={}) and expect latest values for keys" +
+			" [1, N] and consistent values from all nodes (tie-breaking) for keys [N+1, 2N]. " +
+			"Steps 4-6 each have 10 points and step 8 has 20 points for a total of 50.",
+	)
+
+	cluster := c.cluster()
+	score := 0
+	defer func(s *int) {
+		log.WithField("finalScore", *s).Info("test completed.")
+	}(&score)
+
+	if v.NumNodes < 2*v.NumShards {
+		log.Errorf("bad test config; need at least two nodes per shard to split the cluster (%s)", v.String())
+		return score, nil
+	}
+
+	if err := PreTestCleanup(ctx, cluster, c.Namespace, c.GroupName); err != nil {
+		log.Errorf("pre-test cleanup faild: %v", err)
+		return score, infraError(err)
+	}
+
+	if err := cluster.CreatePods(ctx, c.Namespace, c.GroupName, c.Image(), 1, v.NumNodes); err != nil {
+		log.Errorf("test start failed; failed to create pods: %v", err)
+		return score, infraError(err)
+	}
+	defer PostTestCleanup(cluster, c.Namespace, c.GroupName)
+	defer artifacts.FollowLogs(ctx, cluster, c.Namespace, c.GroupName, c.ArtifactDir, "asymmetricPartition", log)()
+	defer monitor.Start(ctx, cluster, c.Namespace, c.GroupName, log)()
+
+	log.Info("nodes created, waiting for them to start up")
+	if err := cluster.AwaitReady(ctx, c.Namespace, k8s.GroupLabels(c.GroupName)); err != nil {
+		log.Errorf("test start failed; nodes did not start: %v", err)
+		return score, infraError(err)
+	}
+
+	// PUT view
+	addrMappings, err := cluster.ListAddressGroupIndexMappings(ctx, c.Namespace, k8s.GroupLabels(c.GroupName))
+	if err != nil {
+		log.Errorf("test start failed; failed to list pod addresses: %v", err)
+		return score, infraError(err)
+	}
+	log.Info("putting view to the nodes")
+	addresses := k8s.PodAddrsFromMappings(addrMappings)
+	statusCode, err := kvs4client.PutView(ctx, addresses[len(addresses)-1], kvs4client.ViewReq{Nodes: addresses, NumShards: v.NumShards})
+	if err != nil {
+		log.Errorf("failed to put view: %v", err)
+		return score, nil
+	}
+	if statusCode != 200 {
+		log.WithFields(logrus.Fields{
+			"expected": 200,
+			"received": statusCode,
+		}).Error("bad status code for put view")
+		return score, nil
+	}
+	log.Info("put view successful")
+
+	log.Info("sleeping for 10s (to let nodes set up the view)")
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
+
+	// GET view
+	log.Info("getting views from nodes and checking consistency")
+	var view kvs4client.ViewResp
+	if view, err = TestViewsConsistent(ctx, addresses, v); err != nil {
+		log.Errorf("get view failed: %v", err)
+		return score, nil
+	}
+	log.Info("get view from all nodes successful and all views consistent")
+
+	// Partition
+	parts := GenPartitions(view)
+	sideA := parts[0]
+	var sideB []string
+	for _, part := range parts[1:] {
+		sideB = append(sideB, part...)
+	}
+	log.WithFields(logrus.Fields{
+		"sideA": sideA,
+		"sideB": sideB,
+	}).Info("partitioning the nodes so that side A can reach side B but side B cannot reach side A")
+	if err = k8s.ApplyOneWay(ctx, cluster, c.Namespace, c.GroupName, sideB, sideA, addrMappings); err != nil {
+		log.Errorf("failed to partition the nodes: %v", err)
+		return score, infraError(err)
+	}
+
+	// Dependent Puts
+	dependentSprayConf := SprayConfig{
+		addresses:           sideA,
+		minI:                1,
+		maxI:                v.NumNodes,
+		minJ:                1,
+		maxJ:                3,
+		cm:                  nil,
+		noCm:                false,
+		acceptedStatusCodes: []int{200, 201},
+	}
+	log.Infof("putting dependent key-value pairs (reusing CM) to side A, minKeyIndex=%d, maxKeyIndex=%d, "+
+		"minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.minJ, dependentSprayConf.maxJ)
+	if dependentSprayConf.cm, err = SprayPuts(ctx, dependentSprayConf); err != nil {
+		log.Errorf("failed to put dependent key-value pairs: %v", err)
+		return score, nil
+	}
+	score += 10
+	log.WithField("score", score).Info("score +10 - put dependent key-value pairs successful")
+
+	// Dependent Gets
+	dependentSprayConf.addresses = sideB
+	dependentSprayConf.minJ = dependentSprayConf.maxJ
+	dependentSprayConf.acceptedStatusCodes = []int{200, 500, 503}
+	log.Infof("getting dependent key-value pairs (reusing CM) from side B and expecting latest value or "+
+		"stall-fail, minKeyIndex=%d, maxKeyIndex=%d, expectedValIndex=%d",
+		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.maxJ)
+	if _, err = SprayGets(ctx, dependentSprayConf); err != nil {
+		log.Warnf("failed to get dependent key-value pairs: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - get dependent key-value pairs successful")
+	}
+
+	// Independent Puts
+	independentSprayConf := SprayConfig{
+		addresses:           sideB,
+		minI:                v.NumNodes + 1,
+		maxI:                2 * v.NumNodes,
+		minJ:                1,
+		maxJ:                3,
+		cm:                  nil,
+		noCm:                true,
+		acceptedStatusCodes: []int{200, 201},
+	}
+	log.Infof("putting independent key-value pairs (CM={}) to side B, minKeyIndex=%d, maxKeyIndex=%d, "+
+		"minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
+	if _, err = SprayPuts(ctx, independentSprayConf); err != nil {
+		log.Warnf("failed to put independent key-value pairs: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - put independent key-value pairs successful")
+	}
+
+	// Heal network
+	log.Info("healing network partitions")
+	if err = k8s.HealPartition(ctx, cluster, c.Namespace, c.GroupName, addrMappings); err != nil {
+		log.Errorf("failed to delete pod network policies: %v", err)
+		return score, infraError(err)
+	}
+	log.Info("sleeping for 11s (to let nodes become eventually consistent)")
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
+
+	// Dependent Gets
+	dependentSprayConf.addresses = addresses
+	dependentSprayConf.acceptedStatusCodes = []int{200}
+	dependentSprayConf.cm = nil
+	dependentSprayConf.noCm = true
+	log.Infof("getting dependent key-value pairs (with CM={}) from all nodes and expecting latest value, "+
+		"minKeyIndex=%d, maxKeyIndex=%d, expectedValIndex=%d",
+		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.maxJ)
+	if _, err = SprayGets(ctx, dependentSprayConf); err != nil {
+		log.Warnf("failed to get dependent key-value pairs: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - get dependent key-value pairs successful")
+	}
+	// Independent Gets
+	independentSprayConf.addresses = addresses
+	independentSprayConf.acceptedStatusCodes = []int{200}
+	log.Infof("getting independent key-value pairs (with CM={}) from all nodes and expecting consistent values, "+
+		"minKeyIndex=%d, maxKeyIndex=%d, minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
+	if _, err = SprayGets(ctx, independentSprayConf); err != nil {
+		log.Warnf("failed to get independent key-value pairs: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - get independent key-value pairs successful")
+	}
+
+	return score, nil
+}
@@ -1,97 +1,97 @@
 package kvs4
 
 import (
+	"context"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs4client"
 )
 
 const BasicKVMaxScore = 70
 
-func BasicKvTest(c TestConfig, v ViewConfig) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func BasicKvTest(ctx context.Context, c TestConfig, v ViewConfig) (int, error) {
+	log := c.logger().WithFields(logrus.Fields{
 		"test":  "basicKeyVal",
 		"group": c.GroupName,
 	})
 	log.WithField("viewConfig", v.String()).Info(
 		"starting test. Steps: " +
-			"1. create a cluster (launch processes; wait 10s; PUT view); " +
+			"1. create a cluster (launch processes; wait until they answer; PUT view; wait 10s); " +
 			"2. get the view from all nodes and expect consistency; " +
 			"3. do non-causally-dependent writes (all with CM={}) sprayed across all nodes (keys [1, N]); " +
 			"4. do causally-dependent writes (use CM received after first req in second and so on) sprayed across" +
 			" all nodes (keys [N+1, 2N]); " +
 			"5. do reads on writes of step 4 (from all nodes, all with reused CM (frm previous access or the end of step 4))" +
 			" and expect latest values; " +
-			"6. wait for eventual consistency (10s); " +
+			"6. wait for eventual consistency (11s); " +
 			"7. do reads on writes of step 3 (from all nodes, all with CM={}) and expect consistent values from" +
 			" all nodes (tie-breaking); " +
 			"8. get key list and expect total to be 2N. " +
 			"Steps 1-5 and 7-8 each have 10 points for a total of 70.",
 	)
 
-	k8sClient := k8s.Client{}
+	cluster := c.cluster()
 	score := 0
 	defer func(s *int) {
 		log.WithField("finalScore", *s).Info("test completed.")
 	}(&score)
 
-	if err := PreTestCleanup(k8sClient, c.Namespace, c.GroupName); err != nil {
+	if err := PreTestCleanup(ctx, cluster, c.Namespace, c.GroupName); err != nil {
 		log.Errorf("pre-test cleanup faild: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
-	if err := k8sClient.CreatePods(c.Namespace, c.GroupName, c.Image(), 1, v.NumNodes); err != nil {
+	if err := cluster.CreatePods(ctx, c.Namespace, c.GroupName, c.Image(), 1, v.NumNodes); err != nil {
 		log.Errorf("test start failed; failed to create pods: %v", err)
-		return score
-	}
-	defer PostTestCleanup(k8sClient, c.Namespace, c.GroupName)
-	defer func() {
-		log.Info("Here are your process logs (for finding what went wrong...)")
-		logs, err := k8sClient.GetPodLogs(c.Namespace, k8s.GroupLabels(c.GroupName))
-		if err != nil {
-			log.Errorf("failed to get pods' logs: %v", err)
-			return
-		}
-		for idx, l := range logs {
-			log.Infof("log idx=%d (indices not stable): %s", idx, l)
-		}
-	}()
-
-	log.Info("nodes created, sleeping for 10s (to let nodes start up)")
-	time.Sleep(10 * time.Second)
+		return score, infraError(err)
+	}
+	defer PostTestCleanup(cluster, c.Namespace, c.GroupName)
+	defer artifacts.FollowLogs(ctx, cluster, c.Namespace, c.GroupName, c.ArtifactDir, "basicKeyVal", log)()
+	defer monitor.Start(ctx, cluster, c.Namespace, c.GroupName, log)()
+
+	log.Info("nodes created, waiting for them to start up")
+	if err := cluster.AwaitReady(ctx, c.Namespace, k8s.GroupLabels(c.GroupName)); err != nil {
+		log.Errorf("test start failed; nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
 	// PUT view
-	addresses, err := k8sClient.ListPodAddresses(c.Namespace, k8s.GroupLabels(c.GroupName))
+	addresses, err := cluster.ListPodAddresses(ctx, c.Namespace, k8s.GroupLabels(c.GroupName))
 	if err != nil {
 		log.Errorf("test start failed; failed to list pod addresses: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
 	log.Info("putting view to the nodes")
-	statusCode, err := kvs4client.PutView(addresses[len(addresses)-1], kvs4client.ViewReq{Nodes: addresses, NumShards: v.NumShards})
+	statusCode, err := kvs4client.PutView(ctx, addresses[len(addresses)-1], kvs4client.ViewReq{Nodes: addresses, NumShards: v.NumShards})
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
 			"expected": 200,
 			"received": statusCode,
 		}).Error("bad status code for put view")
-		return score
+		return score, nil
 	}
 	score += 10
 	log.WithField("score", score).Info("score +10 - put view successful")
 
 	log.Info("sleeping for 10s (to let nodes set up the view)")
-	time.Sleep(10 * time.Second)
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// GET view
 	log.Info("getting views from nodes and checking consistency")
-	if _, err := TestViewsConsistent(addresses, v); err != nil {
+	if _, err := TestViewsConsistent(ctx, addresses, v); err != nil {
 		log.Warnf("get view error: %v", err)
 	} else {
 		score += 10
@@ -112,9 +112,9 @@ func BasicKvTest(c TestConfig, v ViewConfig) int {
 	log.Infof("putting independent key-value pairs (CM={}) to all nodes, minKeyIndex=%d, maxKeyIndex=%d, "+
 		"minValIndexPerKey=%d, maxValIndexPerKey=%d",
 		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
-	if _, err = SprayPuts(independentSprayConf); err != nil {
+	if _, err = SprayPuts(ctx, independentSprayConf); err != nil {
 		log.Errorf("failed to put independent key-value pairs: %v", err)
-		return score
+		return score, nil
 	}
 	score += 10
 	log.WithField("score", score).Info("score +10 - put independent key-value pairs successful")
@@ -134,9 +134,9 @@ func BasicKvTest(c TestConfig, v ViewConfig) int {
 		"minValIndexPerKey=%d, maxValIndexPerKey=%d",
 		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.minJ, dependentSprayConf.maxJ)
 
-	if dependentSprayConf.cm, err = SprayPuts(dependentSprayConf); err != nil {
+	if dependentSprayConf.cm, err = SprayPuts(ctx, dependentSprayConf); err != nil {
 		log.Errorf("failed to put dependent key-value pairs: %v", err)
-		return score
+		return score, nil
 	}
 	score += 10
 	log.WithField("score", score).Info("score +10 - put dependent key-value pairs successful")
@@ -147,7 +147,7 @@ func BasicKvTest(c TestConfig, v ViewConfig) int {
 	log.Infof("getting dependent key-value pairs (reusing CM) from all nodes and expecting latest value, "+
 		"minKeyIndex=%d, maxKeyIndex=%d, expectedValIndex=%d",
 		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.maxJ)
-	if dependentSprayConf.cm, err = SprayGets(dependentSprayConf); err != nil {
+	if dependentSprayConf.cm, err = SprayGets(ctx, dependentSprayConf); err != nil {
 		log.Warnf("failed to get dependent key-value pairs: %v", err)
 	} else {
 		score += 10
@@ -156,14 +156,17 @@ func BasicKvTest(c TestConfig, v ViewConfig) int {
 
 	// Sleep
 	log.Info("sleeping for 11s (to let nodes become eventually consistent)")
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// Independent Gets
 	independentSprayConf.acceptedStatusCodes = []int{200}
 	log.Infof("getting independent key-value pairs (with CM={}) from all nodes and expecting consistent values, "+
 		"minKeyIndex=%d, maxKeyIndex=%d, minValIndexPerKey=%d, maxValIndexPerKey=%d",
 		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
-	if _, err := SprayGets(independentSprayConf); err != nil {
+	if _, err := SprayGets(ctx, independentSprayConf); err != nil {
 		log.Warnf("failed to get independent key-value pairs: %v", err)
 	} else {
 		score += 10
@@ -172,12 +175,12 @@ func BasicKvTest(c TestConfig, v ViewConfig) int {
 
 	// Key List
 	log.Info("getting key list from all nodes and expecting 2N nodes in total")
-	if _, err = TestKeyLists(addresses, 1, 2*v.NumNodes); err != nil {
+	if _, err = TestKeyLists(ctx, addresses, 1, 2*v.NumNodes); err != nil {
 		log.Errorf("key list failed: %v", err)
-		return score
+		return score, nil
 	}
 	score += 10
 	log.WithField("score", score).Info("score +10 - get key lists successful")
 
-	return score
+	return score, nil
 }
@@ -1,13 +1,17 @@
 package kvs4
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"k8s.io/utils/strings/slices"
 
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs4client"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/registry"
 )
 
 type ViewConfig struct {
@@ -23,39 +27,98 @@ type TestConfig struct {
 	Registry  string
 	GroupName string
 	ImageTag  string
-	Namespace string
+	// ImageRef, if set, is the nodes' image instead of the one made of Registry, GroupName and ImageTag.
+	ImageRef string
+	// ImageDigest, if set, pins the nodes' image to that build of the tag (see registry.ResolveDigest).
+	ImageDigest string
+	Namespace   string
+	// Backend runs the nodes; a Kubernetes client is used when nil.
+	Backend k8s.ClusterBackend
+	// Logger configures where and how the tests log; they log to stderr when nil.
+	Logger *logrus.Logger
+	// ArtifactDir is where the tests save process logs, in a directory per test; they are logged when empty.
+	ArtifactDir string
 }
 
 func (c TestConfig) Image() string {
+	image := fmt.Sprintf("%s/%s:%s", c.Registry, c.GroupName, c.ImageTag)
 	if c.Registry == "" {
-		return fmt.Sprintf("%s:%s", c.GroupName, c.ImageTag)
+		image = fmt.Sprintf("%s:%s", c.GroupName, c.ImageTag)
 	}
-	return fmt.Sprintf("%s/%s:%s", c.Registry, c.GroupName, c.ImageTag)
+	if c.ImageRef != "" {
+		image = c.ImageRef
+	}
+	if c.ImageDigest != "" {
+		return registry.Pin(image, c.ImageDigest)
+	}
+	return image
+}
+
+func (c TestConfig) logger() *logrus.Logger {
+	// Each test gets a logger of its own, which it can add hooks to.
+	res := logrus.New()
+	if c.Logger != nil {
+		res.SetOutput(c.Logger.Out)
+		res.SetFormatter(c.Logger.Formatter)
+		res.SetLevel(c.Logger.Level)
+	}
+	return res
+}
+
+// infraError returns err if the grading environment is to blame for it, and nil otherwise. Tests return it next to
+// their score, so that a failure of the environment isn't mistaken for one of the tested code.
+func infraError(err error) error {
+	if k8s.IsInfraError(err) {
+		return err
+	}
+	return nil
+}
+
+// sleep waits for d, or until ctx is done, in which case it returns ctx's error.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c TestConfig) cluster() k8s.ClusterBackend {
+	if c.Backend == nil {
+		return &k8s.Client{}
+	}
+	return c.Backend
 }
 
-func PreTestCleanup(kc k8s.Client, namespace, groupName string) error {
-	if err := kc.DeletePods(namespace, k8s.GroupLabels(groupName)); err != nil {
+func PreTestCleanup(ctx context.Context, kc k8s.ClusterBackend, namespace, groupName string) error {
+	if err := kc.DeletePods(ctx, namespace, k8s.GroupLabels(groupName)); err != nil {
 		return fmt.Errorf("failed to delete pods: %w", err)
 	}
-	if err := kc.AwaitDeletion(namespace, k8s.GroupLabels(groupName)); err != nil {
+	if err := kc.AwaitDeletion(ctx, namespace, k8s.GroupLabels(groupName)); err != nil {
 		return fmt.Errorf("failed when awaiting deletion of pods: %w", err)
 	}
-	if err := kc.DeleteNetPolicies(namespace, k8s.GroupLabels(groupName)); err != nil {
+	if err := kc.DeleteNetPolicies(ctx, namespace, k8s.GroupLabels(groupName)); err != nil {
 		return fmt.Errorf("failed to delete network policies: %w", err)
 	}
 	return nil
 }
 
-func PostTestCleanup(kc k8s.Client, namespace, groupName string) {
-	_ = kc.DeletePods(namespace, k8s.GroupLabels(groupName))
-	_ = kc.AwaitDeletion(namespace, k8s.GroupLabels(groupName))
-	_ = kc.DeleteNetPolicies(namespace, k8s.GroupLabels(groupName))
+// PostTestCleanup deletes the group's nodes and network policies, even if the test ran out of time.
+func PostTestCleanup(kc k8s.ClusterBackend, namespace, groupName string) {
+	ctx, cancel := k8s.CleanupContext()
+	defer cancel()
+	_ = kc.DeletePods(ctx, namespace, k8s.GroupLabels(groupName))
+	_ = kc.AwaitDeletion(ctx, namespace, k8s.GroupLabels(groupName))
+	_ = kc.DeleteNetPolicies(ctx, namespace, k8s.GroupLabels(groupName))
 }
 
-func TestViewsConsistent(addresses []string, conf ViewConfig) (kvs4client.ViewResp, error) {
+func TestViewsConsistent(ctx context.Context, addresses []string, conf ViewConfig) (kvs4client.ViewResp, error) {
 	firstView := kvs4client.ViewResp{}
 	for idx, addr := range addresses {
-		resp, statusCode, err := kvs4client.GetView(addr)
+		resp, statusCode, err := kvs4client.GetView(ctx, addr)
 		if err != nil {
 			return kvs4client.ViewResp{}, fmt.Errorf("failed to get view from node %s: %w", addr, err)
 		}
@@ -114,7 +177,7 @@ type SprayConfig struct {
 	acceptedStatusCodes    []int
 }
 
-func SprayPuts(conf SprayConfig) (kvs4client.CausalMetadata, error) {
+func SprayPuts(ctx context.Context, conf SprayConfig) (kvs4client.CausalMetadata, error) {
 	cm := conf.cm
 	for i := conf.minI; i <= conf.maxI; i++ {
 		for j := conf.minJ; j <= conf.maxJ; j++ {
@@ -132,7 +195,7 @@ func SprayPuts(conf SprayConfig) (kvs4client.CausalMetadata, error) {
 			}
 			var statusCode int
 			var err error
-			cm, statusCode, err = kvs4client.PutKeyVal(conf.addresses[nodeIdx], key, val, cm)
+			cm, statusCode, err = kvs4client.PutKeyVal(ctx, conf.addresses[nodeIdx], key, val, cm)
 			if err != nil {
 				return nil, fmt.Errorf("%s, got error: %v", errorDetails, err)
 			}
@@ -158,7 +221,7 @@ func contains(list []int, val int) bool {
 	return false
 }
 
-func SprayGets(conf SprayConfig) (kvs4client.CausalMetadata, error) {
+func SprayGets(ctx context.Context, conf SprayConfig) (kvs4client.CausalMetadata, error) {
 	cm := conf.cm
 	receivedVals := make(map[string]string)
 	for i := conf.minI; i <= conf.maxI; i++ {
@@ -183,7 +246,7 @@ func SprayGets(conf SprayConfig) (kvs4client.CausalMetadata, error) {
 		var val string
 		var statusCode int
 		var err error
-		val, cm, statusCode, err = kvs4client.GetKey(conf.addresses[nodeIdx], key, cm)
+		val, cm, statusCode, err = kvs4client.GetKey(ctx, conf.addresses[nodeIdx], key, cm)
 		if err != nil {
 			return nil, fmt.Errorf("%s, got error: %v", errorDetails, err)
 		}
@@ -216,31 +279,19 @@ func max(a, b int) int {
 }
 
 func GenPartitions(v kvs4client.ViewResp) [][]string {
-	numParts := 0
+	var shards [][]string
 	for _, s := range v.View {
-		if numParts == 0 || numParts > len(s.Nodes) {
-			numParts = len(s.Nodes)
-		}
+		shards = append(shards, s.Nodes)
 	}
-	res := make([][]string, numParts)
-	for _, s := range v.View {
-		for idx, node := range s.Nodes {
-			targetIdx := idx
-			if targetIdx >= numParts {
-				targetIdx = numParts - 1
-			}
-			res[targetIdx] = append(res[targetIdx], node)
-		}
-	}
-	return res
+	return k8s.OnePerShard(shards).Groups
 }
 
-func TestKeyLists(addresses []string, minI, maxI int) (map[string]map[string]struct{}, error) {
+func TestKeyLists(ctx context.Context, addresses []string, minI, maxI int) (map[string]map[string]struct{}, error) {
 	shardKeys := make(map[string]map[string]struct{})
 	exists := struct{}{}
 	shardCounts := make(map[string]int)
 	for idx, addr := range addresses {
-		res, statusCode, err := kvs4client.GetKeyList(addr, nil)
+		res, statusCode, err := kvs4client.GetKeyList(ctx, addr, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get key list from node %d: %w", idx+1, err)
 		}
@@ -0,0 +1,210 @@
+package kvs4
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs4client"
+)
+
+const CrashRejoinMaxScore = 40
+
+// CrashRejoinTest restarts nodes, which lose everything they held, and expects them to catch up once they are put
+// back into the view. The restarted nodes have to keep their addresses, so in Kubernetes it needs STABLE_ADDRESSES or
+// PROXY_NODES.
+func CrashRejoinTest(ctx context.Context, c TestConfig, v ViewConfig) (int, error) {
+	log := c.logger().WithFields(logrus.Fields{
+		"test":  "crash-rejoin",
+		"group": c.GroupName,
+	})
+	log.WithField("viewConfig", v.String()).Info(
+		"starting test. Steps: " +
+			"1. create a cluster (launch processes; wait until they answer; PUT view; wait 10s); " +
+			"2. get the view from all nodes and expect consistency; " +
+			"3. do non-causally-dependent writes (all with CM={}) sprayed across all nodes (keys [1, N]); " +
+			"4. restart one node from each shard (it crashes and comes back on the same address, with no state); " +
+			"5. PUT the same view again to one of the other nodes and wait for it to take effect (10s); " +
+			"6. get the view from all nodes and expect consistency; " +
+			"7. do reads on writes of step 3 (from the restarted nodes, all with CM={}) and expect consistent values " +
+			"(tie-breaking) for keys [1, N]. " +
+			"Steps 3 and 6 each have 10 points and step 7 has 20 points for a total of 40.",
+	)
+
+	cluster := c.cluster()
+	score := 0
+	defer func(s *int) {
+		log.WithField("finalScore", *s).Info("test completed.")
+	}(&score)
+
+	if v.NumNodes < 2*v.NumShards {
+		log.Errorf("bad test config; need at least two nodes per shard to restart one of them (%s)", v.String())
+		return score, nil
+	}
+
+	if err := PreTestCleanup(ctx, cluster, c.Namespace, c.GroupName); err != nil {
+		log.Errorf("pre-test cleanup faild: %v", err)
+		return score, infraError(err)
+	}
+
+	if err := cluster.CreatePods(ctx, c.Namespace, c.GroupName, c.Image(), 1, v.NumNodes); err != nil {
+		log.Errorf("test start failed; failed to create pods: %v", err)
+		return score, infraError(err)
+	}
+	defer PostTestCleanup(cluster, c.Namespace, c.GroupName)
+	defer artifacts.FollowLogs(ctx, cluster, c.Namespace, c.GroupName, c.ArtifactDir, "crash-rejoin", log)()
+	defer monitor.Start(ctx, cluster, c.Namespace, c.GroupName, log)()
+
+	log.Info("nodes created, waiting for them to start up")
+	if err := cluster.AwaitReady(ctx, c.Namespace, k8s.GroupLabels(c.GroupName)); err != nil {
+		log.Errorf("test start failed; nodes did not start: %v", err)
+		return score, infraError(err)
+	}
+
+	// PUT view
+	addrMappings, err := cluster.ListAddressGroupIndexMappings(ctx, c.Namespace, k8s.GroupLabels(c.GroupName))
+	if err != nil {
+		log.Errorf("test start failed; failed to list pod addresses: %v", err)
+		return score, infraError(err)
+	}
+	log.Info("putting view to the nodes")
+	addresses := k8s.PodAddrsFromMappings(addrMappings)
+	viewReq := kvs4client.ViewReq{Nodes: addresses, NumShards: v.NumShards}
+	statusCode, err := kvs4client.PutView(ctx, addresses[len(addresses)-1], viewReq)
+	if err != nil {
+		log.Errorf("failed to put view: %v", err)
+		return score, nil
+	}
+	if statusCode != 200 {
+		log.WithFields(logrus.Fields{
+			"expected": 200,
+			"received": statusCode,
+		}).Error("bad status code for put view")
+		return score, nil
+	}
+	log.Info("put view successful")
+
+	log.Info("sleeping for 10s (to let nodes set up the view)")
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
+
+	// GET view
+	log.Info("getting views from nodes and checking consistency")
+	var view kvs4client.ViewResp
+	if view, err = TestViewsConsistent(ctx, addresses, v); err != nil {
+		log.Errorf("get view failed: %v", err)
+		return score, nil
+	}
+	log.Info("get view from all nodes successful and all views consistent")
+
+	// Independent Puts
+	independentSprayConf := SprayConfig{
+		addresses:           addresses,
+		minI:                1,
+		maxI:                v.NumNodes,
+		minJ:                1,
+		maxJ:                3,
+		cm:                  nil,
+		noCm:                true,
+		acceptedStatusCodes: []int{200, 201},
+	}
+	log.Infof("putting independent key-value pairs (CM={}) to all nodes, minKeyIndex=%d, maxKeyIndex=%d, "+
+		"minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
+	if _, err = SprayPuts(ctx, independentSprayConf); err != nil {
+		log.Errorf("failed to put independent key-value pairs: %v", err)
+		return score, nil
+	}
+	score += 10
+	log.WithField("score", score).Info("score +10 - put independent key-value pairs successful")
+
+	// Restart
+	var restarted []string
+	isRestarted := make(map[string]bool)
+	for _, s := range view.View {
+		addr := s.Nodes[len(s.Nodes)-1]
+		restarted = append(restarted, addr)
+		isRestarted[addr] = true
+	}
+	log.Info("restarting one node from each shard")
+	for _, addr := range restarted {
+		labels := k8s.PodLabelsNoBatch(c.GroupName, addrMappings[addr].Index)
+		if err = cluster.RestartPods(ctx, c.Namespace, labels); err != nil {
+			log.Errorf("failed to restart node %s: %v", addr, err)
+			return score, infraError(err)
+		}
+	}
+	newMappings, err := cluster.ListAddressGroupIndexMappings(ctx, c.Namespace, k8s.GroupLabels(c.GroupName))
+	if err != nil {
+		log.Errorf("failed to list pod addresses: %v", err)
+		return score, infraError(err)
+	}
+	for _, addr := range restarted {
+		if _, ok := newMappings[addr]; !ok {
+			err = &k8s.InfraError{Err: fmt.Errorf(
+				"restarted node %s came back on a new address; set STABLE_ADDRESSES or PROXY_NODES", addr)}
+			log.Errorf("%v", err)
+			return score, err
+		}
+	}
+	log.Info("restart successful")
+
+	// PUT view again
+	var live string
+	for _, addr := range addresses {
+		if !isRestarted[addr] {
+			live = addr
+		}
+	}
+	log.Infof("putting the same view to %s to bring the restarted nodes back", live)
+	statusCode, err = kvs4client.PutView(ctx, live, viewReq)
+	if err != nil {
+		log.Errorf("failed to put view: %v", err)
+		return score, nil
+	}
+	if statusCode != 200 {
+		log.WithFields(logrus.Fields{
+			"expected": 200,
+			"received": statusCode,
+		}).Error("bad status code for put view")
+		return score, nil
+	}
+	log.Info("put view successful")
+
+	log.Info("sleeping for 10s (to let nodes set up the view)")
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
+
+	// GET view
+	log.Info("getting views from nodes and checking consistency")
+	if _, err = TestViewsConsistent(ctx, addresses, v); err != nil {
+		log.Warnf("get view failed: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - get view from all nodes successful and all views consistent")
+	}
+
+	// Independent Gets
+	independentSprayConf.addresses = restarted
+	independentSprayConf.acceptedStatusCodes = []int{200}
+	log.Infof("getting independent key-value pairs (with CM={}) from the restarted nodes and expecting consistent "+
+		"values, minKeyIndex=%d, maxKeyIndex=%d, minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
+	if _, err = SprayGets(ctx, independentSprayConf); err != nil {
+		log.Warnf("failed to get independent key-value pairs: %v", err)
+	} else {
+		score += 20
+		log.WithField("score", score).Info("score +20 - get independent key-value pairs successful")
+	}
+
+	return score, nil
+}
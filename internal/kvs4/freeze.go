@@ -0,0 +1,237 @@
+package kvs4
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs4client"
+)
+
+const FreezeMaxScore = 50
+
+func FreezeTest(ctx context.Context, c TestConfig, v ViewConfig) (int, error) {
+	log := c.logger().WithFields(logrus.Fields{
+		"test":  "freeze",
+		"group": c.GroupName,
+	})
+	log.WithField("viewConfig", v.String()).Info(
+		"starting test. Steps: " +
+			"1. create a cluster (launch processes; wait until they answer; PUT view; wait 10s); " +
+			"2. get the view from all nodes and expect consistency; " +
+			"3. freeze one node from each shard (its processes stop, but its connections stay open); " +
+			"4. do non-causally-dependent writes (all with CM={}) sprayed across the other nodes (keys [1, N]); " +
+			"5. do causally-dependent writes (use CM received after first req in second and so on) sprayed across" +
+			" the other nodes (keys [N+1, 2N]); " +
+			"6. do reads on writes of step 5 (from the other nodes, all with reused CM) and expect latest values; " +
+			"7. thaw the frozen nodes and wait for eventual consistency (11s); " +
+			"8. do reads on writes of step 4 and 5 (from all nodes, all with CM={}) and expect consistent values from" +
+			" all nodes (tie-breaking) for keys [1, N] and latest values for keys [N+1, 2N]. " +
+			"Steps 4-6 each have 10 points and step 8 has 20 points for a total of 50.",
+	)
+
+	cluster := c.cluster()
+	score := 0
+	defer func(s *int) {
+		log.WithField("finalScore", *s).Info("test completed.")
+	}(&score)
+
+	if v.NumNodes < 2*v.NumShards {
+		log.Errorf("bad test config; need at least two nodes per shard to freeze one of them (%s)", v.String())
+		return score, nil
+	}
+
+	if err := PreTestCleanup(ctx, cluster, c.Namespace, c.GroupName); err != nil {
+		log.Errorf("pre-test cleanup faild: %v", err)
+		return score, infraError(err)
+	}
+
+	if err := cluster.CreatePods(ctx, c.Namespace, c.GroupName, c.Image(), 1, v.NumNodes); err != nil {
+		log.Errorf("test start failed; failed to create pods: %v", err)
+		return score, infraError(err)
+	}
+	defer PostTestCleanup(cluster, c.Namespace, c.GroupName)
+	defer artifacts.FollowLogs(ctx, cluster, c.Namespace, c.GroupName, c.ArtifactDir, "freeze", log)()
+	defer monitor.Start(ctx, cluster, c.Namespace, c.GroupName, log)()
+
+	log.Info("nodes created, waiting for them to start up")
+	if err := cluster.AwaitReady(ctx, c.Namespace, k8s.GroupLabels(c.GroupName)); err != nil {
+		log.Errorf("test start failed; nodes did not start: %v", err)
+		return score, infraError(err)
+	}
+
+	// PUT view
+	addrMappings, err := cluster.ListAddressGroupIndexMappings(ctx, c.Namespace, k8s.GroupLabels(c.GroupName))
+	if err != nil {
+		log.Errorf("test start failed; failed to list pod addresses: %v", err)
+		return score, infraError(err)
+	}
+	log.Info("putting view to the nodes")
+	addresses := k8s.PodAddrsFromMappings(addrMappings)
+	statusCode, err := kvs4client.PutView(ctx, addresses[len(addresses)-1], kvs4client.ViewReq{Nodes: addresses, NumShards: v.NumShards})
+	if err != nil {
+		log.Errorf("failed to put view: %v", err)
+		return score, nil
+	}
+	if statusCode != 200 {
+		log.WithFields(logrus.Fields{
+			"expected": 200,
+			"received": statusCode,
+		}).Error("bad status code for put view")
+		return score, nil
+	}
+	log.Info("put view successful")
+
+	log.Info("sleeping for 10s (to let nodes set up the view)")
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
+
+	// GET view
+	log.Info("getting views from nodes and checking consistency")
+	var view kvs4client.ViewResp
+	if view, err = TestViewsConsistent(ctx, addresses, v); err != nil {
+		log.Errorf("get view failed: %v", err)
+		return score, nil
+	}
+	log.Info("get view from all nodes successful and all views consistent")
+
+	// Freeze
+	frozen := make(map[string]bool)
+	for _, s := range view.View {
+		frozen[s.Nodes[len(s.Nodes)-1]] = true
+	}
+	var liveAddrs []string
+	for _, addr := range addresses {
+		if !frozen[addr] {
+			liveAddrs = append(liveAddrs, addr)
+		}
+	}
+	thawed := false
+	thaw := func(ctx context.Context) error {
+		if thawed {
+			return nil
+		}
+		thawed = true
+		for addr := range frozen {
+			if err := cluster.ThawPods(ctx, c.Namespace, k8s.PodLabelsNoBatch(c.GroupName, addrMappings[addr].Index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// The nodes get deleted either way, but frozen ones would take their whole grace period. ctx may be done by then.
+	defer func() {
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		_ = thaw(ctx)
+	}()
+	log.Info("freezing one node from each shard")
+	for addr := range frozen {
+		if err = cluster.FreezePods(ctx, c.Namespace, k8s.PodLabelsNoBatch(c.GroupName, addrMappings[addr].Index)); err != nil {
+			log.Errorf("failed to freeze node %s: %v", addr, err)
+			return score, infraError(err)
+		}
+	}
+
+	// Independent Puts
+	independentSprayConf := SprayConfig{
+		addresses:           liveAddrs,
+		minI:                1,
+		maxI:                v.NumNodes,
+		minJ:                1,
+		maxJ:                3,
+		cm:                  nil,
+		noCm:                true,
+		acceptedStatusCodes: []int{200, 201},
+	}
+	log.Infof("putting independent key-value pairs (CM={}) to the nodes that are not frozen, minKeyIndex=%d, "+
+		"maxKeyIndex=%d, minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
+	if _, err = SprayPuts(ctx, independentSprayConf); err != nil {
+		log.Errorf("failed to put independent key-value pairs: %v", err)
+		return score, nil
+	}
+	score += 10
+	log.WithField("score", score).Info("score +10 - put independent key-value pairs successful")
+
+	// Dependent Puts
+	dependentSprayConf := SprayConfig{
+		addresses:           liveAddrs,
+		minI:                v.NumNodes + 1,
+		maxI:                2 * v.NumNodes,
+		minJ:                1,
+		maxJ:                3,
+		cm:                  nil,
+		noCm:                false,
+		acceptedStatusCodes: []int{200, 201},
+	}
+	log.Infof("putting dependent key-value pairs (reusing CM) to the nodes that are not frozen, minKeyIndex=%d, "+
+		"maxKeyIndex=%d, minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.minJ, dependentSprayConf.maxJ)
+	if dependentSprayConf.cm, err = SprayPuts(ctx, dependentSprayConf); err != nil {
+		log.Errorf("failed to put dependent key-value pairs: %v", err)
+		return score, nil
+	}
+	score += 10
+	log.WithField("score", score).Info("score +10 - put dependent key-value pairs successful")
+
+	// Dependent Gets
+	dependentSprayConf.minJ = dependentSprayConf.maxJ
+	dependentSprayConf.acceptedStatusCodes = []int{200}
+	log.Infof("getting dependent key-value pairs (reusing CM) from the nodes that are not frozen and expecting "+
+		"latest value, minKeyIndex=%d, maxKeyIndex=%d, expectedValIndex=%d",
+		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.maxJ)
+	if _, err = SprayGets(ctx, dependentSprayConf); err != nil {
+		log.Warnf("failed to get dependent key-value pairs: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - get dependent key-value pairs successful")
+	}
+
+	// Thaw
+	log.Info("thawing the frozen nodes")
+	if err = thaw(ctx); err != nil {
+		log.Errorf("failed to thaw nodes: %v", err)
+		return score, infraError(err)
+	}
+	// Sleep
+	log.Info("sleeping for 11s (to let nodes become eventually consistent)")
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
+
+	// Dependent Gets
+	dependentSprayConf.addresses = addresses
+	dependentSprayConf.cm = nil
+	dependentSprayConf.noCm = true
+	log.Infof("getting dependent key-value pairs (with CM={}) from all nodes and expecting latest value, "+
+		"minKeyIndex=%d, maxKeyIndex=%d, expectedValIndex=%d",
+		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.maxJ)
+	if _, err = SprayGets(ctx, dependentSprayConf); err != nil {
+		log.Warnf("failed to get dependent key-value pairs: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - get dependent key-value pairs successful")
+	}
+	// Independent Gets
+	independentSprayConf.addresses = addresses
+	independentSprayConf.acceptedStatusCodes = []int{200}
+	log.Infof("getting independent key-value pairs (with CM={}) from all nodes and expecting consistent values, "+
+		"minKeyIndex=%d, maxKeyIndex=%d, minValIndexPerKey=%d, maxValIndexPerKey=%d",
+		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
+	if _, err = SprayGets(ctx, independentSprayConf); err != nil {
+		log.Warnf("failed to get independent key-value pairs: %v", err)
+	} else {
+		score += 10
+		log.WithField("score", score).Info("score +10 - get independent key-value pairs successful")
+	}
+
+	return score, nil
+}
@@ -1,11 +1,14 @@
 package kvs4
 
 import (
+	"context"
 	"math"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs4client"
 )
@@ -14,8 +17,8 @@ const KeyDistExtraCredits = 2
 const KeyDistMaxScore = 50
 const thresholdPercent = 25
 
-func KeyDistTest(c TestConfig, n1, numKeys int) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func KeyDistTest(ctx context.Context, c TestConfig, n1, numKeys int) (int, error) {
+	log := c.logger().WithFields(logrus.Fields{
 		"test":  "keyDistribution",
 		"group": c.GroupName,
 	})
@@ -29,81 +32,78 @@ func KeyDistTest(c TestConfig, n1, numKeys int) int {
 	}).Info(
 		"starting test. Steps: " +
 			"1. create all needed nodes; " +
-			"2. put viewConfig1; " +
+			"2. put viewConfig1 and wait 10s; " +
 			"3. get view from all nodes and expect consistency; " +
 			"4. do numKeys causally independent writes sprayed across all nodes; " +
 			"5. sleep for 11 seconds; " +
 			"6. expect number of keys in each shard to be within thresholdPercent% of numKeys/s1; " +
-			"7. put viewConfig2; " +
+			"7. put viewConfig2 and wait 10s; " +
 			"8. get view from all nodes and expect consistency; " +
 			"9. expect number of keys in each shard to be within thresholdPercent% of numKeys/s2; " +
 			"10. expect number of keys moved to be within thresholdPercent% of numKeys/s2. " +
 			"Steps 4, 6, 9 each have 10 points and step 10 has 20 for a total of 50 (step 10 is extra credit).",
 	)
 
-	k8sClient := k8s.Client{}
+	cluster := c.cluster()
 	score := 0
 	defer func(s *int) {
 		log.WithField("finalScore", *s).Info("test completed.")
 	}(&score)
 
-	if err := PreTestCleanup(k8sClient, c.Namespace, c.GroupName); err != nil {
+	if err := PreTestCleanup(ctx, cluster, c.Namespace, c.GroupName); err != nil {
 		log.Errorf("pre-test cleanup faild: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
 	numNodes := v2.NumNodes
-	if err := k8sClient.CreatePods(c.Namespace, c.GroupName, c.Image(), 1, numNodes); err != nil {
+	if err := cluster.CreatePods(ctx, c.Namespace, c.GroupName, c.Image(), 1, numNodes); err != nil {
 		log.Errorf("test start failed; failed to create pods: %v", err)
-		return score
+		return score, infraError(err)
 	}
-	defer PostTestCleanup(k8sClient, c.Namespace, c.GroupName)
-	defer func() {
-		log.Info("Here are your process logs (for finding what went wrong...)")
-		logs, err := k8sClient.GetPodLogs(c.Namespace, k8s.GroupLabels(c.GroupName))
-		if err != nil {
-			log.Errorf("failed to get pods' logs: %v", err)
-			return
-		}
-		for idx, l := range logs {
-			log.Infof("log idx=%d (indices not stable): %s", idx, l)
-		}
-	}()
+	defer PostTestCleanup(cluster, c.Namespace, c.GroupName)
+	defer artifacts.FollowLogs(ctx, cluster, c.Namespace, c.GroupName, c.ArtifactDir, "keyDistribution", log)()
+	defer monitor.Start(ctx, cluster, c.Namespace, c.GroupName, log)()
 
-	log.Info("nodes created, sleeping for 10s (to let nodes start up)")
-	time.Sleep(10 * time.Second)
+	log.Info("nodes created, waiting for them to start up")
+	if err := cluster.AwaitReady(ctx, c.Namespace, k8s.GroupLabels(c.GroupName)); err != nil {
+		log.Errorf("test start failed; nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
 	// PUT view 1
-	allAddrs, err := k8sClient.ListPodAddresses(c.Namespace, k8s.GroupLabels(c.GroupName))
+	allAddrs, err := cluster.ListPodAddresses(ctx, c.Namespace, k8s.GroupLabels(c.GroupName))
 	if err != nil {
 		log.Errorf("test start failed; failed to list pod addresses: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	log.Infof("putting view 1 to the nodes (%s)", v1.String())
 	view1Addrs := allAddrs[:v1.NumNodes]
-	statusCode, err := kvs4client.PutView(view1Addrs[v1.NumNodes-1], kvs4client.ViewReq{Nodes: view1Addrs, NumShards: v1.NumShards})
+	statusCode, err := kvs4client.PutView(ctx, view1Addrs[v1.NumNodes-1], kvs4client.ViewReq{Nodes: view1Addrs, NumShards: v1.NumShards})
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
 			"expected": 200,
 			"received": statusCode,
 		}).Error("bad status code for put view")
-		return score
+		return score, nil
 	}
 	log.Info("put view 1 successful")
 
 	log.Info("sleeping for 10s (to let nodes set up the view)")
-	time.Sleep(10 * time.Second)
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// GET view 1
 	log.Info("getting views from nodes and checking consistency")
 	var view1 kvs4client.ViewResp
-	if view1, err = TestViewsConsistent(view1Addrs, v1); err != nil {
+	if view1, err = TestViewsConsistent(ctx, view1Addrs, v1); err != nil {
 		log.Errorf("get view failed: %v", err)
-		return score
+		return score, nil
 	}
 	log.Info("get view from all nodes successful and all views consistent")
 
@@ -120,28 +120,31 @@ func KeyDistTest(c TestConfig, n1, numKeys int) int {
 	}
 	log.Infof("putting %d independent key-value pairs (CM={}) to all nodes, minKeyIndex=%d, maxKeyIndex=%d, "+
 		"valIndex=%d", numKeys, sprayConf.minI, sprayConf.maxI, sprayConf.maxJ)
-	if _, err = SprayPuts(sprayConf); err != nil {
+	if _, err = SprayPuts(ctx, sprayConf); err != nil {
 		log.Errorf("failed to put independent key-value pairs: %v", err)
-		return score
+		return score, nil
 	}
 	score += 10
 	log.WithField("score", score).Infof("score +10 - put %d independent key-value pairs successful", numKeys)
 
 	// Sleep
 	log.Info("sleeping for 11s")
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// Key lists 1
 	log.Info("getting key lists from all nodes")
-	shardKeys1, err := TestKeyLists(view1Addrs, sprayConf.minI, sprayConf.maxI)
+	shardKeys1, err := TestKeyLists(ctx, view1Addrs, sprayConf.minI, sprayConf.maxI)
 	if err != nil {
 		log.Errorf("key list failed: %v", err)
-		return score
+		return score, nil
 	}
 	nodeKeys1, err := NodeKeySets(shardKeys1, view1)
 	if err != nil {
 		log.Errorf("failed to map nodes to keys: %v", err)
-		return score
+		return score, nil
 	}
 
 	// Check key dist 1
@@ -172,43 +175,46 @@ func KeyDistTest(c TestConfig, n1, numKeys int) int {
 	// PUT view 2
 	log.Infof("putting view 2 to the nodes (%s)", v2.String())
 	view2Addrs := allAddrs[:v2.NumNodes]
-	statusCode, err = kvs4client.PutView(view2Addrs[v2.NumNodes-1], kvs4client.ViewReq{Nodes: view2Addrs, NumShards: v2.NumShards})
+	statusCode, err = kvs4client.PutView(ctx, view2Addrs[v2.NumNodes-1], kvs4client.ViewReq{Nodes: view2Addrs, NumShards: v2.NumShards})
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
 			"expected": 200,
 			"received": statusCode,
 		}).Error("bad status code for put view")
-		return score
+		return score, nil
 	}
 	log.Info("put view 2 successful")
 
 	log.Info("sleeping for 10s (to let nodes set up the view)")
-	time.Sleep(10 * time.Second)
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// GET view 2
 	log.Info("getting views from nodes and checking consistency")
 	var view2 kvs4client.ViewResp
-	if view2, err = TestViewsConsistent(view2Addrs, v2); err != nil {
+	if view2, err = TestViewsConsistent(ctx, view2Addrs, v2); err != nil {
 		log.Errorf("get view failed: %v", err)
-		return score
+		return score, nil
 	}
 	log.Info("get view from all nodes successful and all views consistent")
 
 	// Key lists 2
 	log.Info("getting key lists from all nodes")
-	shardKeys2, err := TestKeyLists(view2Addrs, sprayConf.minI, sprayConf.maxI)
+	shardKeys2, err := TestKeyLists(ctx, view2Addrs, sprayConf.minI, sprayConf.maxI)
 	if err != nil {
 		log.Errorf("key list failed: %v", err)
-		return score
+		return score, nil
 	}
 	nodeKeys2, err := NodeKeySets(shardKeys2, view2)
 	if err != nil {
 		log.Errorf("failed to map nodes to keys: %v", err)
-		return score
+		return score, nil
 	}
 
 	// Check key dist 2
@@ -266,5 +272,5 @@ func KeyDistTest(c TestConfig, n1, numKeys int) int {
 		)
 	}
 
-	return score
+	return score, nil
 }
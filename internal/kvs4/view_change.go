@@ -1,19 +1,22 @@
 package kvs4
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/AKarbas/cse138-kuber-grader/internal/artifacts"
+	"github.com/AKarbas/cse138-kuber-grader/internal/monitor"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs4client"
 )
 
 const ViewChangeMaxScore = 40
 
-func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
-	log := logrus.New().WithFields(logrus.Fields{
+func ViewChangeTest(ctx context.Context, c TestConfig, v1, v2 ViewConfig, killNodes bool) (int, error) {
+	log := c.logger().WithFields(logrus.Fields{
 		"test":  "viewChange",
 		"group": c.GroupName,
 	})
@@ -23,60 +26,56 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 		"killNodes":   killNodes,
 	}).Info(
 		"starting test. Steps: " +
-			"1. create all needed nodes for the test some of which may be killed at step 6 (launch processes; wait 10s); " +
-			"2. put viewConfig1; " +
+			"1. create all needed nodes for the test some of which may be killed at step 6 (launch processes; wait until " +
+			"they answer); " +
+			"2. put viewConfig1 and wait 10s; " +
 			"3. get the view from all nodes and expect consistency; " +
 			"4. do non-causally-dependent writes (all with CM={}) sprayed across all nodes (keys [1, N]); " +
 			"5. do causally-dependent writes (use CM received after first req in second and so on) sprayed across" +
 			" all nodes (keys [N+1, 2N]); " +
-			"6. if killNodes==true, wait for eventual consistency and then kill all but one node from each shard; " +
-			"7. put viewConfig2 (possibly with new nodes if viewConfig2 has more nodes or some have been killed); " +
+			"6. wait for eventual consistency (11s) and then, if killNodes==true, kill all but one node from each shard; " +
+			"7. put viewConfig2 (possibly with new nodes if viewConfig2 has more nodes or some have been killed) and wait " +
+			"10s; " +
 			"8. get the view from all nodes and expect consistency; " +
 			"9. do reads on writes of step 4 and 5 (from all current nodes, all with CM={}) and expect consistent values" +
 			" from all nodes (tie-breaking) for keys [1, N] and latest values for keys [N+1, 2N]. " +
 			"Steps 7-8 each have 10 points and step 9 has 20 points for a total of 40.",
 	)
 
-	k8sClient := k8s.Client{}
+	cluster := c.cluster()
 	score := 0
 	defer func(s *int) {
 		log.WithField("finalScore", *s).Info("test completed.")
 	}(&score)
 
-	if err := PreTestCleanup(k8sClient, c.Namespace, c.GroupName); err != nil {
+	if err := PreTestCleanup(ctx, cluster, c.Namespace, c.GroupName); err != nil {
 		log.Errorf("pre-test cleanup faild: %v", err)
-		return score
+		return score, infraError(err)
 	}
 
 	numNodes := max(v1.NumNodes, v2.NumNodes)
 	if killNodes {
 		numNodes = v1.NumNodes + max(v2.NumNodes-v1.NumShards, 0)
 	}
-	if err := k8sClient.CreatePods(c.Namespace, c.GroupName, c.Image(), 1, numNodes); err != nil {
+	if err := cluster.CreatePods(ctx, c.Namespace, c.GroupName, c.Image(), 1, numNodes); err != nil {
 		log.Errorf("test start failed; failed to create pods: %v", err)
-		return score
-	}
-	defer PostTestCleanup(k8sClient, c.Namespace, c.GroupName)
-	defer func() {
-		log.Info("Here are your process logs (for finding what went wrong...)")
-		logs, err := k8sClient.GetPodLogs(c.Namespace, k8s.GroupLabels(c.GroupName))
-		if err != nil {
-			log.Errorf("failed to get pods' logs: %v", err)
-			return
-		}
-		for idx, l := range logs {
-			log.Infof("log idx=%d (indices not stable): %s", idx, l)
-		}
-	}()
+		return score, infraError(err)
+	}
+	defer PostTestCleanup(cluster, c.Namespace, c.GroupName)
+	defer artifacts.FollowLogs(ctx, cluster, c.Namespace, c.GroupName, c.ArtifactDir, "viewChange", log)()
+	defer monitor.Start(ctx, cluster, c.Namespace, c.GroupName, log)()
 
-	log.Info("nodes created, sleeping for 10s (to let nodes start up)")
-	time.Sleep(10 * time.Second)
+	log.Info("nodes created, waiting for them to start up")
+	if err := cluster.AwaitReady(ctx, c.Namespace, k8s.GroupLabels(c.GroupName)); err != nil {
+		log.Errorf("test start failed; nodes did not start: %v", err)
+		return score, infraError(err)
+	}
 
 	// PUT view 1
-	allAddrMappings, err := k8sClient.ListAddressGroupIndexMappings(c.Namespace, k8s.GroupLabels(c.GroupName))
+	allAddrMappings, err := cluster.ListAddressGroupIndexMappings(ctx, c.Namespace, k8s.GroupLabels(c.GroupName))
 	if err != nil {
 		log.Errorf("test start failed; failed to list pod addresses: %v", err)
-		return score
+		return score, infraError(err)
 	}
 	log.Infof("putting view 1 to the nodes (%s)", v1.String())
 	allAddrs := k8s.PodAddrsFromMappings(allAddrMappings)
@@ -84,30 +83,33 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 	if len(view1Addrs) != v1.NumNodes {
 		panic(fmt.Errorf("nodeAddrs count wrong for view 1, addrs=%v, n1=%d", view1Addrs, v1.NumNodes))
 	}
-	statusCode, err := kvs4client.PutView(view1Addrs[v1.NumNodes-1], kvs4client.ViewReq{Nodes: view1Addrs, NumShards: v1.NumShards})
+	statusCode, err := kvs4client.PutView(ctx, view1Addrs[v1.NumNodes-1], kvs4client.ViewReq{Nodes: view1Addrs, NumShards: v1.NumShards})
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
 			"expected": 200,
 			"received": statusCode,
 		}).Error("bad status code for put view")
-		return score
+		return score, nil
 	}
 	log.Info("put view 1 successful")
 
 	log.Info("sleeping for 10s (to let nodes set up the view)")
-	time.Sleep(10 * time.Second)
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// GET view1
 	log.Info("getting views from nodes and checking consistency")
 	var view kvs4client.ViewResp
-	if view, err = TestViewsConsistent(view1Addrs, v1); err != nil {
+	if view, err = TestViewsConsistent(ctx, view1Addrs, v1); err != nil {
 		if killNodes { // The rest of the test needs the view and it's not usable.
 			log.Errorf("get view failed: %v", err)
-			return score
+			return score, nil
 		}
 		log.Warnf("get view failed: %v", err)
 	} else {
@@ -128,7 +130,7 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 	log.Infof("putting independent key-value pairs (CM={}) to all nodes, minKeyIndex=%d, maxKeyIndex=%d, "+
 		"minValIndexPerKey=%d, maxValIndexPerKey=%d",
 		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
-	if _, err = SprayPuts(independentSprayConf); err != nil {
+	if _, err = SprayPuts(ctx, independentSprayConf); err != nil {
 		log.Warnf("failed to put independent key-value pairs: %v", err)
 	} else {
 		log.Info("put independent key-value pairs successful")
@@ -149,14 +151,17 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 		"minValIndexPerKey=%d, maxValIndexPerKey=%d",
 		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.minJ, dependentSprayConf.maxJ)
 
-	if dependentSprayConf.cm, err = SprayPuts(dependentSprayConf); err != nil {
+	if dependentSprayConf.cm, err = SprayPuts(ctx, dependentSprayConf); err != nil {
 		log.Warnf("failed to put dependent key-value pairs: %v", err)
 	} else {
 		log.Info("put dependent key-value pairs successful")
 	}
 
 	log.Info("sleeping for 11s")
-	time.Sleep(11 * time.Second)
+	if err := sleep(ctx, 11*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// Kill extra nodes
 	view2Addrs := allAddrs[:v2.NumNodes]
@@ -170,9 +175,15 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 		view2Addrs = append(toKeep, allAddrs[v1.NumNodes:]...)[:v2.NumNodes]
 		log.Info("killing all but one node from each shard")
 		for _, addr := range toKill {
-			if err = k8sClient.DeletePods(c.Namespace, k8s.PodLabelsNoBatch(c.GroupName, allAddrMappings[addr].Index)); err != nil {
+			if err = cluster.KillPods(ctx, c.Namespace, k8s.PodLabelsNoBatch(c.GroupName, allAddrMappings[addr].Index)); err != nil {
 				log.Errorf("failed to kill extra node: %v", err)
-				return score
+				return score, infraError(err)
+			}
+		}
+		for _, addr := range toKill {
+			if err = cluster.AwaitDeletion(ctx, c.Namespace, k8s.PodLabelsNoBatch(c.GroupName, allAddrMappings[addr].Index)); err != nil {
+				log.Errorf("failed when awaiting the death of extra node: %v", err)
+				return score, infraError(err)
 			}
 		}
 	}
@@ -182,27 +193,30 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 	if len(view2Addrs) != v2.NumNodes {
 		panic(fmt.Errorf("nodeAddrs count wrong for view 2, addrs=%v, n2=%d", view2Addrs, v2.NumNodes))
 	}
-	statusCode, err = kvs4client.PutView(view2Addrs[0], kvs4client.ViewReq{Nodes: view2Addrs, NumShards: v2.NumShards})
+	statusCode, err = kvs4client.PutView(ctx, view2Addrs[0], kvs4client.ViewReq{Nodes: view2Addrs, NumShards: v2.NumShards})
 	if err != nil {
 		log.Errorf("failed to put view: %v", err)
-		return score
+		return score, nil
 	}
 	if statusCode != 200 {
 		log.WithFields(logrus.Fields{
 			"expected": 200,
 			"received": statusCode,
 		}).Error("bad status code for put view")
-		return score
+		return score, nil
 	}
 	score += 10
 	log.WithField("score", score).Info("score +10 - put view 2 successful")
 
 	log.Info("sleeping for 10s (to let nodes set up the view)")
-	time.Sleep(10 * time.Second)
+	if err := sleep(ctx, 10*time.Second); err != nil {
+		log.Errorf("test stopped: %v", err)
+		return score, nil
+	}
 
 	// GET view2
 	log.Info("getting views from nodes and checking consistency")
-	if _, err = TestViewsConsistent(view2Addrs, v2); err != nil {
+	if _, err = TestViewsConsistent(ctx, view2Addrs, v2); err != nil {
 		log.Warnf("get view failed: %v", err)
 	} else {
 		score += 10
@@ -218,7 +232,7 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 	log.Infof("getting dependent key-value pairs (with CM={}) from all nodes and expecting latest value, "+
 		"minKeyIndex=%d, maxKeyIndex=%d, expectedValIndex=%d",
 		dependentSprayConf.minI, dependentSprayConf.maxI, dependentSprayConf.maxJ)
-	if _, err = SprayGets(dependentSprayConf); err != nil {
+	if _, err = SprayGets(ctx, dependentSprayConf); err != nil {
 		log.Warnf("failed to get dependent key-value pairs: %v", err)
 	} else {
 		score += 10
@@ -230,14 +244,12 @@ func ViewChangeTest(c TestConfig, v1, v2 ViewConfig, killNodes bool) int {
 	log.Infof("getting independent key-value pairs (with CM={}) from all nodes and expecting consistent values, "+
 		"minKeyIndex=%d, maxKeyIndex=%d, minValIndexPerKey=%d, maxValIndexPerKey=%d",
 		independentSprayConf.minI, independentSprayConf.maxI, independentSprayConf.minJ, independentSprayConf.maxJ)
-	if _, err = SprayGets(independentSprayConf); err != nil {
+	if _, err = SprayGets(ctx, independentSprayConf); err != nil {
 		log.Warnf("failed to get independent key-value pairs: %v", err)
 	} else {
 		score += 10
 		log.WithField("score", score).Info("score +10 - get independent key-value pairs successful")
 	}
 
-	return score
-
-	return score
+	return score, nil
 }
@@ -0,0 +1,91 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+// Report collects what Start found out about the nodes, for the tests run with the context it came with (see
+// WithReport).
+type Report struct {
+	mu     sync.Mutex
+	events []string
+}
+
+type reportKey struct{}
+
+// WithReport returns a context that makes Start add what it finds out to the returned report, besides logging it.
+func WithReport(ctx context.Context) (context.Context, *Report) {
+	r := &Report{}
+	return context.WithValue(ctx, reportKey{}, r), r
+}
+
+// Events returns what happened to the nodes, in the order Start found out.
+func (r *Report) Events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *Report) add(event string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Start monitors the group's nodes for the rest of a test, and returns a function that stops monitoring and logs what
+// happened to them (e.g. "node 3 (...) exited with code 2 (Error) at ...") and the warnings the cluster reported about
+// them, and adds them to ctx's report if it has one (see WithReport). Every message the test logs at info level starts
+// a new step, so the events say what the test was doing when they happened. log must have a logger of its own, since
+// it keeps the hook. Monitoring stops early if ctx is done.
+func Start(ctx context.Context, cluster k8s.ClusterBackend, ns, groupName string, log *logrus.Entry) func() {
+	m, err := cluster.MonitorPods(ctx, ns, k8s.GroupLabels(groupName))
+	if err != nil {
+		log.Warnf("failed to start monitoring the nodes (crashes will not be reported): %v", err)
+		return func() {}
+	}
+	log.Logger.AddHook(stepHook{m})
+	report, _ := ctx.Value(reportKey{}).(*Report)
+	return func() {
+		m.Stop()
+		if events := m.Events(); len(events) > 0 {
+			log.Warnf("%d of your nodes crashed or failed to start during the test:", len(events))
+			for _, e := range events {
+				log.Warn(e.String())
+				report.add(e.String())
+			}
+		}
+		if events := m.ClusterEvents(); len(events) > 0 {
+			log.Warn("the cluster reported these problems with your nodes during the test (these may be " +
+				"problems with the grading environment rather than with your code):")
+			for _, e := range events {
+				log.Warn(e.String())
+				report.add("cluster: " + e.String())
+			}
+		}
+	}
+}
+
+type stepHook struct {
+	m k8s.PodMonitor
+}
+
+func (h stepHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel}
+}
+
+func (h stepHook) Fire(e *logrus.Entry) error {
+	// Score updates are results, not steps.
+	if !strings.HasPrefix(e.Message, "score ") {
+		h.m.Step(e.Message)
+	}
+	return nil
+}
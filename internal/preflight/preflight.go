@@ -0,0 +1,209 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/registry"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
+)
+
+// probeGroup is the group name of the stand-in pods the checks create.
+const probeGroup = "grader-preflight"
+
+type check struct {
+	name string
+	// fatal checks skip all remaining checks when they fail.
+	fatal bool
+	// skip, if set, is why the check doesn't apply, in which case it isn't run.
+	skip string
+	run  func() (string, error)
+}
+
+// Run checks that the environment can grade image in namespace ns and prints a pass/fail checklist to out. It returns
+// whether every check passed. Checks give up once ctx is done.
+func Run(ctx context.Context, kc *k8s.Client, ns, image string, out io.Writer) bool {
+	var mappings map[string]k8s.PodMetaDetails
+	// Proxied nodes are partitioned by the grader rather than by NetworkPolicy, and the probe pods aren't proxied.
+	var noPolicies string
+	if kc.Proxied {
+		noPolicies = "PROXY_NODES partitions nodes without NetworkPolicy"
+	}
+	checks := []check{
+		{
+			name:  "kubeconfig loads and the API server answers",
+			fatal: true,
+			run: func() (string, error) {
+				if err := kc.Init(); err != nil {
+					return "", err
+				}
+				v, err := kc.Discovery().ServerVersion()
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("server version %s", v.GitVersion), nil
+			},
+		},
+		{
+			name:  fmt.Sprintf("permissions to manage pods and network policies in namespace %s", ns),
+			fatal: true,
+			run: func() (string, error) {
+				missing, err := missingPermissions(ctx, kc, ns, k8s.GraderRules)
+				if err != nil {
+					return "", err
+				}
+				if len(missing) > 0 {
+					return "", fmt.Errorf("not allowed to: %s", strings.Join(missing, ", "))
+				}
+				return "", nil
+			},
+		},
+		{
+			name: "cluster-wide permissions (only needed for NAMESPACE_PER_RUN and reap)",
+			run: func() (string, error) {
+				missing, err := missingPermissions(ctx, kc, "", k8s.GraderClusterRules)
+				if err != nil {
+					return "", err
+				}
+				if len(missing) > 0 {
+					return fmt.Sprintf("not granted, so don't use them; missing: %s", strings.Join(missing, ", ")), nil
+				}
+				return "", nil
+			},
+		},
+		{
+			name: fmt.Sprintf("image %s exists in the registry", image),
+			run: func() (string, error) {
+				return "", registry.ManifestExists(image)
+			},
+		},
+		{
+			name:  fmt.Sprintf("probe pods (%s) start", k8s.ProbeImage),
+			fatal: true,
+			run: func() (string, error) {
+				if err := cleanup(ctx, kc, ns); err != nil {
+					return "", err
+				}
+				if err := kc.CreateProbePods(ctx, ns, probeGroup, 2); err != nil {
+					return "", err
+				}
+				var err error
+				mappings, err = kc.ListAddressGroupIndexMappings(ctx, ns, k8s.GroupLabels(probeGroup))
+				return "", err
+			},
+		},
+		{
+			name: fmt.Sprintf("pod IPs are reachable from this machine on port %s", k8s.PodPort),
+			run: func() (string, error) {
+				return "", dialAll(ctx, mappings)
+			},
+		},
+		{
+			name: "NetworkPolicy is enforced",
+			skip: noPolicies,
+			run: func() (string, error) {
+				addrs := k8s.PodAddrsFromMappings(mappings)
+				return "", k8s.ApplyPartition(ctx, kc, ns, probeGroup, k8s.EachAlone(addrs), mappings)
+			},
+		},
+		{
+			name: "isolated pods are still reachable from this machine (GRADER_CIDRS, GRADER_DETECT_IP)",
+			skip: noPolicies,
+			run: func() (string, error) {
+				return "", dialAll(ctx, mappings)
+			},
+		},
+		{
+			name: "healing takes effect",
+			skip: noPolicies,
+			run: func() (string, error) {
+				return "", k8s.HealPartition(ctx, kc, ns, probeGroup, mappings)
+			},
+		},
+	}
+
+	passed := true
+	skip := false
+	for _, c := range checks {
+		if skip {
+			fmt.Fprintf(out, "[SKIP] %s\n", c.name)
+			continue
+		}
+		if c.skip != "" {
+			fmt.Fprintf(out, "[SKIP] %s (%s)\n", c.name, c.skip)
+			continue
+		}
+		detail, err := c.run()
+		if err != nil {
+			fmt.Fprintf(out, "[FAIL] %s: %v\n", c.name, err)
+			passed = false
+			skip = c.fatal
+			continue
+		}
+		if detail != "" {
+			fmt.Fprintf(out, "[PASS] %s (%s)\n", c.name, detail)
+		} else {
+			fmt.Fprintf(out, "[PASS] %s\n", c.name)
+		}
+	}
+
+	if mappings != nil {
+		ctx, cancel := k8s.CleanupContext()
+		defer cancel()
+		if err := cleanup(ctx, kc, ns); err != nil {
+			fmt.Fprintf(out, "failed to clean up probe pods: %v\n", err)
+		}
+	}
+	return passed
+}
+
+func cleanup(ctx context.Context, kc *k8s.Client, ns string) error {
+	if err := kc.DeletePods(ctx, ns, k8s.GroupLabels(probeGroup)); err != nil {
+		return err
+	}
+	if err := kc.AwaitDeletion(ctx, ns, k8s.GroupLabels(probeGroup)); err != nil {
+		return err
+	}
+	return kc.DeleteNetPolicies(ctx, ns, k8s.GroupLabels(probeGroup))
+}
+
+// dialAll opens a connection to every pod in mappings on PodPort.
+func dialAll(ctx context.Context, mappings map[string]k8s.PodMetaDetails) error {
+	for _, addr := range k8s.PodAddrsFromMappings(mappings) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		conn, err := transport.Dialer.DialContext(ctx, "tcp", addr)
+		cancel()
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// missingPermissions returns the verbs and resources of rules the grader may not use in namespace ns, or cluster-wide
+// if ns is empty.
+func missingPermissions(ctx context.Context, kc *k8s.Client, ns string, rules []rbacv1.PolicyRule) ([]string, error) {
+	var missing []string
+	for _, rule := range rules {
+		for _, resource := range rule.Resources {
+			res, sub, _ := strings.Cut(resource, "/")
+			for _, verb := range rule.Verbs {
+				ok, err := kc.CanI(ctx, ns, rule.APIGroups[0], res, sub, verb)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					missing = append(missing, fmt.Sprintf("%s %s", verb, resource))
+				}
+			}
+		}
+	}
+	return missing, nil
+}
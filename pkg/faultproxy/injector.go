@@ -0,0 +1,414 @@
+package faultproxy
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultHost = "127.0.0.1"
+
+// Anyone as the From of a Link matches connections from any source, including ones that can't be attributed to a
+// node.
+const Anyone = ""
+
+// Link is the direction a connection is opened in. A fault on a link applies to both directions of the connections
+// opened along it, the same way a stateful firewall lets replies through.
+type Link struct {
+	From string
+	To   string
+}
+
+type Fault struct {
+	// Drop holds all traffic on the link until the fault is lifted, like a network partition would.
+	Drop bool
+	// Loss is the probability that a new connection on the link is black-holed for good.
+	Loss float64
+	// Delay (plus up to Jitter) is how long every chunk of data is held, from when it arrives, before it is forwarded.
+	// Chunks that arrive together are delayed together, so the delay adds latency without capping throughput.
+	Delay  time.Duration
+	Jitter time.Duration
+}
+
+// Injector puts a TCP proxy in front of every node. Nodes reach each other through the proxies, and the injector
+// decides per connection (and per chunk of data) whether to forward, hold or slow down the traffic. Connections are
+// attributed to a source node by their remote IP, which only works when every node has a distinct IP, or else by
+// Resolve.
+type Injector struct {
+	// Host is the IP the proxies listen on; 127.0.0.1 when empty.
+	Host string
+	// Resolve, if set, attributes the connections whose remote IP doesn't belong to exactly one node, e.g. by finding
+	// the process that opened them. It gets the connection's remote and local addresses, and returns Anyone if it
+	// can't tell either.
+	Resolve func(remote, local net.Addr) string
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	closed  bool
+	proxies map[string]*proxy
+	sources map[string][]string
+	faults  map[Link]Fault
+	// shapes set the delay, jitter and loss on links apart from faults, so that healing a partition keeps them.
+	shapes map[Link]Fault
+}
+
+type proxy struct {
+	listener net.Listener
+	// upstream is where connections go; they are closed right away while it is empty.
+	upstream string
+}
+
+func (inj *Injector) init() {
+	if inj.proxies == nil {
+		inj.changed = sync.NewCond(&inj.mu)
+		inj.proxies = make(map[string]*proxy)
+		inj.sources = make(map[string][]string)
+		inj.faults = make(map[Link]Fault)
+		inj.shapes = make(map[Link]Fault)
+	}
+}
+
+// Start listens on a new port of Host and forwards connections to it to upstream, which may be left empty until the
+// node has an address. It returns the proxy's address, which should be the address other nodes know the node by. If
+// the node has a proxy already, Start points it at upstream and returns its address, so the node keeps its address
+// when it is restarted somewhere else.
+func (inj *Injector) Start(node, upstream string) (string, error) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	if inj.closed {
+		return "", errors.New("fault injector closed")
+	}
+	if p, ok := inj.proxies[node]; ok {
+		p.upstream = upstream
+		return p.listener.Addr().String(), nil
+	}
+	host := inj.Host
+	if host == "" {
+		host = defaultHost
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return "", err
+	}
+	p := &proxy{listener: l, upstream: upstream}
+	inj.proxies[node] = p
+	go inj.serve(node, p)
+	return l.Addr().String(), nil
+}
+
+// Stop closes the node's proxy; connections already open through it are left alone.
+func (inj *Injector) Stop(node string) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if p, ok := inj.proxies[node]; ok {
+		_ = p.listener.Close()
+		delete(inj.proxies, node)
+	}
+}
+
+// SetSource records that connections from ip come from node, and no longer from any IP recorded for it before.
+func (inj *Injector) SetSource(ip, node string) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	inj.forgetSource(node)
+	inj.sources[ip] = append(inj.sources[ip], node)
+}
+
+// ForgetSource forgets the IP connections from node come from.
+func (inj *Injector) ForgetSource(node string) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	inj.forgetSource(node)
+}
+
+// forgetSource is ForgetSource; the caller must hold inj.mu.
+func (inj *Injector) forgetSource(node string) {
+	for ip, nodes := range inj.sources {
+		for i, n := range nodes {
+			if n == node {
+				nodes = append(nodes[:i:i], nodes[i+1:]...)
+				break
+			}
+		}
+		if len(nodes) == 0 {
+			delete(inj.sources, ip)
+		} else {
+			inj.sources[ip] = nodes
+		}
+	}
+}
+
+// CanAttribute reports whether every node with a proxy can be told apart by its source IP, or else by Resolve, which
+// is needed for any fault whose Link has a From other than Anyone.
+func (inj *Injector) CanAttribute() bool {
+	if inj.Resolve != nil {
+		return true
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	known := 0
+	for _, nodes := range inj.sources {
+		if len(nodes) > 1 {
+			return false
+		}
+		known++
+	}
+	return known >= len(inj.proxies)
+}
+
+func (inj *Injector) Set(l Link, f Fault) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	inj.faults[l] = f
+	inj.changed.Broadcast()
+}
+
+// Isolate holds all traffic from other nodes to node.
+func (inj *Injector) Isolate(node string) {
+	inj.Set(Link{From: Anyone, To: node}, Fault{Drop: true})
+}
+
+// BlockOneWay holds traffic on connections that from opens to to, but not the other way around.
+func (inj *Injector) BlockOneWay(from, to string) {
+	inj.Set(Link{From: from, To: to}, Fault{Drop: true})
+}
+
+// Heal lifts every fault on links towards the given nodes, or on all links if no node is given.
+func (inj *Injector) Heal(nodes ...string) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	if len(nodes) == 0 {
+		inj.faults = make(map[Link]Fault)
+	}
+	for _, node := range nodes {
+		for l := range inj.faults {
+			if l.To == node {
+				delete(inj.faults, l)
+			}
+		}
+	}
+	inj.changed.Broadcast()
+}
+
+// Shape sets the delay, jitter and loss on l, which override those of any fault on it; Drop is ignored.
+func (inj *Injector) Shape(l Link, f Fault) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	f.Drop = false
+	inj.shapes[l] = f
+	inj.changed.Broadcast()
+}
+
+// Unshape lifts the shapes of links towards the given nodes, or of all links if no node is given.
+func (inj *Injector) Unshape(nodes ...string) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	if len(nodes) == 0 {
+		inj.shapes = make(map[Link]Fault)
+	}
+	for _, node := range nodes {
+		for l := range inj.shapes {
+			if l.To == node {
+				delete(inj.shapes, l)
+			}
+		}
+	}
+	inj.changed.Broadcast()
+}
+
+// Close stops every proxy and tears down the connections going through them.
+func (inj *Injector) Close() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.init()
+	inj.closed = true
+	for node, p := range inj.proxies {
+		_ = p.listener.Close()
+		delete(inj.proxies, node)
+	}
+	inj.changed.Broadcast()
+}
+
+func (inj *Injector) serve(node string, p *proxy) {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		inj.mu.Lock()
+		upstream := p.upstream
+		inj.mu.Unlock()
+		go inj.handle(conn, node, upstream)
+	}
+}
+
+// fault returns the fault on l, shaped if l has a shape; the caller must hold inj.mu.
+func (inj *Injector) fault(l Link) Fault {
+	f, ok := inj.faults[l]
+	if !ok {
+		f = inj.faults[Link{From: Anyone, To: l.To}]
+	}
+	shape, ok := inj.shapes[l]
+	if !ok {
+		shape, ok = inj.shapes[Link{From: Anyone, To: l.To}]
+	}
+	if ok {
+		f.Loss, f.Delay, f.Jitter = shape.Loss, shape.Delay, shape.Jitter
+	}
+	return f
+}
+
+func (inj *Injector) attribute(conn net.Conn) string {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return Anyone
+	}
+	inj.mu.Lock()
+	nodes := inj.sources[tcpAddr.IP.String()]
+	inj.mu.Unlock()
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	if inj.Resolve != nil {
+		return inj.Resolve(conn.RemoteAddr(), conn.LocalAddr())
+	}
+	return Anyone
+}
+
+// session is a connection through a proxy; once either side of it is done, both are.
+type session struct {
+	// done is closed when the session ends.
+	done chan struct{}
+	// ended is guarded by Injector.mu.
+	ended bool
+}
+
+func (inj *Injector) handle(conn net.Conn, node, upstream string) {
+	defer conn.Close()
+	if upstream == "" {
+		return
+	}
+	l := Link{From: inj.attribute(conn), To: node}
+
+	inj.mu.Lock()
+	lost := rand.Float64() < inj.fault(l).Loss
+	inj.mu.Unlock()
+	if lost {
+		_, _ = io.Copy(io.Discard, conn)
+		return
+	}
+
+	up, err := net.Dial("tcp", upstream)
+	if err != nil {
+		return
+	}
+	defer up.Close()
+
+	s := &session{done: make(chan struct{})}
+	var once sync.Once
+	end := func() {
+		once.Do(func() {
+			inj.mu.Lock()
+			s.ended = true
+			inj.changed.Broadcast()
+			inj.mu.Unlock()
+			close(s.done)
+			_ = conn.Close()
+			_ = up.Close()
+		})
+	}
+	go func() {
+		inj.pipe(up, conn, l, s)
+		end()
+	}()
+	inj.pipe(conn, up, l, s)
+	end()
+}
+
+// chunk is data read from one side of a session, and when it was read.
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// pipe copies src to dst, holding or delaying every chunk according to the current fault on l, until src is done or
+// the session ends. If src is closed while a chunk is held, the session ends right away rather than when the fault is
+// lifted.
+func (inj *Injector) pipe(dst, src net.Conn, l Link, s *session) {
+	chunks := make(chan chunk, 8)
+	// srcDone is guarded by inj.mu.
+	srcDone := false
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- chunk{data: buf[:n], at: time.Now()}:
+				case <-s.done:
+					return
+				}
+			}
+			if err != nil {
+				inj.mu.Lock()
+				srcDone = true
+				inj.changed.Broadcast()
+				inj.mu.Unlock()
+				return
+			}
+		}
+	}()
+	for c := range chunks {
+		f, ok := inj.await(l, s, &srcDone)
+		if !ok {
+			return
+		}
+		if wait := time.Until(c.at.Add(f.Delay + jitter(f.Jitter))); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-s.done:
+				return
+			}
+		}
+		if _, err := dst.Write(c.data); err != nil {
+			return
+		}
+	}
+}
+
+// await blocks while traffic on l is dropped and returns the fault to apply once it isn't; ok is false if the injector
+// was closed, the session ended or *srcDone was set in the meantime.
+func (inj *Injector) await(l Link, s *session, srcDone *bool) (f Fault, ok bool) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	for {
+		if inj.closed || s.ended {
+			return Fault{}, false
+		}
+		if f = inj.fault(l); !f.Drop {
+			return f, true
+		}
+		if *srcDone {
+			return Fault{}, false
+		}
+		inj.changed.Wait()
+	}
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,175 @@
+package faultproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer starts a server on a loopback port that echoes everything back, and returns its address.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newInjector returns an injector with proxies for nodes "a" and "b" in front of one echo server, and attributes the
+// test's connections, which come from 127.0.0.1, to "a".
+func newInjector(t *testing.T) (inj *Injector, addrs map[string]string) {
+	t.Helper()
+	upstream := echoServer(t)
+	inj = &Injector{}
+	t.Cleanup(inj.Close)
+	addrs = make(map[string]string)
+	for _, node := range []string{"a", "b"} {
+		addr, err := inj.Start(node, upstream)
+		if err != nil {
+			t.Fatalf("failed to start proxy for %s: %v", node, err)
+		}
+		addrs[node] = addr
+	}
+	inj.SetSource("127.0.0.1", "a")
+	return inj, addrs
+}
+
+// dial connects to addr, failing the test if it can't.
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// echoes reports whether a byte written to conn comes back within wait.
+func echoes(conn net.Conn, wait time.Duration) bool {
+	if _, err := conn.Write([]byte("x")); err != nil {
+		return false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 1)
+	n, err := conn.Read(buf)
+	return err == nil && n == 1
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault func(inj *Injector)
+		to    string
+		want  bool
+	}{
+		{name: "no fault", fault: func(inj *Injector) {}, to: "b", want: true},
+		{name: "isolated", fault: func(inj *Injector) { inj.Isolate("b") }, to: "b", want: false},
+		{name: "other node isolated", fault: func(inj *Injector) { inj.Isolate("a") }, to: "b", want: true},
+		{name: "blocked one way", fault: func(inj *Injector) { inj.BlockOneWay("a", "b") }, to: "b", want: false},
+		{name: "blocked the other way", fault: func(inj *Injector) { inj.BlockOneWay("b", "a") }, to: "b", want: true},
+		{
+			name:  "blocked from another node",
+			fault: func(inj *Injector) { inj.BlockOneWay("c", "b") },
+			to:    "b",
+			want:  true,
+		},
+		{
+			name:  "lost",
+			fault: func(inj *Injector) { inj.Shape(Link{From: Anyone, To: "b"}, Fault{Loss: 1}) },
+			to:    "b",
+			want:  false,
+		},
+		{
+			name:  "lost on another link",
+			fault: func(inj *Injector) { inj.Shape(Link{From: "c", To: "b"}, Fault{Loss: 1}) },
+			to:    "b",
+			want:  true,
+		},
+		{
+			name:  "shape ignores drop",
+			fault: func(inj *Injector) { inj.Shape(Link{From: "a", To: "b"}, Fault{Drop: true}) },
+			to:    "b",
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inj, addrs := newInjector(t)
+			tt.fault(inj)
+			if got := echoes(dial(t, addrs[tt.to]), 300*time.Millisecond); got != tt.want {
+				t.Errorf("connection to %s gets through = %t, want %t", tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeal(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault func(inj *Injector)
+		heal  []string
+		want  bool
+	}{
+		{name: "isolated node", fault: func(inj *Injector) { inj.Isolate("b") }, heal: []string{"b"}, want: true},
+		{name: "one-way block", fault: func(inj *Injector) { inj.BlockOneWay("a", "b") }, heal: nil, want: true},
+		{name: "other node", fault: func(inj *Injector) { inj.Isolate("b") }, heal: []string{"a"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inj, addrs := newInjector(t)
+			tt.fault(inj)
+			conn := dial(t, addrs["b"])
+			if echoes(conn, 200*time.Millisecond) {
+				t.Fatalf("connection got through before healing")
+			}
+			inj.Heal(tt.heal...)
+			// The byte held by the fault comes through once it is lifted.
+			_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			buf := make([]byte, 1)
+			n, err := conn.Read(buf)
+			if got := err == nil && n == 1; got != tt.want {
+				t.Errorf("held data gets through after healing = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelayIsLatency(t *testing.T) {
+	inj, addrs := newInjector(t)
+	const delay = 200 * time.Millisecond
+	inj.Shape(Link{From: Anyone, To: "b"}, Fault{Delay: delay})
+	conn := dial(t, addrs["b"])
+
+	start := time.Now()
+	const chunks = 5
+	for i := 0; i < chunks; i++ {
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, chunks)); err != nil {
+		t.Fatalf("failed to read the echoes: %v", err)
+	}
+	// Each way is delayed once; delaying the chunks one after the other would take chunks times as long.
+	if elapsed := time.Since(start); elapsed < 2*delay || elapsed > 4*delay {
+		t.Errorf("round trip of %d chunks took %v, want about %v", chunks, elapsed, 2*delay)
+	}
+}
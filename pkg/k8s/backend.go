@@ -0,0 +1,40 @@
+package k8s
+
+import "context"
+
+// ClusterBackend is everything the tests need from the environment that runs the student nodes. Client runs them as
+// pods in a Kubernetes cluster; local.Cluster runs them as processes on the grader's machine. Every method gives up
+// when its context is done. Failures of the environment itself, such as any error of the Kubernetes API, are returned
+// as InfraErrors, so that tests can tell them apart from failures of the nodes.
+type ClusterBackend interface {
+	CreatePods(ctx context.Context, ns, groupName, image string, batches, perBatch int) error
+	// AwaitReady waits until the selected nodes are up and answer http requests.
+	AwaitReady(ctx context.Context, ns string, labels map[string]string) error
+	ListAddressGroupIndexMappings(
+		ctx context.Context, ns string, labels map[string]string,
+	) (map[string]PodMetaDetails, error)
+	ListPodAddresses(ctx context.Context, ns string, labels map[string]string) ([]string, error)
+	IsolateBatch(ctx context.Context, ns string, groupName string, batch int) error
+	IsolatePodByIps(ctx context.Context, ns string, groupName string, idx int, ips []string) error
+	IsolatePod(ctx context.Context, ns string, groupName string, idx int) error
+	BlockOneWay(ctx context.Context, ns, groupName string, from, to []PodMetaDetails) error
+	DeleteNetPolicies(ctx context.Context, ns string, labels map[string]string) error
+	// SetLinkProfiles degrades the traffic on the given links between the group's nodes (see ApplyLinkProfiles).
+	SetLinkProfiles(ctx context.Context, ns, groupName string, links map[NodeLink]LinkProfile) error
+	ClearLinkProfiles(ctx context.Context, ns, groupName string) error
+	DeletePods(ctx context.Context, ns string, labels map[string]string) error
+	// KillPods stops the selected nodes abruptly, like a crash, and deletes them.
+	KillPods(ctx context.Context, ns string, labels map[string]string) error
+	// RestartPods kills the selected nodes and starts them again under the same names and labels, like nodes that
+	// crashed and came back, and waits until they run again.
+	RestartPods(ctx context.Context, ns string, labels map[string]string) error
+	// FreezePods makes the selected nodes hang, without closing their connections, until ThawPods.
+	FreezePods(ctx context.Context, ns string, labels map[string]string) error
+	ThawPods(ctx context.Context, ns string, labels map[string]string) error
+	AwaitDeletion(ctx context.Context, ns string, labels map[string]string) error
+	GetPodLogs(ctx context.Context, ns string, labels map[string]string) ([]string, error)
+	FollowPodLogs(ctx context.Context, ns string, labels map[string]string, open LogOpener) (stop func() error, err error)
+	MonitorPods(ctx context.Context, ns string, labels map[string]string) (PodMonitor, error)
+}
+
+var _ ClusterBackend = &Client{}
@@ -1,14 +1,24 @@
 package k8s
 
 import (
+	"errors"
 	"flag"
+	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/faultproxy"
 )
 
+// kubeconfig is set from the -kubeconfig flag once the main package parses the flags.
 var kubeconfig *string
 
 func init() {
@@ -17,29 +27,120 @@ func init() {
 	} else {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
-	flag.Parse()
 }
 
 const kFieldManager = "amin"
 
 type Client struct {
 	*kubernetes.Clientset
+
+	// GraderCidrs are let through every isolating network policy, so the grader can always reach the pods.
+	GraderCidrs []string
+	// DetectGraderIp additionally lets through the grader's own address, as seen by the pods (see GraderIp).
+	DetectGraderIp bool
+
+	// RunId, if set, scopes the client to one grader run: everything it creates is labeled with it and named after it,
+	// and everything it lists or deletes is limited to it, so runs sharing a namespace leave each other alone.
+	RunId string
+
+	// TTL is how long the resources of the run are needed at most; once it is over, Reap may delete them even if the
+	// run never did. DefaultTTL is used when zero.
+	TTL time.Duration
+
+	// ReadyTimeout bounds how long pods get to start and answer on PodPort; DefaultReadyTimeout is used when zero.
+	ReadyTimeout time.Duration
+
+	// GracePeriodSeconds is the grace period of deleted pods; the pods' own (30s by default) is used when nil.
+	GracePeriodSeconds *int64
+
+	// PortForward makes the grader reach pods through the API server's port-forwarding instead of dialing pod IPs,
+	// so the host needs no routes to the pod network (see ListAddressGroupIndexMappings).
+	PortForward bool
+
+	// StableAddresses gives the nodes DNS names as addresses, through a headless service per group, so a node keeps
+	// its address when it is restarted (see RestartPods).
+	StableAddresses bool
+
+	// Resources are the CPU and memory requests and limits of the nodes.
+	Resources v1.ResourceRequirements
+	// RunAsNonRoot keeps nodes whose images run as root from starting.
+	RunAsNonRoot bool
+	// ReadOnlyRootFilesystem makes the nodes' root filesystems read-only; they can still write to /tmp.
+	ReadOnlyRootFilesystem bool
+	// DenyEgress lets the nodes open connections only to the other nodes of their group and to DNS servers.
+	DenyEgress bool
+	// Freezable makes the containers of the nodes share one process namespace, so that their processes can be
+	// signaled from an ephemeral container (see FreezePods). It has to be set before any pods are created.
+	Freezable bool
+
+	// Proxied routes the traffic between nodes through fault-injecting proxies in the grader (see faultproxy), which
+	// partition and shape it instead of network policies and netem, for clusters whose network plugin doesn't enforce
+	// network policies. The nodes' ADDRESS is their proxy's address, which also survives restarts, and the nodes have
+	// to listen on LISTEN_ADDRESS. The nodes have to reach the grader on ProxyHost without NAT, so in practice the
+	// grader has to run in the cluster.
+	Proxied bool
+	// ProxyHost is the grader's IP as the nodes see it, which the proxies listen on.
+	ProxyHost string
+
+	config *rest.Config
+
+	graderIpMu sync.Mutex
+	graderIp   string
+
+	forwardsMu sync.Mutex
+	forwards   map[string]*forward
+
+	// shaped holds the pods whose traffic has link profiles.
+	shapedMu sync.Mutex
+	shaped   map[types.UID]bool
+
+	// expected holds the pods the client created and has not deleted, by podKey (see expectedPods).
+	expectedMu sync.Mutex
+	expected   map[string]expectedPod
+
+	// pools holds the groups' pod pools (see StartPool), by namespace and group.
+	poolsMu sync.Mutex
+	pools   map[string]*PodPool
+
+	// injector holds the proxies of proxied nodes, by podKey.
+	injector  faultproxy.Injector
+	proxyOnce sync.Once
 }
 
 func (c *Client) LazyInit() {
+	if err := c.Init(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// Init is LazyInit, but returns the error instead of panicking.
+func (c *Client) Init() error {
 	if c.Clientset != nil {
-		return
+		return nil
 	}
 
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	config, err := restConfig()
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	// create the clientset
+	c.config = config
 	c.Clientset, err = kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
+	return err
+}
+
+// restConfig uses the current context in the kubeconfig, or the pod's service account when running inside the cluster
+// without a kubeconfig.
+func restConfig() (*rest.Config, error) {
+	if _, err := os.Stat(*kubeconfig); *kubeconfig == "" || err != nil {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, nil
+		}
+		if !errors.Is(err, rest.ErrNotInCluster) {
+			return nil, err
+		}
 	}
+	return clientcmd.BuildConfigFromFlags("", *kubeconfig)
 }
@@ -0,0 +1,203 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	applymetav1 "k8s.io/client-go/applyconfigurations/meta/v1"
+	v1 "k8s.io/client-go/applyconfigurations/networking/v1"
+)
+
+// egressPrefix prefixes the label keys of the nodes' default egress policies (see Client.DenyEgress), so that
+// selecting a group's partition policies by its labels does not select them too.
+const egressPrefix = "egress-"
+
+// egressLabels returns labels with every key prefixed with egressPrefix.
+func egressLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string)
+	for k, v := range labels {
+		res[egressPrefix+k] = v
+	}
+	return res
+}
+
+// applyEgressPolicy lets the node with the given labels (see PodLabels) open connections only to DNS servers and to
+// the other nodes of its group, or, if it is proxied, their proxies.
+func (c *Client) applyEgressPolicy(ctx context.Context, ns string, labels map[string]string) error {
+	return c.applyEgressPolicyToIps(ctx, ns, labels, nil)
+}
+
+// applyEgressPolicyToIps is applyEgressPolicy with the group's nodes replaced by allowedIps, unless it is nil.
+func (c *Client) applyEgressPolicyToIps(
+	ctx context.Context, ns string, labels map[string]string, allowedIps []string,
+) error {
+	c.LazyInit()
+	groupName := labels[GroupKey]
+	idx := IntFromIntLabel(labels[IndexKey])
+	var to []v1.NetworkPolicyPeerApplyConfiguration
+	if allowedIps == nil {
+		to = append(to, v1.NetworkPolicyPeerApplyConfiguration{
+			PodSelector: &applymetav1.LabelSelectorApplyConfiguration{
+				MatchLabels: c.runLabels(GroupLabels(groupName)),
+			},
+		})
+	}
+	if c.Proxied {
+		// Proxied nodes reach each other through the grader.
+		proxyCidr := fmt.Sprintf("%s/32", c.ProxyHost)
+		to = append(to, v1.NetworkPolicyPeerApplyConfiguration{
+			IPBlock: &v1.IPBlockApplyConfiguration{
+				CIDR: &proxyCidr,
+			},
+		})
+	}
+	for _, ip := range allowedIps {
+		ipCidr := fmt.Sprintf("%s/32", ip)
+		to = append(to, v1.NetworkPolicyPeerApplyConfiguration{
+			IPBlock: &v1.IPBlockApplyConfiguration{
+				CIDR: &ipCidr,
+			},
+		})
+	}
+	name := c.runName(fmt.Sprintf("%s-p%d-egress-default", groupName, idx))
+	return c.applyEgressOnlyTo(ctx, ns, name, egressLabels(labels), PodLabelsNoBatch(groupName, idx), to)
+}
+
+// applyPoolEgressPolicy lets the spare pods of the group's pool (see PodPool) open connections only to DNS servers,
+// until claim narrows their policies down to the group they are handed out to.
+func (c *Client) applyPoolEgressPolicy(ctx context.Context, ns, groupName string) error {
+	c.LazyInit()
+	labels := map[string]string{PoolKey: groupName}
+	name := c.runName(fmt.Sprintf("%s-pool-egress-default", groupName))
+	return c.applyEgressOnlyTo(ctx, ns, name, egressLabels(labels), labels, nil)
+}
+
+// applyEgressOnlyTo applies the egress policy name, which lets the pods matching selector open connections only to
+// DNS servers and to.
+func (c *Client) applyEgressOnlyTo(
+	ctx context.Context, ns, name string, policyLabels, selector map[string]string,
+	to []v1.NetworkPolicyPeerApplyConfiguration,
+) error {
+	kind := "NetworkPolicy"
+	apiVersion := "networking.k8s.io/v1"
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dns := intstr.FromInt(53)
+	egress := []v1.NetworkPolicyEgressRuleApplyConfiguration{
+		{
+			To: []v1.NetworkPolicyPeerApplyConfiguration{
+				{
+					NamespaceSelector: &applymetav1.LabelSelectorApplyConfiguration{},
+				},
+			},
+			Ports: []v1.NetworkPolicyPortApplyConfiguration{
+				{Protocol: &udp, Port: &dns},
+				{Protocol: &tcp, Port: &dns},
+			},
+		},
+	}
+	// A rule without peers would allow everything.
+	if len(to) > 0 {
+		egress = append(egress, v1.NetworkPolicyEgressRuleApplyConfiguration{To: to})
+	}
+
+	req := &v1.NetworkPolicyApplyConfiguration{
+		TypeMetaApplyConfiguration: applymetav1.TypeMetaApplyConfiguration{
+			Kind:       &kind,
+			APIVersion: &apiVersion,
+		},
+		ObjectMetaApplyConfiguration: &applymetav1.ObjectMetaApplyConfiguration{
+			Name:        &name,
+			Namespace:   &ns,
+			Labels:      ownedLabels(c.runLabels(policyLabels)),
+			Annotations: c.ownerAnnotations(),
+		},
+		Spec: &v1.NetworkPolicySpecApplyConfiguration{
+			PodSelector: &applymetav1.LabelSelectorApplyConfiguration{
+				MatchLabels: c.runLabels(selector),
+			},
+			Egress:      egress,
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+		},
+	}
+
+	applyOpts := metav1.ApplyOptions{
+		FieldManager: kFieldManager,
+		Force:        true,
+	}
+	return withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.NetworkingV1().NetworkPolicies(ns).Apply(ctx, req, applyOpts)
+		return err
+	})
+}
+
+// blockEgressToIps narrows the default egress policy of every node in from down to the nodes of its group that are
+// not in blockedIps.
+func (c *Client) blockEgressToIps(
+	ctx context.Context, ns, groupName string, from []PodMetaDetails, blockedIps []string,
+) error {
+	pods, err := c.ListPods(ctx, ns, GroupLabels(groupName))
+	if err != nil {
+		return err
+	}
+	blocked := make(map[string]bool)
+	for _, ip := range blockedIps {
+		blocked[ip] = true
+	}
+	allowed := []string{}
+	for _, pod := range pods.Items {
+		if ip := pod.Status.PodIP; ip != "" && !blocked[ip] {
+			allowed = append(allowed, ip)
+		}
+	}
+	for _, p := range from {
+		if err := c.applyEgressPolicyToIps(ctx, ns, PodLabels(groupName, p.Batch, p.Index), allowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetEgressPolicies puts back the default egress policies of the selected nodes that blockEgressToIps narrowed.
+func (c *Client) resetEgressPolicies(ctx context.Context, ns string, labels map[string]string) error {
+	var list *networkingv1.NetworkPolicyList
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		list, err = c.NetworkingV1().NetworkPolicies(ns).List(
+			ctx,
+			metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(egressLabels(labels)))},
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, policy := range list.Items {
+		if rules := policy.Spec.Egress; len(rules) > 1 && rules[len(rules)-1].To[0].PodSelector != nil {
+			continue // Not narrowed.
+		}
+		podLabels := make(map[string]string)
+		for k, v := range policy.Labels {
+			if strings.HasPrefix(k, egressPrefix) {
+				podLabels[strings.TrimPrefix(k, egressPrefix)] = v
+			}
+		}
+		if err := c.applyEgressPolicy(ctx, ns, podLabels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) deleteEgressPolicies(ctx context.Context, ns string, labels map[string]string) error {
+	return withRetry(ctx, func(ctx context.Context) error {
+		return c.NetworkingV1().NetworkPolicies(ns).DeleteCollection(
+			ctx,
+			metav1.DeleteOptions{},
+			metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(egressLabels(labels)))},
+		)
+	})
+}
@@ -0,0 +1,91 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// ProbeImage is the image of the helper containers the grader adds to the student pods; it needs sh and nc.
+const ProbeImage = "busybox:1.36"
+
+// ephemeralName returns a fresh name for an ephemeral container; they can't be removed from a pod, so names can't be
+// reused.
+func ephemeralName(prefix string) string {
+	return fmt.Sprintf("%s-%x", prefix, time.Now().UnixNano())
+}
+
+// addEphemeralContainer runs a helper container inside a running pod, sharing its network namespace.
+func (c *Client) addEphemeralContainer(ctx context.Context, ns, podName string, ec v1.EphemeralContainer) error {
+	c.LazyInit()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := c.CoreV1().Pods(ns).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, ec)
+		_, err = c.CoreV1().Pods(ns).UpdateEphemeralContainers(ctx, podName, pod, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// awaitEphemeralContainer waits until the container is running, or until it has terminated if terminated is set.
+func (c *Client) awaitEphemeralContainer(
+	ctx context.Context, ns, podName, name string, terminated bool, timeout time.Duration,
+) error {
+	c.LazyInit()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		var pod *v1.Pod
+		err := withRetry(ctx, func(ctx context.Context) (err error) {
+			pod, err = c.CoreV1().Pods(ns).Get(ctx, podName, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range pod.Status.EphemeralContainerStatuses {
+			if s.Name != name {
+				continue
+			}
+			if s.State.Terminated != nil {
+				if terminated {
+					return nil
+				}
+				return fmt.Errorf("container %s in pod %s terminated: %s", name, podName, s.State.Terminated.Reason)
+			}
+			if s.State.Running != nil && !terminated {
+				return nil
+			}
+			if s.State.Waiting != nil && s.State.Waiting.Reason != "" && s.State.Waiting.Reason != "ContainerCreating" &&
+				s.State.Waiting.Reason != "PodInitializing" {
+				return fmt.Errorf("container %s in pod %s is stuck: %s: %s",
+					name, podName, s.State.Waiting.Reason, s.State.Waiting.Message)
+			}
+		}
+
+		select {
+		case <-deadline.C:
+			return fmt.Errorf("deadline for container %s in pod %s exceeded", name, podName)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) containerLogs(ctx context.Context, ns, podName, container string) (string, error) {
+	c.LazyInit()
+	var res []byte
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.CoreV1().Pods(ns).GetLogs(podName, &v1.PodLogOptions{Container: container}).DoRaw(ctx)
+		return err
+	})
+	return string(res), err
+}
@@ -0,0 +1,72 @@
+package k8s
+
+// expectedPod is a pod the client created and has not deleted yet.
+type expectedPod struct {
+	ns     string
+	labels map[string]string
+}
+
+// expectPod records that the client created the named pod with the given labels, so that waiting for pods waits for it
+// too (see expectedPods).
+func (c *Client) expectPod(ns, name string, labels map[string]string) {
+	c.expectedMu.Lock()
+	defer c.expectedMu.Unlock()
+	if c.expected == nil {
+		c.expected = make(map[string]expectedPod)
+	}
+	c.expected[podKey(ns, name)] = expectedPod{ns: ns, labels: labels}
+}
+
+// relabelExpected applies a label patch, as patchLabels sends it, to the record of the named pod.
+func (c *Client) relabelExpected(ns, name string, patch map[string]interface{}) {
+	c.expectedMu.Lock()
+	defer c.expectedMu.Unlock()
+	p, ok := c.expected[podKey(ns, name)]
+	if !ok {
+		return
+	}
+	labels := make(map[string]string)
+	for k, v := range p.labels {
+		labels[k] = v
+	}
+	for k, v := range patch {
+		if s, ok := v.(string); ok {
+			labels[k] = s
+		} else {
+			delete(labels, k)
+		}
+	}
+	p.labels = labels
+	c.expected[podKey(ns, name)] = p
+}
+
+// forgetExpected forgets the pods in ns matching labels, once they are being deleted.
+func (c *Client) forgetExpected(ns string, labels map[string]string) {
+	c.expectedMu.Lock()
+	defer c.expectedMu.Unlock()
+	for key, p := range c.expected {
+		if p.ns == ns && MatchLabels(labels, p.labels) {
+			delete(c.expected, key)
+		}
+	}
+}
+
+// forgetExpectedPod forgets the named pod, once it is being deleted.
+func (c *Client) forgetExpectedPod(ns, name string) {
+	c.expectedMu.Lock()
+	defer c.expectedMu.Unlock()
+	delete(c.expected, podKey(ns, name))
+}
+
+// expectedPods returns how many of the pods the client created in ns, and has not deleted since, match labels.
+func (c *Client) expectedPods(ns string, labels map[string]string) int {
+	c.expectedMu.Lock()
+	defer c.expectedMu.Unlock()
+	n := 0
+	for _, p := range c.expected {
+		if p.ns == ns && MatchLabels(labels, p.labels) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,108 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// FreezePods stops every process of the selected nodes with SIGSTOP, so they hang while their connections stay open,
+// like nodes that are stuck or very slow.
+func (c *Client) FreezePods(ctx context.Context, ns string, labels map[string]string) error {
+	return c.signalPods(ctx, ns, labels, "STOP")
+}
+
+// ThawPods lets frozen nodes carry on with SIGCONT.
+func (c *Client) ThawPods(ctx context.Context, ns string, labels map[string]string) error {
+	return c.signalPods(ctx, ns, labels, "CONT")
+}
+
+// signalPods sends signal to the processes of the main container of every selected pod, from an ephemeral container.
+// The pods share one process namespace (see Client.Freezable), in which the node's processes are not PID 1 and so can
+// be stopped; they are told apart from the grader's helpers by their cgroup, which is named after the main container's
+// ID.
+func (c *Client) signalPods(ctx context.Context, ns string, labels map[string]string, signal string) error {
+	c.LazyInit()
+	if !c.Freezable {
+		return &InfraError{fmt.Errorf("pods can only be sent SIG%s when the client is Freezable", signal)}
+	}
+	pods, err := c.ListPods(ctx, ns, labels)
+	if err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no pods to send SIG%s to; ns=%s; labels=%v", signal, ns, labels)
+	}
+	list := make([]*v1.Pod, len(pods.Items))
+	for i := range pods.Items {
+		list[i] = &pods.Items[i]
+	}
+	return c.signalPodList(ctx, list, signal)
+}
+
+// signalPodList sends signal to the pods concurrently, and returns one of the errors, if any.
+func (c *Client) signalPodList(ctx context.Context, pods []*v1.Pod, signal string) error {
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(pods))
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod *v1.Pod) {
+			defer wg.Done()
+			errChan <- c.signalPod(ctx, pod, signal)
+		}(pod)
+	}
+	wg.Wait()
+	close(errChan)
+	var err error
+	for e := range errChan {
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (c *Client) signalPod(ctx context.Context, pod *v1.Pod, signal string) error {
+	containerId := ""
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.Name == "main" && s.State.Running != nil {
+			// E.g. containerd://<id>.
+			_, containerId, _ = strings.Cut(s.ContainerID, "://")
+		}
+	}
+	if containerId == "" {
+		return fmt.Errorf("pod %s is not running", pod.Name)
+	}
+	if pod.Spec.ShareProcessNamespace == nil || !*pod.Spec.ShareProcessNamespace {
+		return fmt.Errorf("pod %s does not share its process namespace", pod.Name)
+	}
+
+	script := fmt.Sprintf(
+		"for p in /proc/[0-9]*; do grep -qs %[1]s $p/cgroup && kill -%[2]s ${p#/proc/} && echo ${p#/proc/}; done",
+		containerId, signal)
+	name := ephemeralName(strings.ToLower(signal))
+	if err := c.addEphemeralContainer(ctx, pod.Namespace, pod.Name, v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:    name,
+			Image:   ProbeImage,
+			Command: []string{"sh", "-c", script},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to add SIG%s sender to pod %s: %w", signal, pod.Name, err)
+	}
+	if err := c.awaitEphemeralContainer(ctx, pod.Namespace, pod.Name, name, true, 2*time.Minute); err != nil {
+		return err
+	}
+	logs, err := c.containerLogs(ctx, pod.Namespace, pod.Name, name)
+	if err != nil {
+		return fmt.Errorf("failed to get SIG%s sender logs from pod %s: %w", signal, pod.Name, err)
+	}
+	if strings.TrimSpace(logs) == "" {
+		return &InfraError{fmt.Errorf("found no processes to send SIG%s to in pod %s", signal, pod.Name)}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	applyv1 "k8s.io/client-go/applyconfigurations/networking/v1"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
+)
+
+// detectGroup labels the short-lived pods that find out the grader's address.
+const detectGroup = "grader-ip-detect"
+
+// detectScript serves the address the request came from, as the pod sees it, on PodPort.
+const detectScript = `mkdir -p /tmp/cgi-bin && printf '#!/bin/sh\necho "Content-Type: text/plain"\necho\necho "$REMOTE_ADDR"\n' > /tmp/cgi-bin/ip && chmod +x /tmp/cgi-bin/ip && exec httpd -f -p ` + PodPort + ` -h /tmp`
+
+// graderPeers returns the ingress peers that let the grader reach isolated pods: GraderCidrs, plus the detected address
+// of the grader if DetectGraderIp is set.
+func (c *Client) graderPeers(ctx context.Context, ns string) ([]applyv1.NetworkPolicyPeerApplyConfiguration, error) {
+	cidrs := append([]string(nil), c.GraderCidrs...)
+	if c.DetectGraderIp {
+		ip, err := c.GraderIp(ctx, ns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect the grader's address: %w", err)
+		}
+		cidrs = append(cidrs, fmt.Sprintf("%s/32", ip))
+	}
+	var res []applyv1.NetworkPolicyPeerApplyConfiguration
+	for _, cidr := range cidrs {
+		cidr := cidr
+		res = append(res, applyv1.NetworkPolicyPeerApplyConfiguration{
+			IPBlock: &applyv1.IPBlockApplyConfiguration{
+				CIDR: &cidr,
+			},
+		})
+	}
+	return res, nil
+}
+
+// checkGraderCidrs returns an InfraError if one of GraderCidrs contains the pod's IP: isolating network policies would
+// let the pod through as if it were the grader, so partitions would not hold.
+func (c *Client) checkGraderCidrs(pod *v1.Pod) error {
+	ip := net.ParseIP(pod.Status.PodIP)
+	for _, cidr := range c.GraderCidrs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+			return &InfraError{Err: fmt.Errorf(
+				"grader CIDR %s contains the IP %s of pod %s, so partitions would not hold", cidr, ip, pod.Name)}
+		}
+	}
+	return nil
+}
+
+// GraderIp returns the address the grader's connections come from, as seen by pods in ns. It is found once, by starting
+// a pod that echoes back the address of whoever connects to it, and remembered afterwards. With PortForward set, the
+// grader reaches the pod the way it reaches the nodes, through a forwarded port.
+func (c *Client) GraderIp(ctx context.Context, ns string) (string, error) {
+	c.LazyInit()
+	c.graderIpMu.Lock()
+	defer c.graderIpMu.Unlock()
+	if c.graderIp != "" {
+		return c.graderIp, nil
+	}
+
+	name := ephemeralName(detectGroup)
+	err := c.createPod(ctx, ns, name, ProbeImage, []string{"sh", "-c", detectScript}, GroupLabels(detectGroup))
+	if err != nil {
+		return "", err
+	}
+	name = c.runName(name)
+	defer func() {
+		// The pod has to go even if ctx is done.
+		ctx, cancel := CleanupContext()
+		defer cancel()
+		var grace int64
+		_ = deleteWithRetry(ctx, func(ctx context.Context) error {
+			return c.CoreV1().Pods(ns).Delete(ctx, name, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+		})
+		c.forgetExpectedPod(ns, name)
+	}()
+	podIp, err := c.awaitPodIp(ctx, ns, name, 60*time.Second)
+	if err != nil {
+		return "", err
+	}
+	if c.PortForward {
+		var pod *v1.Pod
+		err := withRetry(ctx, func(ctx context.Context) (err error) {
+			pod, err = c.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := c.forwardPod(ctx, pod); err != nil {
+			return "", err
+		}
+		defer c.stopForwards([]v1.Pod{*pod})
+	}
+
+	client := transport.NewHttpClient(2 * time.Second)
+	url := fmt.Sprintf("http://%s/cgi-bin/ip", net.JoinHostPort(podIp, PodPort))
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		ip, err := fetchIp(client.Get(url))
+		if err == nil {
+			c.graderIp = ip
+			return ip, nil
+		}
+		if time.Now().After(deadline) {
+			return "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func fetchIp(res *http.Response, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from the address detection pod", res.StatusCode)
+	}
+	raw := strings.TrimPrefix(strings.TrimSpace(string(body)), "::ffff:")
+	ip := net.ParseIP(raw).To4()
+	if ip == nil {
+		return "", fmt.Errorf("address detection pod returned %q, not an IPv4 address", raw)
+	}
+	return ip.String(), nil
+}
+
+// awaitPodIp waits until the pod is running and returns its IP.
+func (c *Client) awaitPodIp(ctx context.Context, ns, name string, timeout time.Duration) (string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		var pod *v1.Pod
+		err := withRetry(ctx, func(ctx context.Context) (err error) {
+			pod, err = c.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			if pod.Status.PodIP != "" {
+				return pod.Status.PodIP, nil
+			}
+		case v1.PodFailed, v1.PodSucceeded:
+			return "", fmt.Errorf("pod %s stopped: %s", name, pod.Status.Phase)
+		}
+
+		select {
+		case <-deadline.C:
+			return "", fmt.Errorf("deadline for pod %s running exceeded", name)
+		case <-ticker.C:
+		}
+	}
+}
@@ -10,6 +10,9 @@ const GroupKey = "group"
 const BatchKey = "batch"
 const IndexKey = "index"
 
+// RunKey labels everything a grader run creates with the run's ID (see Client.RunId).
+const RunKey = "run"
+
 func GroupLabels(groupName string) map[string]string {
 	res := make(map[string]string)
 	res[GroupKey] = groupName
@@ -28,6 +31,12 @@ func PodLabels(groupName string, batch, idx int) map[string]string {
 	return res
 }
 
+// NodeIndex numbers the j-th node (from 1) of batch (from 1) when every batch has perBatch nodes, so that the nodes of
+// all batches are numbered 1 through batches*perBatch.
+func NodeIndex(batch, perBatch, j int) int {
+	return (batch-1)*perBatch + j
+}
+
 func PodLabelsNoBatch(groupName string, idx int) map[string]string {
 	res := GroupLabels(groupName)
 	res[IndexKey] = fmt.Sprintf("%d", idx)
@@ -54,3 +63,14 @@ func condenseLabelsMap(lm map[string]string) string {
 	}
 	return res.String()
 }
+
+// MatchLabels reports whether labels has every key-value pair in selector, the same way a label selector built with
+// condenseLabelsMap would match it.
+func MatchLabels(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
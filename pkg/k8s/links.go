@@ -0,0 +1,75 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LinkProfile is how traffic on a link between two nodes is degraded. The zero profile leaves it alone.
+type LinkProfile struct {
+	// Delay (give or take up to Jitter) is added to every packet.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Loss is the percentage of packets that are dropped, e.g. 1.5.
+	Loss float64
+}
+
+func (p LinkProfile) String() string {
+	var res []string
+	if p.Delay > 0 || p.Jitter > 0 {
+		res = append(res, fmt.Sprintf("delay %v±%v", p.Delay, p.Jitter))
+	}
+	if p.Loss > 0 {
+		res = append(res, fmt.Sprintf("loss %g%%", p.Loss))
+	}
+	if len(res) == 0 {
+		return "none"
+	}
+	return strings.Join(res, ", ")
+}
+
+// NodeLink is the direction traffic goes in between two nodes.
+type NodeLink struct {
+	From PodMetaDetails
+	To   PodMetaDetails
+}
+
+// LinkSpec degrades the links from every node in From to every other node in To (node addresses).
+type LinkSpec struct {
+	From    []string
+	To      []string
+	Profile LinkProfile
+}
+
+// Symmetric degrades the links both ways between two groups of nodes, and within each group if they overlap.
+func Symmetric(a, b []string, p LinkProfile) []LinkSpec {
+	return []LinkSpec{{From: a, To: b, Profile: p}, {From: b, To: a, Profile: p}}
+}
+
+// ApplyLinkProfiles replaces the profiles of the links between the nodes in m (keyed by address, as returned by
+// ListAddressGroupIndexMappings) with specs. Where specs cover the same link, the last one wins.
+func ApplyLinkProfiles(
+	ctx context.Context, b ClusterBackend, ns, groupName string, specs []LinkSpec, m map[string]PodMetaDetails,
+) error {
+	links := make(map[NodeLink]LinkProfile)
+	for _, s := range specs {
+		for _, from := range s.From {
+			for _, to := range s.To {
+				fromDetails, ok := m[from]
+				if !ok {
+					return fmt.Errorf("unknown node %s", from)
+				}
+				toDetails, ok := m[to]
+				if !ok {
+					return fmt.Errorf("unknown node %s", to)
+				}
+				if from != to {
+					links[NodeLink{From: fromDetails, To: toDetails}] = s.Profile
+				}
+			}
+		}
+	}
+	return b.SetLinkProfiles(ctx, ns, groupName, links)
+}
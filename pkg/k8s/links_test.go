@@ -0,0 +1,68 @@
+package k8s
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// linkRecorder records the links it is asked to degrade; it panics on any other backend method.
+type linkRecorder struct {
+	ClusterBackend
+	links map[NodeLink]LinkProfile
+}
+
+func (r *linkRecorder) SetLinkProfiles(_ context.Context, _, _ string, links map[NodeLink]LinkProfile) error {
+	r.links = links
+	return nil
+}
+
+func TestApplyLinkProfiles(t *testing.T) {
+	m := map[string]PodMetaDetails{
+		"a": {Ip: "10.0.0.1", Index: 1},
+		"b": {Ip: "10.0.0.2", Index: 2},
+		"c": {Ip: "10.0.0.3", Index: 3},
+	}
+	slow := LinkProfile{Delay: 100}
+	lossy := LinkProfile{Loss: 1}
+	link := func(from, to string) NodeLink { return NodeLink{From: m[from], To: m[to]} }
+	tests := []struct {
+		name    string
+		specs   []LinkSpec
+		want    map[NodeLink]LinkProfile
+		wantErr bool
+	}{
+		{name: "no specs", want: map[NodeLink]LinkProfile{}},
+		{
+			name:  "one way",
+			specs: []LinkSpec{{From: []string{"a"}, To: []string{"b", "c"}, Profile: slow}},
+			want:  map[NodeLink]LinkProfile{link("a", "b"): slow, link("a", "c"): slow},
+		},
+		{
+			name:  "symmetric skips links to self",
+			specs: Symmetric([]string{"a", "b"}, []string{"b"}, slow),
+			want:  map[NodeLink]LinkProfile{link("a", "b"): slow, link("b", "a"): slow},
+		},
+		{
+			name: "last spec wins",
+			specs: []LinkSpec{
+				{From: []string{"a"}, To: []string{"b", "c"}, Profile: slow},
+				{From: []string{"a"}, To: []string{"c"}, Profile: lossy},
+			},
+			want: map[NodeLink]LinkProfile{link("a", "b"): slow, link("a", "c"): lossy},
+		},
+		{name: "unknown node", specs: []LinkSpec{{From: []string{"a"}, To: []string{"d"}, Profile: slow}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &linkRecorder{}
+			err := ApplyLinkProfiles(context.Background(), r, "ns", "g", tt.specs, m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplyLinkProfiles() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(r.links, tt.want) {
+				t.Errorf("ApplyLinkProfiles() set %v, want %v", r.links, tt.want)
+			}
+		})
+	}
+}
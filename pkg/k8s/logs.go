@@ -0,0 +1,138 @@
+package k8s
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// LogOpener opens where the logs of a node go. run counts the pods that ran under the node's name while its logs were
+// followed, from 0, since restarting a node (see RestartPods) replaces its pod.
+type LogOpener func(name string, details PodMetaDetails, run int) (io.WriteCloser, error)
+
+// FollowPodLogs streams the logs of the selected pods, with timestamps, into writers from open as they are written.
+// A stream starts once its pod runs, including pods created after following started. The returned function stops
+// following and returns the first error any of the streams hit.
+func (c *Client) FollowPodLogs(
+	ctx context.Context, ns string, labels map[string]string, open LogOpener,
+) (func() error, error) {
+	c.LazyInit()
+	opts := metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(labels))}
+	var list *v1.PodList
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		list, err = c.CoreV1().Pods(ns).List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Following stops early if ctx is done.
+	ctx, cancel := context.WithCancel(ctx)
+	streams := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	var firstErr error
+	setErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// started holds the pods whose logs are followed, and runs the number of them under each name. Both are only
+	// touched by the initial list and then the watch, one after the other.
+	started := make(map[types.UID]bool)
+	runs := make(map[string]int)
+	handle := func(pod *v1.Pod) {
+		switch pod.Status.Phase {
+		case v1.PodRunning, v1.PodSucceeded, v1.PodFailed:
+		default:
+			return
+		}
+		if started[pod.UID] {
+			return
+		}
+		started[pod.UID] = true
+		run := runs[pod.Name]
+		runs[pod.Name]++
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			opts := &v1.PodLogOptions{Follow: true, Timestamps: true}
+			// Errors after stopping are just from cutting the streams short.
+			if err := c.copyPodLog(ctx, pod, opts, open, run); err != nil && ctx.Err() == nil {
+				setErr(err)
+			}
+		}()
+	}
+	for i := range list.Items {
+		handle(&list.Items[i])
+	}
+
+	watching := sync.WaitGroup{}
+	watching.Add(1)
+	go func() {
+		defer watching.Done()
+		follow(ctx, list.ResourceVersion,
+			func(ctx context.Context) ([]v1.Pod, string, error) {
+				list, err := c.CoreV1().Pods(ns).List(ctx, opts)
+				if err != nil {
+					return nil, "", err
+				}
+				return list.Items, list.ResourceVersion, nil
+			},
+			func(ctx context.Context, rv string) (watch.Interface, error) {
+				watchOpts := opts
+				watchOpts.ResourceVersion = rv
+				return c.CoreV1().Pods(ns).Watch(ctx, watchOpts)
+			},
+			handle,
+		)
+	}()
+
+	return func() error {
+		cancel()
+		// No streams start once the watch is done.
+		watching.Wait()
+		streams.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}, nil
+}
+
+func (c *Client) copyPodLog(
+	ctx context.Context, pod *v1.Pod, opts *v1.PodLogOptions, open LogOpener, run int,
+) error {
+	var stream io.ReadCloser
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		stream, err = c.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Stream(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	details := PodMetaDetails{Ip: pod.Status.PodIP}
+	if b, ok := pod.Labels[BatchKey]; ok {
+		details.Batch = IntFromIntLabel(b)
+	}
+	if i, ok := pod.Labels[IndexKey]; ok {
+		details.Index = IntFromIntLabel(i)
+	}
+	w, err := open(pod.Name, details, run)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, stream)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
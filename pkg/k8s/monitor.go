@@ -0,0 +1,383 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// PodEvent is something that happened to a node during a test that the node did not survive, or that kept it from
+// starting: it exited, ran out of memory, its image could not be pulled, etc.
+type PodEvent struct {
+	Time    time.Time
+	Pod     string
+	Index   int
+	Message string
+	// Step is the step of the test the event happened in, if known.
+	Step string
+}
+
+func (e PodEvent) String() string {
+	res := fmt.Sprintf("node %d (%s) %s at %s", e.Index, e.Pod, e.Message, e.Time.Format("15:04:05"))
+	if e.Step != "" {
+		res += fmt.Sprintf(" (step: %s)", e.Step)
+	}
+	return res
+}
+
+// ClusterEvent is a warning the cluster reported about one of a group's pods or network policies, e.g. that an image
+// could not be pulled or a pod could not be scheduled.
+type ClusterEvent struct {
+	Time    time.Time
+	Kind    string
+	Name    string
+	Reason  string
+	Message string
+	Count   int32
+}
+
+func (e ClusterEvent) String() string {
+	res := fmt.Sprintf("%s %s: %s: %s (at %s", e.Kind, e.Name, e.Reason, e.Message, e.Time.Format("15:04:05"))
+	if e.Count > 1 {
+		res += fmt.Sprintf(", %d times", e.Count)
+	}
+	return res + ")"
+}
+
+// PodMonitor records PodEvents for a group of nodes from when it is started until it is stopped.
+type PodMonitor interface {
+	// Step marks the start of a step of the test.
+	Step(name string)
+	// Events returns what happened so far, in order.
+	Events() []PodEvent
+	// ClusterEvents returns the warnings the cluster reported so far, in order.
+	ClusterEvents() []ClusterEvent
+	Stop()
+}
+
+// StepLog remembers when each step of a test started, to tell which step something happened in.
+type StepLog struct {
+	mu    sync.Mutex
+	times []time.Time
+	names []string
+}
+
+func (s *StepLog) Step(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times = append(s.times, time.Now())
+	s.names = append(s.names, name)
+}
+
+// At returns the step that was going on at t, numbered from 1 (e.g. "5 (putting view to the nodes)"), or "" if t is
+// before the first step.
+func (s *StepLog) At(t time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := ""
+	for i, st := range s.times {
+		if st.After(t) {
+			break
+		}
+		res = fmt.Sprintf("%d (%s)", i+1, s.names[i])
+	}
+	return res
+}
+
+// stuckReasons are the reasons for a container to wait that it won't get out of on its own.
+var stuckReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+type podMonitor struct {
+	StepLog
+	start  time.Time
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu            sync.Mutex
+	events        []PodEvent
+	seen          map[string]bool
+	pods          map[types.UID]bool
+	clusterEvents map[types.UID]ClusterEvent
+}
+
+// MonitorPods starts recording what happens to the selected pods. Pods being deleted or killed (see KillPods) are left
+// alone, so the grader killing a node is not reported.
+func (c *Client) MonitorPods(ctx context.Context, ns string, labels map[string]string) (PodMonitor, error) {
+	c.LazyInit()
+	ctx, cancel := context.WithCancel(ctx)
+	m := &podMonitor{
+		start:         time.Now(),
+		cancel:        cancel,
+		seen:          make(map[string]bool),
+		pods:          make(map[types.UID]bool),
+		clusterEvents: make(map[types.UID]ClusterEvent),
+	}
+	opts := metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(labels))}
+	var list *v1.PodList
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		list, err = c.CoreV1().Pods(ns).List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for i := range list.Items {
+		// Compare with the API server's clock, not ours.
+		if created := list.Items[i].CreationTimestamp.Time; created.Before(m.start) {
+			m.start = created
+		}
+		m.observe(&list.Items[i])
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		follow(ctx, list.ResourceVersion,
+			func(ctx context.Context) ([]v1.Pod, string, error) {
+				list, err := c.CoreV1().Pods(ns).List(ctx, opts)
+				if err != nil {
+					return nil, "", err
+				}
+				return list.Items, list.ResourceVersion, nil
+			},
+			func(ctx context.Context, rv string) (watch.Interface, error) {
+				watchOpts := opts
+				watchOpts.ResourceVersion = rv
+				return c.CoreV1().Pods(ns).Watch(ctx, watchOpts)
+			},
+			m.observe,
+		)
+	}()
+
+	// Events are matched to the pods seen above by UID, since pod names are reused between tests; network policies
+	// are matched by name, and only from when the test's pods were created on.
+	eventOpts := metav1.ListOptions{FieldSelector: "type=" + v1.EventTypeWarning}
+	var events *v1.EventList
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		events, err = c.CoreV1().Events(ns).List(ctx, eventOpts)
+		return err
+	})
+	if err != nil {
+		cancel()
+		m.wg.Wait()
+		return nil, err
+	}
+	handleEvent := func(ev *v1.Event) {
+		obj := ev.InvolvedObject
+		switch obj.Kind {
+		case "Pod":
+			if !m.isPod(obj.UID) {
+				return
+			}
+		case "NetworkPolicy":
+			if !c.isGroupPolicy(obj.Name, labels[GroupKey]) || eventTime(ev).Before(m.start) {
+				return
+			}
+		default:
+			return
+		}
+		m.observeEvent(ev)
+	}
+	for i := range events.Items {
+		handleEvent(&events.Items[i])
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		follow(ctx, events.ResourceVersion,
+			func(ctx context.Context) ([]v1.Event, string, error) {
+				list, err := c.CoreV1().Events(ns).List(ctx, eventOpts)
+				if err != nil {
+					return nil, "", err
+				}
+				return list.Items, list.ResourceVersion, nil
+			},
+			func(ctx context.Context, rv string) (watch.Interface, error) {
+				watchOpts := eventOpts
+				watchOpts.ResourceVersion = rv
+				return c.CoreV1().Events(ns).Watch(ctx, watchOpts)
+			},
+			handleEvent,
+		)
+	}()
+	return m, nil
+}
+
+// groupPolicyName matches what follows the group name in the names of a group's network policies (see IsolateBatch,
+// IsolatePod, BlockPodEgressToIps and applyEgressPolicyToIps), so that the events of a group whose name starts with
+// another's are not reported for both.
+var groupPolicyName = regexp.MustCompile(`^(g\d+|p\d+(-egress(-default)?)?)$`)
+
+// isGroupPolicy reports whether name is the name of one of groupName's network policies in this run.
+func (c *Client) isGroupPolicy(name, groupName string) bool {
+	if c.RunId != "" {
+		if !strings.HasSuffix(name, "-"+c.RunId) {
+			return false
+		}
+		name = strings.TrimSuffix(name, "-"+c.RunId)
+	}
+	if !strings.HasPrefix(name, groupName+"-") {
+		return false
+	}
+	return groupPolicyName.MatchString(strings.TrimPrefix(name, groupName+"-"))
+}
+
+func (m *podMonitor) isPod(uid types.UID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pods[uid]
+}
+
+func (m *podMonitor) observe(pod *v1.Pod) {
+	m.mu.Lock()
+	m.pods[pod.UID] = true
+	m.mu.Unlock()
+	if pod.DeletionTimestamp != nil || pod.Annotations[KilledAnnotation] != "" {
+		return
+	}
+	index := -1
+	if idx, ok := pod.Labels[IndexKey]; ok {
+		index = IntFromIntLabel(idx)
+	}
+	record := func(key string, t time.Time, msg string) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		key = fmt.Sprintf("%s/%s", pod.UID, key)
+		if m.seen[key] {
+			return
+		}
+		m.seen[key] = true
+		m.events = append(m.events, PodEvent{Time: t, Pod: pod.Name, Index: index, Message: msg, Step: m.At(t)})
+	}
+
+	now := time.Now()
+	for _, s := range pod.Status.ContainerStatuses {
+		if t := s.State.Terminated; t != nil {
+			at := now
+			if !t.FinishedAt.IsZero() {
+				at = t.FinishedAt.Time
+			}
+			key := fmt.Sprintf("%s/terminated/%d", s.Name, s.RestartCount)
+			if t.Reason == "OOMKilled" {
+				record(key, at, "was killed for using too much memory (OOMKilled)")
+			} else {
+				record(key, at, fmt.Sprintf("exited with code %d (%s)", t.ExitCode, t.Reason))
+			}
+		}
+		if w := s.State.Waiting; w != nil && stuckReasons[w.Reason] {
+			record(fmt.Sprintf("%s/%s", s.Name, w.Reason), now, fmt.Sprintf("is stuck in %s: %s", w.Reason, w.Message))
+		}
+	}
+	if pod.Status.Reason == "Evicted" {
+		record("evicted", now, fmt.Sprintf("was evicted: %s", pod.Status.Message))
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodScheduled && cond.Status == v1.ConditionFalse && cond.Reason == v1.PodReasonUnschedulable {
+			record("unschedulable", now, fmt.Sprintf("could not be scheduled: %s", cond.Message))
+		}
+	}
+}
+
+func (m *podMonitor) Events() []PodEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := append([]PodEvent(nil), m.events...)
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res
+}
+
+func eventTime(ev *v1.Event) time.Time {
+	if !ev.LastTimestamp.IsZero() {
+		return ev.LastTimestamp.Time
+	}
+	if !ev.EventTime.IsZero() {
+		return ev.EventTime.Time
+	}
+	return ev.CreationTimestamp.Time
+}
+
+func (m *podMonitor) observeEvent(ev *v1.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clusterEvents[ev.UID] = ClusterEvent{
+		Time:    eventTime(ev),
+		Kind:    ev.InvolvedObject.Kind,
+		Name:    ev.InvolvedObject.Name,
+		Reason:  ev.Reason,
+		Message: ev.Message,
+		Count:   ev.Count,
+	}
+}
+
+func (m *podMonitor) ClusterEvents() []ClusterEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []ClusterEvent
+	for _, e := range m.clusterEvents {
+		res = append(res, e)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res
+}
+
+func (m *podMonitor) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// follow calls handle for every object list returns, then for every object that changes according to watch, from
+// resource version rv on, until ctx is done. When a watch ends or expires, it lists again and starts over.
+func follow[T any](
+	ctx context.Context, rv string,
+	list func(ctx context.Context) ([]T, string, error),
+	watchFrom func(ctx context.Context, rv string) (watch.Interface, error),
+	handle func(obj *T),
+) {
+	for ctx.Err() == nil {
+		w, err := watchFrom(ctx, rv)
+		if err == nil {
+			for ev := range w.ResultChan() {
+				obj, ok := any(ev.Object).(*T)
+				if ev.Type == watch.Error || !ok {
+					break
+				}
+				if accessor, err := meta.Accessor(ev.Object); err == nil {
+					rv = accessor.GetResourceVersion()
+				}
+				handle(obj)
+			}
+			w.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		time.Sleep(time.Second)
+		items, listRv, err := list(ctx)
+		if err != nil {
+			continue
+		}
+		for i := range items {
+			handle(&items[i])
+		}
+		rv = listRv
+	}
+}
@@ -0,0 +1,29 @@
+package k8s
+
+import "testing"
+
+func TestIsGroupPolicy(t *testing.T) {
+	tests := []struct {
+		runId, name string
+		want        bool
+	}{
+		{"", "team-g0", true},
+		{"", "team-p3", true},
+		{"", "team-p3-egress", true},
+		{"", "team-p3-egress-default", true},
+		{"", "team-2-g0", false},
+		{"", "team-p3-egress-other", false},
+		{"", "team", false},
+		{"run1", "team-g1-run1", true},
+		{"run1", "team-p0-egress-default-run1", true},
+		{"run1", "team-g1", false},
+		{"run1", "team-2-g1-run1", false},
+		{"run1", "team-g1-run2", false},
+	}
+	for _, tt := range tests {
+		c := &Client{RunId: tt.runId}
+		if got := c.isGroupPolicy(tt.name, "team"); got != tt.want {
+			t.Errorf("isGroupPolicy(%q, %q) with run %q = %t, want %t", tt.name, "team", tt.runId, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// NetemImage is the image of the helper containers that shape the nodes' traffic; it needs sh and tc (iproute2).
+const NetemImage = "nicolaka/netshoot:v0.11"
+
+// maxProfilesPerNode is how many distinct profiles the links from one node can have: a prio qdisc has up to 16
+// bands, and the first one is for undegraded traffic.
+const maxProfilesPerNode = 15
+
+// SetLinkProfiles replaces the group's link profiles with links. Traffic is degraded with tc netem from inside the
+// sending pods, on the way out only, so replies on a link are left alone unless the link back has a profile too.
+// Proxied pods are shaped by their proxies instead (see ShapeProxied).
+func (c *Client) SetLinkProfiles(ctx context.Context, ns, groupName string, links map[NodeLink]LinkProfile) error {
+	c.LazyInit()
+	if c.Proxied {
+		nodes, err := c.proxyNodes(ctx, ns, GroupLabels(groupName))
+		if err != nil {
+			return err
+		}
+		return ShapeProxied(&c.injector, nodes, links)
+	}
+	pods, err := c.ListPods(ctx, ns, GroupLabels(groupName))
+	if err != nil {
+		return err
+	}
+	bySender := make(map[string]map[string]LinkProfile)
+	for l, p := range links {
+		if bySender[l.From.Ip] == nil {
+			bySender[l.From.Ip] = make(map[string]LinkProfile)
+		}
+		bySender[l.From.Ip][l.To.Ip] = p
+	}
+
+	scripts := make(map[*v1.Pod]string)
+	// Pods that no longer send on any degraded link get their profiles lifted.
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if c.isShaped(pod.UID) && runningPodByIp(pods.Items, pod.Status.PodIP) == pod && bySender[pod.Status.PodIP] == nil {
+			bySender[pod.Status.PodIP] = map[string]LinkProfile{}
+		}
+	}
+	for ip, profiles := range bySender {
+		pod := runningPodByIp(pods.Items, ip)
+		if pod == nil {
+			return fmt.Errorf("no running pod with IP %s", ip)
+		}
+		if scripts[pod], err = netemScript(profiles); err != nil {
+			return fmt.Errorf("pod %s: %w", pod.Name, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(scripts))
+	for pod, script := range scripts {
+		wg.Add(1)
+		go func(pod *v1.Pod, script string) {
+			defer wg.Done()
+			errChan <- c.shapePod(ctx, pod, script)
+		}(pod, script)
+	}
+	wg.Wait()
+	close(errChan)
+	for e := range errChan {
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ClearLinkProfiles lifts every profile set on the group's links.
+func (c *Client) ClearLinkProfiles(ctx context.Context, ns, groupName string) error {
+	c.LazyInit()
+	if c.Proxied {
+		nodes, err := c.proxyNodes(ctx, ns, GroupLabels(groupName))
+		if err != nil {
+			return err
+		}
+		return ShapeProxied(&c.injector, nodes, nil)
+	}
+	pods, err := c.ListPods(ctx, ns, GroupLabels(groupName))
+	if err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !c.isShaped(pod.UID) || pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if err := c.shapePod(ctx, pod, "tc qdisc del dev eth0 root 2>/dev/null; true"); err != nil {
+			return err
+		}
+		c.setShaped(pod.UID, false)
+	}
+	return nil
+}
+
+func runningPodByIp(pods []v1.Pod, ip string) *v1.Pod {
+	for i := range pods {
+		if pods[i].Status.PodIP == ip && pods[i].Status.Phase == v1.PodRunning && pods[i].DeletionTimestamp == nil {
+			return &pods[i]
+		}
+	}
+	return nil
+}
+
+// netemScript replaces the root qdisc of the pod's interface with a prio qdisc that sends traffic to every
+// destination IP through a band with a netem qdisc for its profile, and everything else through the first band. Bands
+// are numbered in the order of the IPs, so the same profiles always give the same script.
+func netemScript(profiles map[string]LinkProfile) (string, error) {
+	var script strings.Builder
+	script.WriteString("set -e; tc qdisc del dev eth0 root 2>/dev/null || true; ")
+	var ips []string
+	for ip, p := range profiles {
+		if p != (LinkProfile{}) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	bands := make(map[LinkProfile]int)
+	var ordered []LinkProfile
+	for _, ip := range ips {
+		if _, ok := bands[profiles[ip]]; !ok {
+			bands[profiles[ip]] = len(bands) + 2
+			ordered = append(ordered, profiles[ip])
+		}
+	}
+	if len(bands) == 0 {
+		return script.String(), nil
+	}
+	if len(bands) > maxProfilesPerNode {
+		return "", fmt.Errorf("%d distinct link profiles from one node; at most %d are supported",
+			len(bands), maxProfilesPerNode)
+	}
+	script.WriteString("tc qdisc add dev eth0 root handle 1: prio bands 16 priomap" +
+		strings.Repeat(" 0", 16) + "; ")
+	for _, p := range ordered {
+		band := bands[p]
+		script.WriteString(fmt.Sprintf("tc qdisc add dev eth0 parent 1:%d handle %d: netem", band, band+10))
+		if p.Delay > 0 || p.Jitter > 0 {
+			script.WriteString(fmt.Sprintf(" delay %dus %dus", p.Delay/time.Microsecond, p.Jitter/time.Microsecond))
+		}
+		if p.Loss > 0 {
+			script.WriteString(fmt.Sprintf(" loss %g%%", p.Loss))
+		}
+		script.WriteString("; ")
+	}
+	for _, ip := range ips {
+		script.WriteString(fmt.Sprintf(
+			"tc filter add dev eth0 parent 1: protocol ip prio 1 u32 match ip dst %s/32 flowid 1:%d; ",
+			ip, bands[profiles[ip]]))
+	}
+	return script.String(), nil
+}
+
+// shapePod runs script in a helper container in the pod's network namespace that may change its traffic control
+// settings.
+func (c *Client) shapePod(ctx context.Context, pod *v1.Pod, script string) error {
+	name := ephemeralName("netem")
+	if err := c.addEphemeralContainer(ctx, pod.Namespace, pod.Name, v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:    name,
+			Image:   NetemImage,
+			Command: []string{"sh", "-c", script + " && echo ok"},
+			SecurityContext: &v1.SecurityContext{
+				Capabilities: &v1.Capabilities{Add: []v1.Capability{"NET_ADMIN"}},
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to add traffic shaper to pod %s: %w", pod.Name, err)
+	}
+	if err := c.awaitEphemeralContainer(ctx, pod.Namespace, pod.Name, name, true, 2*time.Minute); err != nil {
+		return err
+	}
+	logs, err := c.containerLogs(ctx, pod.Namespace, pod.Name, name)
+	if err != nil {
+		return fmt.Errorf("failed to get traffic shaper logs from pod %s: %w", pod.Name, err)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(logs), "ok") {
+		return &InfraError{fmt.Errorf("failed to shape the traffic of pod %s: %s", pod.Name, strings.TrimSpace(logs))}
+	}
+	c.setShaped(pod.UID, true)
+	return nil
+}
+
+func (c *Client) isShaped(uid types.UID) bool {
+	c.shapedMu.Lock()
+	defer c.shapedMu.Unlock()
+	return c.shaped[uid]
+}
+
+func (c *Client) setShaped(uid types.UID, shaped bool) {
+	c.shapedMu.Lock()
+	defer c.shapedMu.Unlock()
+	if c.shaped == nil {
+		c.shaped = make(map[types.UID]bool)
+	}
+	if shaped {
+		c.shaped[uid] = true
+	} else {
+		delete(c.shaped, uid)
+	}
+}
+
+// anyShaped reports whether the traffic of any pod has link profiles.
+func (c *Client) anyShaped() bool {
+	c.shapedMu.Lock()
+	defer c.shapedMu.Unlock()
+	return len(c.shaped) > 0
+}
+
+// forgetShaped forgets the link profiles of the given pods, which are being deleted.
+func (c *Client) forgetShaped(pods []v1.Pod) {
+	c.shapedMu.Lock()
+	defer c.shapedMu.Unlock()
+	for _, pod := range pods {
+		delete(c.shaped, pod.UID)
+	}
+}
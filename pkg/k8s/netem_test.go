@@ -0,0 +1,62 @@
+package k8s
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNetemScript(t *testing.T) {
+	const reset = "set -e; tc qdisc del dev eth0 root 2>/dev/null || true; "
+	const prio = "tc qdisc add dev eth0 root handle 1: prio bands 16 priomap 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0; "
+	filter := func(ip string, band int) string {
+		return fmt.Sprintf("tc filter add dev eth0 parent 1: protocol ip prio 1 u32 match ip dst %s/32 flowid 1:%d; ",
+			ip, band)
+	}
+	slow := LinkProfile{Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond}
+	lossy := LinkProfile{Loss: 1.5}
+	tooMany := make(map[string]LinkProfile)
+	for i := 0; i <= maxProfilesPerNode; i++ {
+		tooMany[fmt.Sprintf("10.0.0.%d", i)] = LinkProfile{Delay: time.Duration(i+1) * time.Millisecond}
+	}
+	tests := []struct {
+		name     string
+		profiles map[string]LinkProfile
+		want     string
+		wantErr  bool
+	}{
+		{name: "no profiles", profiles: nil, want: reset},
+		{name: "only zero profiles", profiles: map[string]LinkProfile{"10.0.0.1": {}}, want: reset},
+		{
+			name:     "one profile",
+			profiles: map[string]LinkProfile{"10.0.0.1": slow},
+			want: reset + prio + "tc qdisc add dev eth0 parent 1:2 handle 12: netem delay 100000us 10000us; " +
+				filter("10.0.0.1", 2),
+		},
+		{
+			name:     "shared profile shares a band",
+			profiles: map[string]LinkProfile{"10.0.0.2": lossy, "10.0.0.1": lossy, "10.0.0.3": {}},
+			want: reset + prio + "tc qdisc add dev eth0 parent 1:2 handle 12: netem loss 1.5%; " +
+				filter("10.0.0.1", 2) + filter("10.0.0.2", 2),
+		},
+		{
+			name:     "bands in the order of the IPs",
+			profiles: map[string]LinkProfile{"10.0.0.2": slow, "10.0.0.1": lossy},
+			want: reset + prio + "tc qdisc add dev eth0 parent 1:2 handle 12: netem loss 1.5%; " +
+				"tc qdisc add dev eth0 parent 1:3 handle 13: netem delay 100000us 10000us; " +
+				filter("10.0.0.1", 2) + filter("10.0.0.2", 3),
+		},
+		{name: "too many profiles", profiles: tooMany, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := netemScript(tt.profiles)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("netemScript() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("netemScript() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
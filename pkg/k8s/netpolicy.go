@@ -10,38 +10,77 @@ import (
 	v1 "k8s.io/client-go/applyconfigurations/networking/v1"
 )
 
-func (c *Client) IsolateBatch(ns string, groupName string, batch int) error {
+func (c *Client) IsolateBatch(ctx context.Context, ns string, groupName string, batch int) error {
 	c.LazyInit()
-	return c.CreateNetPolicy(ns, fmt.Sprintf("%s-g%d", groupName, batch), BatchLabels(groupName, batch), nil)
+	return c.CreateNetPolicy(ctx, ns, fmt.Sprintf("%s-g%d", groupName, batch), BatchLabels(groupName, batch), nil)
 }
 
-func (c *Client) IsolatePodByIps(ns string, groupName string, idx int, ips []string) error {
+func (c *Client) IsolatePodByIps(ctx context.Context, ns string, groupName string, idx int, ips []string) error {
 	c.LazyInit()
-	return c.CreateNetPolicy(ns, fmt.Sprintf("%s-p%d", groupName, idx), PodLabelsNoBatch(groupName, idx), ips)
+	return c.CreateNetPolicy(ctx, ns, fmt.Sprintf("%s-p%d", groupName, idx), PodLabelsNoBatch(groupName, idx), ips)
 }
 
-func (c *Client) IsolatePod(ns string, groupName string, idx int) error {
+func (c *Client) IsolatePod(ctx context.Context, ns string, groupName string, idx int) error {
 	c.LazyInit()
-	return c.CreateNetPolicy(ns, fmt.Sprintf("%s-p%d", groupName, idx), PodLabelsNoBatch(groupName, idx), nil)
+	return c.CreateNetPolicy(ctx, ns, fmt.Sprintf("%s-p%d", groupName, idx), PodLabelsNoBatch(groupName, idx), nil)
 }
 
-func (c *Client) CreateNetPolicy(ns, name string, labels map[string]string, extraIps []string) error {
+// BlockOneWay stops every pod in from from opening connections to any pod in to, while connections in the other
+// direction (and the replies to them) still go through. Egress policies add up, so a pod only gets one: blocking
+// more destinations for the same pod needs them all in a single call. With DenyEgress set, the pods' default egress
+// policies are narrowed instead, since an extra policy could only let more through.
+func (c *Client) BlockOneWay(ctx context.Context, ns, groupName string, from, to []PodMetaDetails) error {
 	c.LazyInit()
+	var toIps []string
+	for _, p := range to {
+		toIps = append(toIps, p.Ip)
+	}
+	if c.DenyEgress && !c.Proxied {
+		return c.blockEgressToIps(ctx, ns, groupName, from, toIps)
+	}
+	for _, p := range from {
+		if err := c.BlockPodEgressToIps(ctx, ns, groupName, p.Index, toIps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) BlockPodEgressToIps(ctx context.Context, ns string, groupName string, idx int, ips []string) error {
+	c.LazyInit()
+	name := fmt.Sprintf("%s-p%d-egress", groupName, idx)
+	return c.CreateEgressNetPolicy(ctx, ns, name, PodLabelsNoBatch(groupName, idx), ips)
+}
+
+// CreateNetPolicy isolates the selected pods: only pods with the same labels, extraIps and the grader (see
+// Client.GraderCidrs) can connect to them. Proxied pods are isolated by their proxies instead.
+func (c *Client) CreateNetPolicy(
+	ctx context.Context, ns, name string, labels map[string]string, extraIps []string,
+) error {
+	c.LazyInit()
+	if c.Proxied {
+		nodes, err := c.proxyNodes(ctx, ns, GroupLabels(labels[GroupKey]))
+		if err != nil {
+			return err
+		}
+		IsolateProxied(&c.injector, nodes, labels, extraIps)
+		return nil
+	}
+	name = c.runName(name)
+	labels = c.runLabels(labels)
 	kind := "NetworkPolicy"
 	apiVersion := "networking.k8s.io/v1"
-	//hostCidr := "192.168.0.0/16"
-	from := []v1.NetworkPolicyPeerApplyConfiguration{
+	graderPeers, err := c.graderPeers(ctx, ns)
+	if err != nil {
+		return err
+	}
+	from := append([]v1.NetworkPolicyPeerApplyConfiguration{
 		{
 			PodSelector: &applymetav1.LabelSelectorApplyConfiguration{
 				MatchLabels: labels,
 			},
 		},
-		//{
-		//	IPBlock: &v1.IPBlockApplyConfiguration{
-		//		CIDR: &hostCidr,
-		//	},
-		//},
-	}
+	}, graderPeers...)
 	for _, ip := range extraIps {
 		ipCidr := fmt.Sprintf("%s/32", ip)
 		from = append(from, v1.NetworkPolicyPeerApplyConfiguration{
@@ -57,9 +96,10 @@ func (c *Client) CreateNetPolicy(ns, name string, labels map[string]string, extr
 			APIVersion: &apiVersion,
 		},
 		ObjectMetaApplyConfiguration: &applymetav1.ObjectMetaApplyConfiguration{
-			Name:      &name,
-			Namespace: &ns,
-			Labels:    labels,
+			Name:        &name,
+			Namespace:   &ns,
+			Labels:      ownedLabels(labels),
+			Annotations: c.ownerAnnotations(),
 		},
 		Spec: &v1.NetworkPolicySpecApplyConfiguration{
 			PodSelector: &applymetav1.LabelSelectorApplyConfiguration{
@@ -78,22 +118,97 @@ func (c *Client) CreateNetPolicy(ns, name string, labels map[string]string, extr
 		FieldManager: kFieldManager,
 		Force:        true,
 	}
-	_, err := c.NetworkingV1().NetworkPolicies(ns).Apply(context.TODO(), req, applyOpts)
-	return err
+	return withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.NetworkingV1().NetworkPolicies(ns).Apply(ctx, req, applyOpts)
+		return err
+	})
 }
 
-func (c *Client) DeleteNetPolicies(ns string, labels map[string]string) error {
+// CreateEgressNetPolicy lets the selected pods open connections to anywhere except blockedIps. Proxied pods are
+// blocked by their proxies instead.
+func (c *Client) CreateEgressNetPolicy(
+	ctx context.Context, ns, name string, labels map[string]string, blockedIps []string,
+) error {
 	c.LazyInit()
-	netPolicies, err := c.NetworkingV1().NetworkPolicies(ns).List(
-		context.TODO(), metav1.ListOptions{LabelSelector: condenseLabelsMap(labels)})
-	if err != nil {
-		return err
+	if c.Proxied {
+		nodes, err := c.proxyNodes(ctx, ns, GroupLabels(labels[GroupKey]))
+		if err != nil {
+			return err
+		}
+		BlockProxied(&c.injector, nodes, labels, blockedIps)
+		return nil
+	}
+	name = c.runName(name)
+	labels = c.runLabels(labels)
+	kind := "NetworkPolicy"
+	apiVersion := "networking.k8s.io/v1"
+	anywhere := "0.0.0.0/0"
+	var except []string
+	for _, ip := range blockedIps {
+		except = append(except, fmt.Sprintf("%s/32", ip))
 	}
-	for _, np := range netPolicies.Items {
-		err := c.NetworkingV1().NetworkPolicies(ns).Delete(context.TODO(), np.GetName(), metav1.DeleteOptions{})
+
+	req := &v1.NetworkPolicyApplyConfiguration{
+		TypeMetaApplyConfiguration: applymetav1.TypeMetaApplyConfiguration{
+			Kind:       &kind,
+			APIVersion: &apiVersion,
+		},
+		ObjectMetaApplyConfiguration: &applymetav1.ObjectMetaApplyConfiguration{
+			Name:        &name,
+			Namespace:   &ns,
+			Labels:      ownedLabels(labels),
+			Annotations: c.ownerAnnotations(),
+		},
+		Spec: &v1.NetworkPolicySpecApplyConfiguration{
+			PodSelector: &applymetav1.LabelSelectorApplyConfiguration{
+				MatchLabels: labels,
+			},
+			Egress: []v1.NetworkPolicyEgressRuleApplyConfiguration{
+				{
+					To: []v1.NetworkPolicyPeerApplyConfiguration{
+						{
+							IPBlock: &v1.IPBlockApplyConfiguration{
+								CIDR:   &anywhere,
+								Except: except,
+							},
+						},
+					},
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+		},
+	}
+
+	applyOpts := metav1.ApplyOptions{
+		FieldManager: kFieldManager,
+		Force:        true,
+	}
+	return withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.NetworkingV1().NetworkPolicies(ns).Apply(ctx, req, applyOpts)
+		return err
+	})
+}
+
+// DeleteNetPolicies heals the partitions of the selected pods. The default egress policies of the nodes (see
+// Client.DenyEgress) stay, but go back to letting the nodes reach their whole group.
+func (c *Client) DeleteNetPolicies(ctx context.Context, ns string, labels map[string]string) error {
+	c.LazyInit()
+	if c.Proxied {
+		nodes, err := c.proxyNodes(ctx, ns, labels)
 		if err != nil {
 			return err
 		}
+		HealProxied(&c.injector, nodes, labels)
 	}
-	return nil
+	err := withRetry(ctx, func(ctx context.Context) error {
+		return c.NetworkingV1().NetworkPolicies(ns).DeleteCollection(
+			ctx,
+			metav1.DeleteOptions{},
+			metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(labels))},
+		)
+	})
+	if err != nil || !c.DenyEgress {
+		return err
+	}
+	return c.resetEgressPolicies(ctx, ns, labels)
 }
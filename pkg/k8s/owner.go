@@ -0,0 +1,210 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ManagedByKey labels everything the grader creates, so that Reap can find it in any namespace.
+const ManagedByKey = "app.kubernetes.io/managed-by"
+
+const managedBy = "cse138-grader"
+
+// RunAnnotation holds the ID of the run that created a resource, and ExpiresAnnotation (RFC 3339) when Reap may delete
+// it.
+const (
+	RunAnnotation     = "cse138-grader/run"
+	ExpiresAnnotation = "cse138-grader/expires"
+)
+
+// DefaultTTL is how long the resources of a run are kept, when the client has no TTL.
+const DefaultTTL = 6 * time.Hour
+
+// CleanupTimeout bounds cleaning up after a test or a run.
+const CleanupTimeout = 2 * time.Minute
+
+// CleanupContext returns a context for cleaning up, which gets CleanupTimeout even when the test or run it cleans up
+// after was stopped for running out of time or being interrupted.
+func CleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), CleanupTimeout)
+}
+
+// ownedLabels returns labels plus the label that marks resources as the grader's.
+func ownedLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		res[k] = v
+	}
+	res[ManagedByKey] = managedBy
+	return res
+}
+
+// ownerAnnotations say which run is creating a resource, and until when it needs it.
+func (c *Client) ownerAnnotations() map[string]string {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	return map[string]string{
+		RunAnnotation:     c.RunId,
+		ExpiresAnnotation: time.Now().Add(ttl).UTC().Format(time.RFC3339),
+	}
+}
+
+// DeleteRun deletes the pods, network policies and services of the client's run in ns, without waiting for them to
+// go away. It is what is left to do when the grader is interrupted in the middle of a test.
+func (c *Client) DeleteRun(ctx context.Context, ns string) error {
+	c.LazyInit()
+	if c.RunId == "" {
+		return fmt.Errorf("cannot tell the resources of a run without a run ID")
+	}
+	opts := metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(map[string]string{ManagedByKey: managedBy}))}
+	err := withRetry(ctx, func(ctx context.Context) error {
+		return c.CoreV1().Pods(ns).DeleteCollection(
+			ctx, metav1.DeleteOptions{GracePeriodSeconds: c.GracePeriodSeconds}, opts)
+	})
+	if err != nil {
+		return err
+	}
+	c.forgetExpected(ns, c.runLabels(nil))
+	err = withRetry(ctx, func(ctx context.Context) error {
+		return c.NetworkingV1().NetworkPolicies(ns).DeleteCollection(ctx, metav1.DeleteOptions{}, opts)
+	})
+	if err != nil {
+		return err
+	}
+	// Services cannot be deleted as a collection.
+	var services *v1.ServiceList
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		services, err = c.CoreV1().Services(ns).List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range services.Items {
+		err := deleteWithRetry(ctx, func(ctx context.Context) error {
+			return c.CoreV1().Services(ns).Delete(ctx, s.Name, metav1.DeleteOptions{})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reaped is a resource Reap deleted.
+type Reaped struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Run       string
+	Expired   time.Time
+}
+
+func (r Reaped) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s %s (run %s, expired %s)", r.Kind, r.Name, r.Run, r.Expired.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s %s/%s (run %s, expired %s)", r.Kind, r.Namespace, r.Name, r.Run,
+		r.Expired.Format(time.RFC3339))
+}
+
+// Reap deletes, in every namespace, the grader's pods, network policies, services and namespaces that expired before
+// now, or, if runId is set, all of that run's regardless of when they expire. Resources without the ownership
+// annotations are left alone. It returns what it deleted, also when it fails part of the way.
+func (c *Client) Reap(ctx context.Context, now time.Time, runId string) ([]Reaped, error) {
+	c.LazyInit()
+	selector := map[string]string{ManagedByKey: managedBy}
+	if runId != "" {
+		selector[RunKey] = runId
+	}
+	opts := metav1.ListOptions{LabelSelector: condenseLabelsMap(selector)}
+	var res []Reaped
+	reap := func(kind string, obj metav1.Object, del func(ctx context.Context) error) error {
+		run, ok := obj.GetAnnotations()[RunAnnotation]
+		if !ok {
+			return nil
+		}
+		expires, err := time.Parse(time.RFC3339, obj.GetAnnotations()[ExpiresAnnotation])
+		if err != nil || (runId == "" && expires.After(now)) {
+			return nil
+		}
+		if err := deleteWithRetry(ctx, del); err != nil {
+			return fmt.Errorf("failed to delete %s %s: %w", kind, obj.GetName(), err)
+		}
+		res = append(res, Reaped{Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName(), Run: run, Expired: expires})
+		return nil
+	}
+
+	var pods *v1.PodList
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		pods, err = c.CoreV1().Pods(metav1.NamespaceAll).List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		if err := reap("pod", p, func(ctx context.Context) error {
+			return c.CoreV1().Pods(p.Namespace).Delete(ctx, p.Name, metav1.DeleteOptions{})
+		}); err != nil {
+			return res, err
+		}
+	}
+	var policies *networkingv1.NetworkPolicyList
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		policies, err = c.NetworkingV1().NetworkPolicies(metav1.NamespaceAll).List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	for i := range policies.Items {
+		p := &policies.Items[i]
+		if err := reap("networkpolicy", p, func(ctx context.Context) error {
+			return c.NetworkingV1().NetworkPolicies(p.Namespace).Delete(ctx, p.Name, metav1.DeleteOptions{})
+		}); err != nil {
+			return res, err
+		}
+	}
+	var services *v1.ServiceList
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		services, err = c.CoreV1().Services(metav1.NamespaceAll).List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	for i := range services.Items {
+		s := &services.Items[i]
+		if err := reap("service", s, func(ctx context.Context) error {
+			return c.CoreV1().Services(s.Namespace).Delete(ctx, s.Name, metav1.DeleteOptions{})
+		}); err != nil {
+			return res, err
+		}
+	}
+	var namespaces *v1.NamespaceList
+	err = withRetry(ctx, func(ctx context.Context) (err error) {
+		namespaces, err = c.CoreV1().Namespaces().List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	for i := range namespaces.Items {
+		n := &namespaces.Items[i]
+		if err := reap("namespace", n, func(ctx context.Context) error {
+			return c.CoreV1().Namespaces().Delete(ctx, n.Name, metav1.DeleteOptions{})
+		}); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
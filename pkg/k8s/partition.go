@@ -0,0 +1,185 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+)
+
+// Partition describes a network split as groups of node addresses. Two nodes can reach each other if they share a
+// group. Groups may overlap, in which case the nodes they share bridge them; nodes in no group are cut off from
+// everyone.
+type Partition struct {
+	Groups [][]string
+}
+
+// MajorityMinority splits the nodes into a majority (the first n/2+1 of them) and a minority (the rest). It needs at
+// least 2 nodes, so that the minority isn't empty.
+func MajorityMinority(addrs []string) (Partition, error) {
+	if len(addrs) < 2 {
+		return Partition{}, fmt.Errorf("a majority-minority partition needs at least 2 nodes, got %d", len(addrs))
+	}
+	m := len(addrs)/2 + 1
+	return Partition{Groups: [][]string{addrs[:m:m], addrs[m:]}}, nil
+}
+
+// OnePerShard splits the nodes so that every group has at least one node from each non-empty shard. There are as many
+// groups as the smallest of those has nodes; the extra nodes of bigger shards go to the last group.
+func OnePerShard(shards [][]string) Partition {
+	numParts := 0
+	for _, s := range shards {
+		if len(s) > 0 && (numParts == 0 || numParts > len(s)) {
+			numParts = len(s)
+		}
+	}
+	res := make([][]string, numParts)
+	for _, s := range shards {
+		for idx, node := range s {
+			targetIdx := idx
+			if targetIdx >= numParts {
+				targetIdx = numParts - 1
+			}
+			res[targetIdx] = append(res[targetIdx], node)
+		}
+	}
+	return Partition{Groups: res}
+}
+
+// EachAlone cuts every node off from all the others.
+func EachAlone(addrs []string) Partition {
+	res := make([][]string, len(addrs))
+	for idx, addr := range addrs {
+		res[idx] = []string{addr}
+	}
+	return Partition{Groups: res}
+}
+
+// Bridge splits all but the first node into two halves that can't reach each other, and puts the first node in both
+// halves so that it can reach everyone. It needs at least 3 nodes, so that neither half is just the bridge.
+func Bridge(addrs []string) (Partition, error) {
+	if len(addrs) < 3 {
+		return Partition{}, fmt.Errorf("a bridge partition needs at least 3 nodes, got %d", len(addrs))
+	}
+	bridge, rest := addrs[0], addrs[1:]
+	m := len(rest) / 2
+	left := append([]string{bridge}, rest[:m]...)
+	right := append([]string{bridge}, rest[m:]...)
+	return Partition{Groups: [][]string{left, right}}, nil
+}
+
+// Ring lets every node reach only the nodes right before and after it (wrapping around). It needs at least 3 nodes;
+// with fewer, every node would reach every other one.
+func Ring(addrs []string) (Partition, error) {
+	if len(addrs) < 3 {
+		return Partition{}, fmt.Errorf("a ring partition needs at least 3 nodes, got %d", len(addrs))
+	}
+	res := make([][]string, len(addrs))
+	for idx, addr := range addrs {
+		res[idx] = []string{addr, addrs[(idx+1)%len(addrs)]}
+	}
+	return Partition{Groups: res}, nil
+}
+
+// Peers returns the nodes addr can reach under the partition, including addr itself.
+func (p Partition) Peers(addr string) []string {
+	seen := map[string]struct{}{addr: {}}
+	res := []string{addr}
+	for _, g := range p.Groups {
+		in := false
+		for _, a := range g {
+			if a == addr {
+				in = true
+				break
+			}
+		}
+		if !in {
+			continue
+		}
+		for _, a := range g {
+			if _, ok := seen[a]; !ok {
+				seen[a] = struct{}{}
+				res = append(res, a)
+			}
+		}
+	}
+	return res
+}
+
+// Reaches tells whether the node at address from can reach the node at address to under the partition.
+func (p Partition) Reaches(from, to string) bool {
+	for _, peer := range p.Peers(from) {
+		if peer == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyPartition isolates every node in m (keyed by address, as returned by ListAddressGroupIndexMappings) so that
+// it can only be reached by its peers under p. If the backend can verify partitions, it returns an InfraError unless
+// the partition is confirmed to be in effect.
+func ApplyPartition(
+	ctx context.Context, b ClusterBackend, ns, groupName string, p Partition, m map[string]PodMetaDetails,
+) error {
+	for _, addr := range PodAddrsFromMappings(m) {
+		var ips []string
+		for _, peer := range p.Peers(addr) {
+			if details, ok := m[peer]; ok {
+				ips = append(ips, details.Ip)
+			}
+		}
+		if err := b.IsolatePodByIps(ctx, ns, groupName, m[addr].Index, ips); err != nil {
+			return err
+		}
+	}
+	if v, ok := b.(PartitionVerifier); ok {
+		if err := v.VerifyReachability(ctx, ns, groupName, p.Reaches, m); err != nil {
+			return &InfraError{Err: fmt.Errorf("could not confirm the partition is in effect: %w", err)}
+		}
+	}
+	return nil
+}
+
+// ApplyOneWay stops every node in from (addresses in m, as returned by ListAddressGroupIndexMappings) from opening
+// connections to any node in to, while connections in the other direction still get through. If the backend can verify
+// partitions, it returns an InfraError unless exactly those connections are confirmed to be blocked between the nodes
+// in m.
+func ApplyOneWay(
+	ctx context.Context, b ClusterBackend, ns, groupName string, from, to []string, m map[string]PodMetaDetails,
+) error {
+	blocked := make(map[[2]string]bool)
+	var fromDetails, toDetails []PodMetaDetails
+	for _, f := range from {
+		fromDetails = append(fromDetails, m[f])
+		for _, t := range to {
+			blocked[[2]string{f, t}] = true
+		}
+	}
+	for _, t := range to {
+		toDetails = append(toDetails, m[t])
+	}
+	if err := b.BlockOneWay(ctx, ns, groupName, fromDetails, toDetails); err != nil {
+		return err
+	}
+	if v, ok := b.(PartitionVerifier); ok {
+		reaches := func(from, to string) bool { return from == to || !blocked[[2]string{from, to}] }
+		if err := v.VerifyReachability(ctx, ns, groupName, reaches, m); err != nil {
+			return &InfraError{Err: fmt.Errorf("could not confirm the one-way partition is in effect: %w", err)}
+		}
+	}
+	return nil
+}
+
+// HealPartition lifts any partition applied to the group. If m is not nil and the backend can verify partitions, it
+// returns an InfraError unless all nodes in m are confirmed to reach each other again.
+func HealPartition(ctx context.Context, b ClusterBackend, ns, groupName string, m map[string]PodMetaDetails) error {
+	if err := b.DeleteNetPolicies(ctx, ns, GroupLabels(groupName)); err != nil {
+		return err
+	}
+	if v, ok := b.(PartitionVerifier); ok && m != nil {
+		healed := Partition{Groups: [][]string{PodAddrsFromMappings(m)}}
+		if err := v.VerifyReachability(ctx, ns, groupName, healed.Reaches, m); err != nil {
+			return &InfraError{Err: fmt.Errorf("could not confirm the partition is healed: %w", err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package k8s
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMajorityMinority(t *testing.T) {
+	tests := []struct {
+		name    string
+		addrs   []string
+		want    [][]string
+		wantErr bool
+	}{
+		{name: "empty", addrs: nil, wantErr: true},
+		{name: "one node", addrs: []string{"a"}, wantErr: true},
+		{name: "two nodes", addrs: []string{"a", "b"}, want: [][]string{{"a", "b"}, {}}},
+		{name: "three nodes", addrs: []string{"a", "b", "c"}, want: [][]string{{"a", "b"}, {"c"}}},
+		{name: "four nodes", addrs: []string{"a", "b", "c", "d"}, want: [][]string{{"a", "b", "c"}, {"d"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MajorityMinority(tt.addrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MajorityMinority(%v) error = %v, wantErr %t", tt.addrs, err, tt.wantErr)
+			}
+			if !tt.wantErr && !sameGroups(got.Groups, tt.want) {
+				t.Errorf("MajorityMinority(%v) = %v, want %v", tt.addrs, got.Groups, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnePerShard(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards [][]string
+		want   [][]string
+	}{
+		{name: "no shards", shards: nil, want: [][]string{}},
+		{name: "only empty shards", shards: [][]string{{}, {}}, want: [][]string{}},
+		{name: "even shards", shards: [][]string{{"a", "b"}, {"c", "d"}}, want: [][]string{{"a", "c"}, {"b", "d"}}},
+		{
+			name:   "extra nodes go last",
+			shards: [][]string{{"a", "b", "c"}, {"d", "e"}},
+			want:   [][]string{{"a", "d"}, {"b", "c", "e"}},
+		},
+		{
+			name:   "empty shard ignored",
+			shards: [][]string{{"a", "b"}, {}, {"c", "d"}},
+			want:   [][]string{{"a", "c"}, {"b", "d"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OnePerShard(tt.shards); !sameGroups(got.Groups, tt.want) {
+				t.Errorf("OnePerShard(%v) = %v, want %v", tt.shards, got.Groups, tt.want)
+			}
+		})
+	}
+}
+
+func TestBridge(t *testing.T) {
+	tests := []struct {
+		name    string
+		addrs   []string
+		want    [][]string
+		wantErr bool
+	}{
+		{name: "empty", addrs: nil, wantErr: true},
+		{name: "two nodes", addrs: []string{"a", "b"}, wantErr: true},
+		{name: "three nodes", addrs: []string{"a", "b", "c"}, want: [][]string{{"a", "b"}, {"a", "c"}}},
+		{name: "four nodes", addrs: []string{"a", "b", "c", "d"}, want: [][]string{{"a", "b"}, {"a", "c", "d"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Bridge(tt.addrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Bridge(%v) error = %v, wantErr %t", tt.addrs, err, tt.wantErr)
+			}
+			if !tt.wantErr && !sameGroups(got.Groups, tt.want) {
+				t.Errorf("Bridge(%v) = %v, want %v", tt.addrs, got.Groups, tt.want)
+			}
+		})
+	}
+}
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		addrs   []string
+		want    [][]string
+		wantErr bool
+	}{
+		{name: "empty", addrs: nil, wantErr: true},
+		{name: "two nodes", addrs: []string{"a", "b"}, wantErr: true},
+		{name: "three nodes", addrs: []string{"a", "b", "c"}, want: [][]string{{"a", "b"}, {"b", "c"}, {"c", "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Ring(tt.addrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Ring(%v) error = %v, wantErr %t", tt.addrs, err, tt.wantErr)
+			}
+			if !tt.wantErr && !sameGroups(got.Groups, tt.want) {
+				t.Errorf("Ring(%v) = %v, want %v", tt.addrs, got.Groups, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaches(t *testing.T) {
+	p := Partition{Groups: [][]string{{"a", "b"}, {"b", "c"}}}
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"a", "a", true},
+		{"a", "b", true},
+		{"b", "c", true},
+		{"a", "c", false},
+		{"c", "a", false},
+		{"d", "a", false},
+		{"d", "d", true},
+	}
+	for _, tt := range tests {
+		if got := p.Reaches(tt.from, tt.to); got != tt.want {
+			t.Errorf("Reaches(%s, %s) = %t, want %t", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// sameGroups compares groups, treating nil and empty groups alike.
+func sameGroups(got, want [][]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if len(got[i]) == 0 && len(want[i]) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
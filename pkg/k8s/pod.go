@@ -3,24 +3,35 @@ package k8s
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"sort"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	corev1 "k8s.io/client-go/applyconfigurations/core/v1"
 	applymetav1 "k8s.io/client-go/applyconfigurations/meta/v1"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
 )
 
 const PodPort = "8080"
 
-func (c *Client) ListPods(ns string, labels map[string]string) (*v1.PodList, error) {
+func (c *Client) ListPods(ctx context.Context, ns string, labels map[string]string) (*v1.PodList, error) {
 	c.LazyInit()
-	return c.Clientset.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: condenseLabelsMap(labels),
+	var res *v1.PodList
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.Clientset.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{
+			LabelSelector: condenseLabelsMap(c.runLabels(labels)),
+		})
+		return err
 	})
+	return res, err
 }
 
 type PodMetaDetails struct {
@@ -29,44 +40,47 @@ type PodMetaDetails struct {
 	Index int
 }
 
+// ListAddressGroupIndexMappings waits for the selected pods to run, all those the client created and at least one, and
+// maps their addresses to their labels. With PortForward set, it also forwards a local port to each pod, so the grader
+// can keep dialing the pod addresses. Pods with stable addresses are mapped by their DNS names, which the grader dials
+// through their current IPs. It returns an InfraError if GraderCidrs contain a pod's IP.
 func (c *Client) ListAddressGroupIndexMappings(
-	ns string, labels map[string]string,
+	ctx context.Context, ns string, labels map[string]string,
 ) (map[string]PodMetaDetails, error) {
 	c.LazyInit()
-	deadline := time.NewTimer(20 * time.Second)
-	defer deadline.Stop()
+	pods, err := c.awaitRunning(ctx, ns, labels, c.expectedPods(ns, c.runLabels(labels)), c.readyTimeout())
+	if err != nil {
+		return nil, err
+	}
 
 	res := make(map[string]PodMetaDetails)
-	for {
-		select {
-		case <-deadline.C:
-			return nil, fmt.Errorf("deadline for pods ready exceeded; ns=%s; labels=%v", ns, labels)
-		default: // Fall through
+	for _, pod := range pods {
+		for _, l := range []string{BatchKey, IndexKey} {
+			if _, ok := pod.ObjectMeta.Labels[l]; !ok {
+				return nil, fmt.Errorf("pod has no label with key=%s", l)
+			}
 		}
-		pods, err := c.ListPods(ns, labels)
-		if err != nil {
-			return nil, err
+		podInfo := PodMetaDetails{
+			Ip:    pod.Status.PodIP,
+			Batch: IntFromIntLabel(pod.ObjectMeta.Labels[BatchKey]),
+			Index: IntFromIntLabel(pod.ObjectMeta.Labels[IndexKey]),
 		}
-		ready := true
-		for _, pod := range pods.Items {
-			if pod.Status.Phase != v1.PodRunning {
-				ready = false
-				break
-			}
-			for _, l := range []string{BatchKey, IndexKey} {
-				if _, ok := pod.ObjectMeta.Labels[l]; !ok {
-					return nil, fmt.Errorf("pod has no label with key=%s", l)
-				}
-			}
-			podInfo := PodMetaDetails{
-				Ip:    pod.Status.PodIP,
-				Batch: IntFromIntLabel(pod.ObjectMeta.Labels[BatchKey]),
-				Index: IntFromIntLabel(pod.ObjectMeta.Labels[IndexKey]),
+		if pod.Annotations[ProxyAnnotation] == "" {
+			if err := c.checkGraderCidrs(&pod); err != nil {
+				return nil, err
 			}
-			res[fmt.Sprintf("%s:%s", pod.Status.PodIP, PodPort)] = podInfo
 		}
-		if ready {
-			break
+		addr := podAddr(&pod)
+		res[addr] = podInfo
+		if pod.Annotations[ProxyAnnotation] != "" {
+			c.proxyPod(&pod)
+		} else if c.PortForward {
+			if err := c.forwardPod(ctx, &pod); err != nil {
+				return nil, err
+			}
+		} else if pod.Spec.Subdomain != "" {
+			// The grader may not be able to resolve the pod's name.
+			transport.Dialer.Rewrite(addr, net.JoinHostPort(pod.Status.PodIP, PodPort))
 		}
 	}
 	return res, nil
@@ -81,27 +95,48 @@ func PodAddrsFromMappings(m map[string]PodMetaDetails) []string {
 	return res
 }
 
-func (c *Client) ListPodAddresses(ns string, labels map[string]string) ([]string, error) {
+func (c *Client) ListPodAddresses(ctx context.Context, ns string, labels map[string]string) ([]string, error) {
 	c.LazyInit()
-	m, err := c.ListAddressGroupIndexMappings(ns, labels)
+	m, err := c.ListAddressGroupIndexMappings(ctx, ns, labels)
 	if err != nil {
 		return nil, err
 	}
 	return PodAddrsFromMappings(m), nil
 }
 
-func (c *Client) CreatePods(ns, groupName, image string, batches, perBatch int) error {
+func (c *Client) CreatePods(ctx context.Context, ns, groupName, image string, batches, perBatch int) error {
 	c.LazyInit()
+	if p := c.pool(ns, groupName); p != nil && p.image == image {
+		return p.claim(ctx, batches, perBatch)
+	}
+	subdomain := ""
+	if c.StableAddresses {
+		var err error
+		if subdomain, err = c.applyNodeService(ctx, ns, groupName); err != nil {
+			return err
+		}
+	}
+	if c.DenyEgress {
+		for i := 1; i <= batches; i++ {
+			for j := 1; j <= perBatch; j++ {
+				if err := c.applyEgressPolicy(ctx, ns, PodLabels(groupName, i, NodeIndex(i, perBatch, j))); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	errChan := make(chan error, 1)
 	defer close(errChan)
 	for i := 1; i <= batches; i++ {
 		for j := 1; j <= perBatch; j++ {
 			go func(i, j int) {
-				err := c.CreatePod(
-					ns,
-					fmt.Sprintf("%s-b%d-p%d", groupName, i, j),
-					image, PodLabels(groupName, i, ((i-1)*batches)+j),
-				)
+				err := c.applyPod(ctx, ns, podTemplate{
+					name:      c.runName(fmt.Sprintf("%s-b%d-p%d", groupName, i, j)),
+					image:     image,
+					labels:    c.runLabels(PodLabels(groupName, i, NodeIndex(i, perBatch, j))),
+					subdomain: subdomain,
+					node:      true,
+				})
 				errChan <- err
 			}(i, j)
 		}
@@ -117,7 +152,38 @@ func (c *Client) CreatePods(ns, groupName, image string, batches, perBatch int)
 	return err
 }
 
-func (c *Client) CreatePod(ns, name, image string, labels map[string]string) error {
+func (c *Client) CreatePod(ctx context.Context, ns, name, image string, labels map[string]string) error {
+	return c.createPod(ctx, ns, name, image, nil, labels)
+}
+
+// createPod creates a pod like CreatePod, overriding the image's entrypoint with command unless it is empty.
+func (c *Client) createPod(
+	ctx context.Context, ns, name, image string, command []string, labels map[string]string,
+) error {
+	return c.applyPod(ctx, ns, podTemplate{
+		name:    c.runName(name),
+		image:   image,
+		command: command,
+		labels:  c.runLabels(labels),
+	})
+}
+
+// podTemplate is what applyPod needs to create a pod. The name and labels are used as they are.
+type podTemplate struct {
+	name  string
+	image string
+	// command overrides the image's entrypoint unless it is empty.
+	command []string
+	labels  map[string]string
+	// subdomain, if set, is the name of a headless service selecting the pod, and makes the pod's ADDRESS its stable
+	// DNS name instead of its IP.
+	subdomain string
+	// node marks pods that run student code, which get the client's resources and security options.
+	node bool
+}
+
+// applyPod creates a pod from t. No pod gets a service account token, privilege escalation or any capabilities.
+func (c *Client) applyPod(ctx context.Context, ns string, t podTemplate) error {
 	c.LazyInit()
 	kind := "Pod"
 	apiVersion := "v1"
@@ -127,25 +193,79 @@ func (c *Client) CreatePod(ns, name, image string, labels map[string]string) err
 	podIpFieldPath := "status.podIP"
 	addressEnvName := "ADDRESS"
 	addressEnvValue := fmt.Sprintf("$(POD_IP):%s", PodPort)
+	var listenAddressEnv []corev1.EnvVarApplyConfiguration
+	annotations := c.ownerAnnotations()
 	imagePullPolicy := v1.PullAlways
+	// So that the node's processes can be frozen (see FreezePods).
+	shareProcessNamespace := c.Freezable
+	automountToken := false
+	var hostname, subdomain *string
+	if t.subdomain != "" {
+		hostname, subdomain = &t.name, &t.subdomain
+		addressEnvValue = stableAddr(ns, t.name, t.subdomain)
+	}
+	if t.node && c.Proxied {
+		addr, err := c.startProxy(ns, t.name)
+		if err != nil {
+			return fmt.Errorf("failed to start the proxy for pod %s: %w", t.name, err)
+		}
+		addressEnvValue = addr
+		annotations[ProxyAnnotation] = addr
+		listenAddressEnv = append(listenAddressEnv, *corev1.EnvVar().
+			WithName("LISTEN_ADDRESS").
+			WithValue(fmt.Sprintf("$(POD_IP):%s", PodPort)))
+	}
+	securityContext := corev1.SecurityContext().
+		WithAllowPrivilegeEscalation(false).
+		WithCapabilities(corev1.Capabilities().WithDrop("ALL"))
+	var resources *corev1.ResourceRequirementsApplyConfiguration
+	var volumes []corev1.VolumeApplyConfiguration
+	var mounts []corev1.VolumeMountApplyConfiguration
+	if t.node {
+		if c.RunAsNonRoot {
+			securityContext.WithRunAsNonRoot(true)
+		}
+		if c.ReadOnlyRootFilesystem {
+			// Leave the nodes somewhere to write to.
+			securityContext.WithReadOnlyRootFilesystem(true)
+			volumes = append(volumes, *corev1.Volume().WithName("tmp").WithEmptyDir(corev1.EmptyDirVolumeSource()))
+			mounts = append(mounts, *corev1.VolumeMount().WithName("tmp").WithMountPath("/tmp"))
+		}
+		if len(c.Resources.Requests) > 0 || len(c.Resources.Limits) > 0 {
+			resources = corev1.ResourceRequirements()
+			if len(c.Resources.Requests) > 0 {
+				resources.WithRequests(c.Resources.Requests)
+			}
+			if len(c.Resources.Limits) > 0 {
+				resources.WithLimits(c.Resources.Limits)
+			}
+		}
+	}
 	req := &corev1.PodApplyConfiguration{
 		TypeMetaApplyConfiguration: applymetav1.TypeMetaApplyConfiguration{
 			Kind:       &kind,
 			APIVersion: &apiVersion,
 		},
 		ObjectMetaApplyConfiguration: &applymetav1.ObjectMetaApplyConfiguration{
-			Name:      &name,
-			Namespace: &ns,
-			Labels:    labels,
+			Name:        &t.name,
+			Namespace:   &ns,
+			Labels:      ownedLabels(t.labels),
+			Annotations: annotations,
 		},
 		Spec: &corev1.PodSpecApplyConfiguration{
-			RestartPolicy: (*v1.RestartPolicy)(&restartPolicy),
+			RestartPolicy:                (*v1.RestartPolicy)(&restartPolicy),
+			Hostname:                     hostname,
+			Subdomain:                    subdomain,
+			ShareProcessNamespace:        &shareProcessNamespace,
+			AutomountServiceAccountToken: &automountToken,
+			Volumes:                      volumes,
 			Containers: []corev1.ContainerApplyConfiguration{
 				{
 					Name:            &containerName,
-					Image:           &image,
+					Image:           &t.image,
+					Command:         t.command,
 					ImagePullPolicy: &imagePullPolicy,
-					Env: []corev1.EnvVarApplyConfiguration{
+					Env: append([]corev1.EnvVarApplyConfiguration{
 						{
 							Name: &podIpEnvName,
 							ValueFrom: &corev1.EnvVarSourceApplyConfiguration{
@@ -158,7 +278,10 @@ func (c *Client) CreatePod(ns, name, image string, labels map[string]string) err
 							Name:  &addressEnvName,
 							Value: &addressEnvValue,
 						},
-					},
+					}, listenAddressEnv...),
+					Resources:       resources,
+					SecurityContext: securityContext,
+					VolumeMounts:    mounts,
 				},
 			},
 		},
@@ -168,49 +291,193 @@ func (c *Client) CreatePod(ns, name, image string, labels map[string]string) err
 		FieldManager: kFieldManager,
 		Force:        true,
 	}
-	_, err := c.Clientset.CoreV1().Pods(ns).Apply(context.TODO(), req, applyOpts)
+	err := withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.Clientset.CoreV1().Pods(ns).Apply(ctx, req, applyOpts)
+		return err
+	})
+	if err == nil {
+		c.expectPod(ns, t.name, t.labels)
+	}
 	return err
 }
 
-func (c *Client) DeletePods(ns string, labels map[string]string) error {
+// DeletePods deletes the selected pods. The pods of a group with a pool (see StartPool) are no longer selected once it
+// returns, but are deleted in the background.
+func (c *Client) DeletePods(ctx context.Context, ns string, labels map[string]string) error {
 	c.LazyInit()
-	pods, err := c.Clientset.CoreV1().Pods(ns).List(
-		context.TODO(), metav1.ListOptions{LabelSelector: condenseLabelsMap(labels)})
-	if err != nil {
+	if p := c.pool(ns, labels[GroupKey]); p != nil {
+		if err := p.recycle(ctx, labels); err != nil {
+			return err
+		}
+	} else if err := c.deletePods(ctx, ns, labels, c.GracePeriodSeconds, false); err != nil {
 		return err
 	}
-	for _, pod := range pods.Items {
-		err := c.Clientset.CoreV1().Pods(ns).Delete(context.TODO(), pod.GetName(), metav1.DeleteOptions{})
-		if err != nil {
+	if c.StableAddresses {
+		if err := c.deleteNodeServices(ctx, ns, labels); err != nil {
 			return err
 		}
 	}
+	if c.DenyEgress {
+		return c.deleteEgressPolicies(ctx, ns, labels)
+	}
 	return nil
 }
 
-func (c *Client) AwaitDeletion(ns string, labels map[string]string) error {
-	deadline := time.NewTimer(20 * time.Second)
-	defer deadline.Stop()
+// KilledAnnotation marks the pods KillPods is killing, so that monitors don't report their nodes as crashed.
+const KilledAnnotation = "cse138-grader/killed"
 
-	for {
-		select {
-		case <-deadline.C:
-			return fmt.Errorf("deadline for pod deletion exceeded; ns=%s; labels=%v", ns, labels)
-		default: // Fall through
+// KillPods deletes the selected pods without giving them time to shut down gracefully, like nodes that crash. A zero
+// grace period deletes the pods from the API right away, while their containers can keep running on the node for a
+// little longer, so the nodes of pods that share their process namespace get SIGKILL first.
+func (c *Client) KillPods(ctx context.Context, ns string, labels map[string]string) error {
+	return c.killPods(ctx, ns, labels, false)
+}
+
+// killPods is KillPods, keeping the pods' proxies if keepProxies is set (see deletePods).
+func (c *Client) killPods(ctx context.Context, ns string, labels map[string]string, keepProxies bool) error {
+	c.LazyInit()
+	pods, err := c.ListPods(ctx, ns, labels)
+	if err != nil {
+		return err
+	}
+	var signaled []*v1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning ||
+			pod.Spec.ShareProcessNamespace == nil || !*pod.Spec.ShareProcessNamespace {
+			continue
+		}
+		if err := c.annotatePod(ctx, ns, pod.Name, KilledAnnotation, "true"); err != nil {
+			return fmt.Errorf("failed to mark pod %s as killed: %w", pod.Name, err)
 		}
+		signaled = append(signaled, pod)
+	}
+	// The pods are deleted either way; this only makes the nodes stop sooner.
+	_ = c.signalPodList(ctx, signaled, "KILL")
+	grace := int64(0)
+	return c.deletePods(ctx, ns, labels, &grace, keepProxies)
+}
 
-		pods, err := c.ListPods(ns, labels)
+// annotatePod sets an annotation of the named pod.
+func (c *Client) annotatePod(ctx context.Context, ns, name, key, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]string{key: value}},
+	})
+	if err != nil {
+		return err
+	}
+	return withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.CoreV1().Pods(ns).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// deletePods deletes the selected pods with the given grace period. Unless keepProxies is set, it also stops their
+// proxies (see Client.Proxied); pods that keep them get their addresses back when they are created again.
+func (c *Client) deletePods(
+	ctx context.Context, ns string, labels map[string]string, grace *int64, keepProxies bool,
+) error {
+	c.LazyInit()
+	if c.PortForward || c.StableAddresses || c.Proxied || c.anyShaped() {
+		pods, err := c.ListPods(ctx, ns, labels)
 		if err != nil {
 			return err
 		}
-		if len(pods.Items) == 0 {
+		c.stopForwards(pods.Items)
+		c.forgetShaped(pods.Items)
+		if c.Proxied && !keepProxies {
+			c.stopProxies(pods.Items)
+		}
+		for _, pod := range pods.Items {
+			if pod.Spec.Subdomain != "" {
+				transport.Dialer.Forget(podAddr(&pod))
+			}
+		}
+	}
+	err := withRetry(ctx, func(ctx context.Context) error {
+		return c.CoreV1().Pods(ns).DeleteCollection(
+			ctx,
+			metav1.DeleteOptions{GracePeriodSeconds: grace},
+			metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(labels))},
+		)
+	})
+	if err == nil {
+		c.forgetExpected(ns, c.runLabels(labels))
+	}
+	return err
+}
+
+// AwaitDeletion watches the selected pods until all of them are gone.
+func (c *Client) AwaitDeletion(ctx context.Context, ns string, labels map[string]string) error {
+	c.LazyInit()
+	// Allow for the grace period on top of the time the deletion itself takes.
+	timeout := 20 * time.Second
+	if c.GracePeriodSeconds != nil {
+		timeout += time.Duration(*c.GracePeriodSeconds) * time.Second
+	} else {
+		timeout += 30 * time.Second
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	opts := metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(labels))}
+	deadlineErr := &InfraError{fmt.Errorf("deadline for pod deletion exceeded; ns=%s; labels=%v", ns, labels)}
+
+	for {
+		var list *v1.PodList
+		err := withRetry(ctx, func(ctx context.Context) (err error) {
+			list, err = c.CoreV1().Pods(ns).List(ctx, opts)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return timeoutError(parent, deadlineErr)
+			}
+			return err
+		}
+		if len(list.Items) == 0 {
 			return nil
 		}
+		remaining := make(map[string]bool)
+		for _, pod := range list.Items {
+			remaining[pod.Name] = true
+		}
+
+		watchOpts := opts
+		watchOpts.ResourceVersion = list.ResourceVersion
+		w, err := c.CoreV1().Pods(ns).Watch(ctx, watchOpts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return timeoutError(parent, deadlineErr)
+			}
+			return apiError(err)
+		}
+		for ev := range w.ResultChan() {
+			pod, ok := ev.Object.(*v1.Pod)
+			if ev.Type == watch.Error || !ok {
+				// Most likely an expired resource version; list again.
+				break
+			}
+			switch ev.Type {
+			case watch.Deleted:
+				delete(remaining, pod.Name)
+			case watch.Added:
+				remaining[pod.Name] = true
+			}
+			if len(remaining) == 0 {
+				w.Stop()
+				return nil
+			}
+		}
+		w.Stop()
+		if ctx.Err() != nil {
+			return timeoutError(parent, deadlineErr)
+		}
 	}
 }
 
-func (c *Client) GetPodLogs(ns string, labels map[string]string) ([]string, error) {
-	pods, err := c.ListPods(ns, labels)
+func (c *Client) GetPodLogs(ctx context.Context, ns string, labels map[string]string) ([]string, error) {
+	pods, err := c.ListPods(ctx, ns, labels)
 	if err != nil {
 		return nil, err
 	}
@@ -218,9 +485,13 @@ func (c *Client) GetPodLogs(ns string, labels map[string]string) ([]string, erro
 	for _, pod := range pods.Items {
 		podLogOpts := v1.PodLogOptions{}
 		logs := c.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &podLogOpts)
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
-		podLogs, err := logs.Stream(ctx)
+		var podLogs io.ReadCloser
+		err := withRetry(ctx, func(ctx context.Context) (err error) {
+			podLogs, err = logs.Stream(ctx)
+			return err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("error in opening log stream: %w", err)
 		}
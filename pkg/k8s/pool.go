@@ -0,0 +1,266 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
+)
+
+// PoolKey labels the pods of a PodPool with the group they are kept for, as long as they are not handed out.
+const PoolKey = "pool"
+
+// RetiredKey labels the pods a PodPool took back and is deleting.
+const RetiredKey = "retired"
+
+// PodPool keeps spare node pods for a group running, so that tests get started nodes instead of waiting for new pods
+// to be scheduled, pull the image and boot. Once started (see StartPool), CreatePods hands out spares for the group
+// and image and starts replacements right away, while the test runs; DeletePods takes the test's pods back and deletes
+// them in the background. Spares are fresh pods that never served a test.
+type PodPool struct {
+	c         *Client
+	ns        string
+	groupName string
+	image     string
+	size      int
+	subdomain string
+	// ctx bounds the pool's background work; Close cancels it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	spares []string
+	// pending counts the spares being created.
+	pending int
+	next    int
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// StartPool starts creating size spare pods for the group in the background, and makes CreatePods and DeletePods use
+// them. Close stops it.
+func (c *Client) StartPool(ctx context.Context, ns, groupName, image string, size int) (*PodPool, error) {
+	c.LazyInit()
+	p := &PodPool{c: c, ns: ns, groupName: groupName, image: image, size: size}
+	// The pool outlives ctx.
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if c.StableAddresses {
+		var err error
+		if p.subdomain, err = c.applyNodeService(ctx, ns, groupName); err != nil {
+			p.cancel()
+			return nil, err
+		}
+	}
+	if c.DenyEgress {
+		// Spares run the group's image too, so they must not reach anything before they are handed out either.
+		if err := c.applyPoolEgressPolicy(ctx, ns, groupName); err != nil {
+			p.cancel()
+			return nil, err
+		}
+	}
+	c.poolsMu.Lock()
+	defer c.poolsMu.Unlock()
+	key := poolKey(ns, groupName)
+	if c.pools == nil {
+		c.pools = make(map[string]*PodPool)
+	}
+	if c.pools[key] != nil {
+		p.cancel()
+		return nil, fmt.Errorf("there already is a pod pool for group %s in namespace %s", groupName, ns)
+	}
+	c.pools[key] = p
+	p.fill()
+	return p, nil
+}
+
+func poolKey(ns, groupName string) string {
+	return ns + "/" + groupName
+}
+
+// pool returns the pool for the group, or nil if there is none.
+func (c *Client) pool(ns, groupName string) *PodPool {
+	c.poolsMu.Lock()
+	defer c.poolsMu.Unlock()
+	return c.pools[poolKey(ns, groupName)]
+}
+
+// fill starts creating spares until there are size of them.
+func (p *PodPool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ; !p.closed && len(p.spares)+p.pending < p.size; p.pending++ {
+		name := p.newName()
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			// A spare that could not be created is just missing; claim makes up for it.
+			err := p.createSpare(p.ctx, name)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.pending--
+			if err == nil {
+				p.spares = append(p.spares, name)
+			}
+		}()
+	}
+}
+
+// newName names the next pod of the pool; p.mu must be held.
+func (p *PodPool) newName() string {
+	p.next++
+	return p.c.runName(fmt.Sprintf("%s-s%d", p.groupName, p.next))
+}
+
+func (p *PodPool) createSpare(ctx context.Context, name string) error {
+	return p.c.applyPod(ctx, p.ns, podTemplate{
+		name:      name,
+		image:     p.image,
+		labels:    p.c.runLabels(map[string]string{PoolKey: p.groupName}),
+		subdomain: p.subdomain,
+		node:      true,
+	})
+}
+
+// claim hands out spares as the nodes CreatePods would create, creating any that are missing on the spot, and starts
+// replacing them.
+func (p *PodPool) claim(ctx context.Context, batches, perBatch int) error {
+	p.mu.Lock()
+	n := batches * perBatch
+	names := p.spares
+	if len(names) > n {
+		names = names[:n]
+	}
+	p.spares = append([]string(nil), p.spares[len(names):]...)
+	var missing []string
+	for len(names)+len(missing) < n {
+		missing = append(missing, p.newName())
+	}
+	p.mu.Unlock()
+	defer p.fill()
+
+	for _, name := range missing {
+		if err := p.createSpare(ctx, name); err != nil {
+			return err
+		}
+	}
+	names = append(names, missing...)
+	if p.c.StableAddresses {
+		// DeletePods deletes the group's service along with its nodes.
+		if _, err := p.c.applyNodeService(ctx, p.ns, p.groupName); err != nil {
+			return err
+		}
+	}
+	k := 0
+	for i := 1; i <= batches; i++ {
+		for j := 1; j <= perBatch; j++ {
+			labels := PodLabels(p.groupName, i, NodeIndex(i, perBatch, j))
+			if p.c.DenyEgress {
+				// Before the pool label goes, so that a policy selects the pod at all times.
+				if err := p.c.applyEgressPolicy(ctx, p.ns, labels); err != nil {
+					return err
+				}
+			}
+			// Removes the pool label, so the pod is the group's now.
+			patch := map[string]interface{}{PoolKey: nil}
+			for key, v := range labels {
+				patch[key] = v
+			}
+			if err := p.c.patchLabels(ctx, p.ns, names[k], patch); err != nil {
+				return fmt.Errorf("failed to hand out pod %s: %w", names[k], err)
+			}
+			k++
+		}
+	}
+	return nil
+}
+
+// recycle takes the selected pods back from the group and kills them in the background, without grace like KillPods,
+// so that they can't talk to the nodes of the next test while they shut down.
+func (p *PodPool) recycle(ctx context.Context, labels map[string]string) error {
+	pods, err := p.c.ListPods(ctx, p.ns, labels)
+	if err != nil {
+		return err
+	}
+	p.c.stopForwards(pods.Items)
+	p.c.forgetShaped(pods.Items)
+	if p.c.Proxied {
+		p.c.stopProxies(pods.Items)
+	}
+	patch := map[string]interface{}{PoolKey: p.groupName, RetiredKey: "true"}
+	for key := range PodLabels("", 0, 0) {
+		patch[key] = nil
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.Subdomain != "" {
+			transport.Dialer.Forget(podAddr(pod))
+		}
+		if err := p.c.patchLabels(ctx, p.ns, pod.Name, patch); err != nil {
+			return fmt.Errorf("failed to take back pod %s: %w", pod.Name, err)
+		}
+		p.c.forgetExpectedPod(p.ns, pod.Name)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			if pod.DeletionTimestamp == nil && pod.Status.Phase == v1.PodRunning &&
+				pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace {
+				// The pod is deleted either way; this only makes the node stop sooner.
+				_ = p.c.signalPod(p.ctx, pod, "KILL")
+			}
+			grace := int64(0)
+			_ = deleteWithRetry(p.ctx, func(ctx context.Context) error {
+				opts := metav1.DeleteOptions{GracePeriodSeconds: &grace}
+				return p.c.CoreV1().Pods(p.ns).Delete(ctx, pod.Name, opts)
+			})
+		}()
+	}
+	return nil
+}
+
+// Close stops handing out spares, and deletes them along with the pods being recycled.
+func (p *PodPool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cancel()
+	p.wg.Wait()
+	p.c.poolsMu.Lock()
+	delete(p.c.pools, poolKey(p.ns, p.groupName))
+	p.c.poolsMu.Unlock()
+
+	labels := map[string]string{PoolKey: p.groupName}
+	if err := p.c.deletePods(ctx, p.ns, labels, p.c.GracePeriodSeconds, false); err != nil {
+		return err
+	}
+	if err := p.c.AwaitDeletion(ctx, p.ns, labels); err != nil {
+		return err
+	}
+	if p.c.DenyEgress {
+		return p.c.deleteEgressPolicies(ctx, p.ns, labels)
+	}
+	return nil
+}
+
+// patchLabels sets the given labels of the pod, and removes those set to nil.
+func (c *Client) patchLabels(ctx context.Context, ns, name string, labels map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+	if err != nil {
+		return err
+	}
+	err = withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.CoreV1().Pods(ns).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+	if err == nil {
+		c.relabelExpected(ns, name, labels)
+	}
+	return err
+}
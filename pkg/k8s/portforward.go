@@ -0,0 +1,153 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
+)
+
+// forward is a local port that is forwarded to PodPort of a pod.
+type forward struct {
+	uid  types.UID
+	addr string
+	stop chan struct{}
+}
+
+func podKey(ns, name string) string {
+	return ns + "/" + name
+}
+
+// forwardPod starts forwarding a local port to pod, unless that is already done, and makes transport.Dialer connect
+// through it whenever the grader dials the pod's address. ctx only bounds starting the forward; it runs until stopped,
+// and is re-created whenever the connection to the pod is lost.
+func (c *Client) forwardPod(ctx context.Context, pod *v1.Pod) error {
+	c.LazyInit()
+	key := podKey(pod.Namespace, pod.Name)
+	addr := podAddr(pod)
+
+	c.forwardsMu.Lock()
+	defer c.forwardsMu.Unlock()
+	if f, ok := c.forwards[key]; ok {
+		if f.uid == pod.UID && f.addr == addr {
+			return nil
+		}
+		// Same name, but a new pod.
+		c.stopForward(key)
+	}
+
+	stop := make(chan struct{})
+	local, lost, err := c.dialForward(ctx, pod, stop)
+	if err != nil {
+		close(stop)
+		return err
+	}
+	if c.forwards == nil {
+		c.forwards = make(map[string]*forward)
+	}
+	f := &forward{uid: pod.UID, addr: addr, stop: stop}
+	c.forwards[key] = f
+	transport.Dialer.Rewrite(addr, local)
+	go c.superviseForward(key, f, pod.DeepCopy(), lost)
+	return nil
+}
+
+// dialForward forwards a local port to pod until stop is closed or the connection to the pod is lost, and returns the
+// local address. The returned channel gets the reason the forward ended.
+func (c *Client) dialForward(ctx context.Context, pod *v1.Pod, stop chan struct{}) (string, <-chan error, error) {
+	rt, upgrader, err := spdy.RoundTripperFor(c.config)
+	if err != nil {
+		return "", nil, err
+	}
+	url := c.CoreV1().RESTClient().Post().
+		Resource("pods").Namespace(pod.Namespace).Name(pod.Name).SubResource("portforward").URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: rt}, http.MethodPost, url)
+
+	ready := make(chan struct{})
+	fw, err := portforward.NewOnAddresses(
+		dialer, []string{"127.0.0.1"}, []string{"0:" + PodPort}, stop, ready, io.Discard, io.Discard)
+	if err != nil {
+		return "", nil, err
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- fw.ForwardPorts()
+	}()
+	select {
+	case <-ready:
+	case err := <-errChan:
+		if err == nil {
+			err = errors.New("stopped")
+		}
+		return "", nil, fmt.Errorf("failed to forward a port to pod %s: %w", pod.Name, err)
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+	ports, err := fw.GetPorts()
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("127.0.0.1:%d", ports[0].Local), errChan, nil
+}
+
+// superviseForward re-creates f, the forward to pod, whenever its connection to the pod is lost (for instance when the
+// API server or the kubelet closes the stream) and points transport.Dialer at the new local port, until f is stopped.
+func (c *Client) superviseForward(key string, f *forward, pod *v1.Pod, lost <-chan error) {
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-lost:
+		}
+		wait := retryBackoff
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-time.After(wait):
+			}
+			local, l, err := c.dialForward(context.Background(), pod, f.stop)
+			if err == nil {
+				c.forwardsMu.Lock()
+				if c.forwards[key] == f {
+					transport.Dialer.Rewrite(f.addr, local)
+				}
+				c.forwardsMu.Unlock()
+				lost = l
+				break
+			}
+			if wait *= 2; wait > retryMaxWait {
+				wait = retryMaxWait
+			}
+		}
+	}
+}
+
+// stopForward stops forwarding to the pod with the given key; c.forwardsMu must be held.
+func (c *Client) stopForward(key string) {
+	f, ok := c.forwards[key]
+	if !ok {
+		return
+	}
+	close(f.stop)
+	transport.Dialer.Forget(f.addr)
+	delete(c.forwards, key)
+}
+
+// stopForwards stops forwarding to the given pods.
+func (c *Client) stopForwards(pods []v1.Pod) {
+	c.forwardsMu.Lock()
+	defer c.forwardsMu.Unlock()
+	for _, pod := range pods {
+		c.stopForward(podKey(pod.Namespace, pod.Name))
+	}
+}
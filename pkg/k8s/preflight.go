@@ -0,0 +1,53 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CanI asks the API server whether the grader may do verb on resource (and subresource, if not empty) in ns.
+func (c *Client) CanI(ctx context.Context, ns, group, resource, subresource, verb string) (bool, error) {
+	c.LazyInit()
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   ns,
+				Verb:        verb,
+				Group:       group,
+				Resource:    resource,
+				Subresource: subresource,
+			},
+		},
+	}
+	// A review is not stored anywhere, so asking again is safe.
+	var res *authorizationv1.SelfSubjectAccessReview
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		res, err = c.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.Status.Allowed, nil
+}
+
+// CreateProbePods creates n pods in a single batch that stand in for a group's nodes: they serve http on PodPort and
+// are labeled like the nodes would be.
+func (c *Client) CreateProbePods(ctx context.Context, ns, groupName string, n int) error {
+	c.LazyInit()
+	for j := 1; j <= n; j++ {
+		err := c.createPod(
+			ctx,
+			ns,
+			fmt.Sprintf("%s-b1-p%d", groupName, j),
+			ProbeImage, []string{"httpd", "-f", "-p", PodPort, "-h", "/tmp"}, PodLabels(groupName, 1, j),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
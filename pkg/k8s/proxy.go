@@ -0,0 +1,159 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/faultproxy"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
+)
+
+// ProxyAnnotation holds the address of the proxy in front of a node (see Client.Proxied), which is the node's address.
+const ProxyAnnotation = "cse138-grader/proxy"
+
+// ProxyNode is a node behind a fault-injecting proxy: Key names its proxy in the injector, and Ip and Labels are the
+// ones the node would have as a pod.
+type ProxyNode struct {
+	Key    string
+	Ip     string
+	Labels map[string]string
+}
+
+// IsolateProxied makes inj hold the connections towards the nodes matching labels that come from nodes which neither
+// match nor have one of extraIps, the way CreateNetPolicy isolates pods. A single node that nobody may reach is cut off
+// from connections that can't be attributed to a node too.
+func IsolateProxied(inj *faultproxy.Injector, nodes []ProxyNode, labels map[string]string, extraIps []string) {
+	allowed := make(map[string]bool)
+	for _, ip := range extraIps {
+		allowed[ip] = true
+	}
+	var targets, blocked []ProxyNode
+	for _, n := range nodes {
+		if MatchLabels(labels, n.Labels) {
+			targets = append(targets, n)
+		} else if !allowed[n.Ip] {
+			blocked = append(blocked, n)
+		}
+	}
+	if len(targets) == 1 && len(blocked) == len(nodes)-1 {
+		inj.Isolate(targets[0].Key)
+		return
+	}
+	for _, to := range targets {
+		for _, from := range blocked {
+			inj.BlockOneWay(from.Key, to.Key)
+		}
+	}
+}
+
+// BlockProxied makes inj hold the connections that the nodes matching labels open to the nodes with blockedIps, the
+// way CreateEgressNetPolicy blocks them.
+func BlockProxied(inj *faultproxy.Injector, nodes []ProxyNode, labels map[string]string, blockedIps []string) {
+	blocked := make(map[string]bool)
+	for _, ip := range blockedIps {
+		blocked[ip] = true
+	}
+	for _, from := range nodes {
+		if !MatchLabels(labels, from.Labels) {
+			continue
+		}
+		for _, to := range nodes {
+			if blocked[to.Ip] && to.Key != from.Key {
+				inj.BlockOneWay(from.Key, to.Key)
+			}
+		}
+	}
+}
+
+// HealProxied lifts the faults on connections towards the nodes matching labels, the way DeleteNetPolicies deletes
+// their policies.
+func HealProxied(inj *faultproxy.Injector, nodes []ProxyNode, labels map[string]string) {
+	var keys []string
+	for _, n := range nodes {
+		if MatchLabels(labels, n.Labels) {
+			keys = append(keys, n.Key)
+		}
+	}
+	if len(keys) > 0 {
+		inj.Heal(keys...)
+	}
+}
+
+// ShapeProxied replaces the link profiles of nodes with links, which inj applies to the connections each node opens
+// to another. Unlike netem, loss applies to whole connections rather than packets: a lost connection never gets
+// through.
+func ShapeProxied(inj *faultproxy.Injector, nodes []ProxyNode, links map[NodeLink]LinkProfile) error {
+	byIndex := make(map[int]ProxyNode)
+	for _, n := range nodes {
+		byIndex[IntFromIntLabel(n.Labels[IndexKey])] = n
+	}
+	for l := range links {
+		if _, ok := byIndex[l.From.Index]; !ok {
+			return fmt.Errorf("no node for link %d -> %d", l.From.Index, l.To.Index)
+		}
+		if _, ok := byIndex[l.To.Index]; !ok {
+			return fmt.Errorf("no node for link %d -> %d", l.From.Index, l.To.Index)
+		}
+	}
+	for _, n := range nodes {
+		inj.Unshape(n.Key)
+	}
+	for l, p := range links {
+		inj.Shape(
+			faultproxy.Link{From: byIndex[l.From.Index].Key, To: byIndex[l.To.Index].Key},
+			faultproxy.Fault{Delay: p.Delay, Jitter: p.Jitter, Loss: p.Loss / 100},
+		)
+	}
+	return nil
+}
+
+// startProxy starts the proxy in front of the named pod, or takes it back from the pod it was in front of before, and
+// returns its address. Connections to it are closed until proxyPod points it at the pod.
+func (c *Client) startProxy(ns, name string) (string, error) {
+	if c.ProxyHost == "" {
+		return "", fmt.Errorf("proxied nodes need the grader's IP as the nodes see it (Client.ProxyHost)")
+	}
+	c.proxyOnce.Do(func() { c.injector.Host = c.ProxyHost })
+	return c.injector.Start(podKey(ns, name), "")
+}
+
+// proxyPod points the proxy in front of pod at the pod, and attributes connections from the pod's IP to it. The grader
+// itself dials the pod directly.
+func (c *Client) proxyPod(pod *v1.Pod) {
+	key := podKey(pod.Namespace, pod.Name)
+	upstream := net.JoinHostPort(pod.Status.PodIP, PodPort)
+	_, _ = c.injector.Start(key, upstream)
+	c.injector.SetSource(pod.Status.PodIP, key)
+	transport.Dialer.Rewrite(podAddr(pod), upstream)
+}
+
+// stopProxies stops the proxies in front of the given pods.
+func (c *Client) stopProxies(pods []v1.Pod) {
+	for _, pod := range pods {
+		key := podKey(pod.Namespace, pod.Name)
+		c.injector.Stop(key)
+		c.injector.Heal(key)
+		c.injector.Unshape(key)
+		c.injector.ForgetSource(key)
+		transport.Dialer.Forget(podAddr(&pod))
+	}
+}
+
+// proxyNodes returns the selected proxied nodes.
+func (c *Client) proxyNodes(ctx context.Context, ns string, labels map[string]string) ([]ProxyNode, error) {
+	pods, err := c.ListPods(ctx, ns, labels)
+	if err != nil {
+		return nil, err
+	}
+	var res []ProxyNode
+	for _, pod := range pods.Items {
+		if pod.Annotations[ProxyAnnotation] == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		res = append(res, ProxyNode{Key: podKey(ns, pod.Name), Ip: pod.Status.PodIP, Labels: pod.Labels})
+	}
+	return res, nil
+}
@@ -0,0 +1,119 @@
+package k8s
+
+import (
+	"bytes"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// GraderRules are the permissions the grader needs in the namespace it grades in.
+var GraderRules = []rbacv1.PolicyRule{
+	{
+		APIGroups: []string{""},
+		Resources: []string{"pods"},
+		Verbs:     []string{"create", "get", "list", "watch", "patch", "delete", "deletecollection"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"pods/log"},
+		Verbs:     []string{"get"},
+	},
+	{
+		// For reaching the pods through port-forwarding (PORT_FORWARD).
+		APIGroups: []string{""},
+		Resources: []string{"pods/portforward"},
+		Verbs:     []string{"create"},
+	},
+	{
+		// For checking partitions from inside the pods.
+		APIGroups: []string{""},
+		Resources: []string{"pods/ephemeralcontainers"},
+		Verbs:     []string{"update"},
+	},
+	{
+		// For reporting problems with the pods, like failed image pulls.
+		APIGroups: []string{""},
+		Resources: []string{"events"},
+		Verbs:     []string{"list", "watch"},
+	},
+	{
+		// For the headless services that give nodes stable addresses.
+		APIGroups: []string{""},
+		Resources: []string{"services"},
+		Verbs:     []string{"create", "get", "list", "patch", "delete"},
+	},
+	{
+		APIGroups: []string{"networking.k8s.io"},
+		Resources: []string{"networkpolicies"},
+		Verbs:     []string{"create", "get", "list", "patch", "delete", "deletecollection"},
+	},
+}
+
+// GraderClusterRules are the permissions the grader needs to create a namespace per run (NAMESPACE_PER_RUN), grade in
+// it, and reap what runs left behind in any namespace.
+var GraderClusterRules = append([]rbacv1.PolicyRule{
+	{
+		APIGroups: []string{""},
+		Resources: []string{"namespaces"},
+		Verbs:     []string{"create", "get", "list", "patch", "delete"},
+	},
+}, GraderRules...)
+
+// clusterRbacComment precedes the cluster-wide part of the RBAC manifest.
+const clusterRbacComment = "# The ClusterRole and ClusterRoleBinding are only needed for NAMESPACE_PER_RUN and reap.\n"
+
+// RbacYaml returns the ServiceAccount, Role and RoleBinding (all called name) that let a grader running in the cluster
+// grade in namespace ns, followed by the ClusterRole and ClusterRoleBinding (also called name) that grant it
+// GraderClusterRules, as a multi-document YAML manifest.
+func RbacYaml(ns, name string) ([]byte, error) {
+	meta := metav1.ObjectMeta{Name: name, Namespace: ns}
+	clusterMeta := metav1.ObjectMeta{Name: name}
+	subjects := []rbacv1.Subject{
+		{Kind: "ServiceAccount", Name: name, Namespace: ns},
+	}
+	objects := []interface{}{
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: meta,
+		},
+		&rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+			ObjectMeta: meta,
+			Rules:      GraderRules,
+		},
+		&rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: meta,
+			Subjects:   subjects,
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "Role", Name: name},
+		},
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+			ObjectMeta: clusterMeta,
+			Rules:      GraderClusterRules,
+		},
+		&rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+			ObjectMeta: clusterMeta,
+			Subjects:   subjects,
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: name},
+		},
+	}
+
+	var buf bytes.Buffer
+	for _, o := range objects {
+		out, err := yaml.Marshal(o)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		if _, ok := o.(*rbacv1.ClusterRole); ok {
+			buf.WriteString(clusterRbacComment)
+		}
+		buf.Write(out)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,149 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
+)
+
+// DefaultReadyTimeout is how long pods get to start and answer on PodPort when Client.ReadyTimeout is not set.
+const DefaultReadyTimeout = 60 * time.Second
+
+func (c *Client) readyTimeout() time.Duration {
+	if c.ReadyTimeout == 0 {
+		return DefaultReadyTimeout
+	}
+	return c.ReadyTimeout
+}
+
+// AwaitReady waits until all selected pods are running and every one of them answers http requests on PodPort.
+func (c *Client) AwaitReady(ctx context.Context, ns string, labels map[string]string) error {
+	c.LazyInit()
+	start := time.Now()
+	m, err := c.ListAddressGroupIndexMappings(ctx, ns, labels)
+	if err != nil {
+		return err
+	}
+	return transport.AwaitHttp(ctx, PodAddrsFromMappings(m), c.readyTimeout()-time.Since(start))
+}
+
+// awaitRunning watches the selected pods until at least want of them (and at least one) are running and none are still
+// starting, and returns the running ones. Pods that are being deleted are left out. It fails early if a pod stops,
+// since pods are never restarted.
+func (c *Client) awaitRunning(
+	ctx context.Context, ns string, labels map[string]string, want int, timeout time.Duration,
+) ([]v1.Pod, error) {
+	c.LazyInit()
+	parent := ctx
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	opts := metav1.ListOptions{LabelSelector: condenseLabelsMap(c.runLabels(labels))}
+	deadlineErr := fmt.Errorf("deadline for pods ready exceeded; ns=%s; labels=%v", ns, labels)
+
+	for {
+		var list *v1.PodList
+		err := withRetry(ctx, func(ctx context.Context) (err error) {
+			list, err = c.CoreV1().Pods(ns).List(ctx, opts)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, timeoutError(parent, deadlineErr)
+			}
+			return nil, err
+		}
+		pods := make(map[string]v1.Pod)
+		for _, pod := range list.Items {
+			pods[pod.Name] = pod
+		}
+		if done, err := allRunning(pods, want); done || err != nil {
+			return running(pods), err
+		}
+
+		watchOpts := opts
+		watchOpts.ResourceVersion = list.ResourceVersion
+		w, err := c.CoreV1().Pods(ns).Watch(ctx, watchOpts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, timeoutError(parent, deadlineErr)
+			}
+			return nil, apiError(err)
+		}
+		for ev := range w.ResultChan() {
+			pod, ok := ev.Object.(*v1.Pod)
+			if ev.Type == watch.Error || !ok {
+				// Most likely an expired resource version; list again.
+				break
+			}
+			if ev.Type == watch.Deleted {
+				delete(pods, pod.Name)
+			} else {
+				pods[pod.Name] = *pod
+			}
+			if done, err := allRunning(pods, want); done || err != nil {
+				w.Stop()
+				return running(pods), err
+			}
+		}
+		w.Stop()
+		if ctx.Err() != nil {
+			return nil, timeoutError(parent, deadlineErr)
+		}
+	}
+}
+
+// timeoutError is the error of a wait with a timeout, derived from parent, that was cut short: parent's own error if
+// parent is done, since then the caller gave up rather than the wait running out of time, or else err.
+func timeoutError(parent context.Context, err error) error {
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+	return err
+}
+
+// allRunning tells whether at least want of the pods (and at least one) are running and none are still starting,
+// leaving out pods that are being deleted. A pod that stopped is an error.
+func allRunning(pods map[string]v1.Pod, want int) (bool, error) {
+	n := 0
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			n++
+		case v1.PodFailed, v1.PodSucceeded:
+			return false, errors.New(describeStopped(&pod))
+		default:
+			return false, nil
+		}
+	}
+	return n > 0 && n >= want, nil
+}
+
+// running returns the pods that are running and not being deleted.
+func running(pods map[string]v1.Pod) []v1.Pod {
+	res := make([]v1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil {
+			res = append(res, pod)
+		}
+	}
+	return res
+}
+
+func describeStopped(pod *v1.Pod) string {
+	for _, s := range pod.Status.ContainerStatuses {
+		if t := s.State.Terminated; t != nil {
+			return fmt.Sprintf("pod %s stopped before it was ready: exit code %d (%s)", pod.Name, t.ExitCode, t.Reason)
+		}
+	}
+	return fmt.Sprintf("pod %s stopped before it was ready: %s", pod.Name, pod.Status.Phase)
+}
@@ -0,0 +1,70 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAllRunning(t *testing.T) {
+	pod := func(phase v1.PodPhase, deleting bool) v1.Pod {
+		p := v1.Pod{Status: v1.PodStatus{Phase: phase}}
+		if deleting {
+			now := metav1.Now()
+			p.DeletionTimestamp = &now
+		}
+		return p
+	}
+	tests := []struct {
+		name    string
+		pods    []v1.Pod
+		want    int
+		done    bool
+		wantErr bool
+	}{
+		{name: "no pods", want: 0, done: false},
+		{name: "fewer than expected", pods: []v1.Pod{pod(v1.PodRunning, false)}, want: 2, done: false},
+		{name: "all expected", pods: []v1.Pod{pod(v1.PodRunning, false), pod(v1.PodRunning, false)}, want: 2, done: true},
+		{name: "one starting", pods: []v1.Pod{pod(v1.PodRunning, false), pod(v1.PodPending, false)}, want: 1, done: false},
+		{name: "deleted ones left out", pods: []v1.Pod{pod(v1.PodRunning, true), pod(v1.PodRunning, false)}, want: 2},
+		{name: "stopped", pods: []v1.Pod{pod(v1.PodFailed, false)}, want: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pods := make(map[string]v1.Pod)
+			for i, p := range tt.pods {
+				p.Name = string(rune('a' + i))
+				pods[p.Name] = p
+			}
+			done, err := allRunning(pods, tt.want)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("allRunning() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if done != tt.done {
+				t.Errorf("allRunning() = %t, want %t", done, tt.done)
+			}
+		})
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	deadlineErr := errors.New("deadline exceeded")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name   string
+		parent context.Context
+		want   error
+	}{
+		{name: "timed out", parent: context.Background(), want: deadlineErr},
+		{name: "parent cancelled", parent: cancelled, want: context.Canceled},
+	}
+	for _, tt := range tests {
+		if got := timeoutError(tt.parent, deadlineErr); got != tt.want {
+			t.Errorf("timeoutError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
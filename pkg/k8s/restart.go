@@ -0,0 +1,114 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// RestartPods kills the selected pods and creates them again with the same names, labels, image and command, like
+// nodes that crashed and came back. With StableAddresses the nodes keep their addresses too; otherwise they get new
+// IPs, and the views they were in no longer name them, unless they are proxied. It returns once the new pods run.
+func (c *Client) RestartPods(ctx context.Context, ns string, labels map[string]string) error {
+	c.LazyInit()
+	pods, err := c.ListPods(ctx, ns, labels)
+	if err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no pods to restart; ns=%s; labels=%v", ns, labels)
+	}
+	if err := c.killPods(ctx, ns, labels, true); err != nil {
+		return err
+	}
+	if err := c.AwaitDeletion(ctx, ns, labels); err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		container := pod.Spec.Containers[0]
+		err := c.applyPod(ctx, ns, podTemplate{
+			name:      pod.Name,
+			image:     container.Image,
+			command:   container.Command,
+			labels:    pod.Labels,
+			subdomain: pod.Spec.Subdomain,
+			node:      true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to recreate pod %s: %w", pod.Name, err)
+		}
+	}
+	// This also points the grader's connections, and port forwards, at the new pods.
+	_, err = c.ListAddressGroupIndexMappings(ctx, ns, labels)
+	return err
+}
+
+// podAddr is the address the pod's node is known by: its proxy's address if it is proxied, its stable DNS name if it
+// has one, or else its IP.
+func podAddr(pod *v1.Pod) string {
+	if addr := pod.Annotations[ProxyAnnotation]; addr != "" {
+		return addr
+	}
+	if pod.Spec.Subdomain != "" {
+		return stableAddr(pod.Namespace, pod.Name, pod.Spec.Subdomain)
+	}
+	return fmt.Sprintf("%s:%s", pod.Status.PodIP, PodPort)
+}
+
+// stableAddr is the address of a pod through the headless service named subdomain. The name leaves out the cluster
+// domain, which the pods' DNS search path fills in.
+func stableAddr(ns, name, subdomain string) string {
+	return fmt.Sprintf("%s.%s.%s.svc:%s", name, subdomain, ns, PodPort)
+}
+
+// applyNodeService creates the headless service that gives the group's pods their DNS names, and returns its name.
+func (c *Client) applyNodeService(ctx context.Context, ns, groupName string) (string, error) {
+	// Service names have to start with a letter.
+	name := c.runName("kvs-" + groupName)
+	labels := c.runLabels(GroupLabels(groupName))
+	req := corev1.Service(name, ns).
+		WithLabels(ownedLabels(labels)).
+		WithAnnotations(c.ownerAnnotations()).
+		WithSpec(corev1.ServiceSpec().
+			WithClusterIP(v1.ClusterIPNone).
+			WithSelector(labels).
+			// The names should resolve as soon as the pods have IPs, not when they become ready.
+			WithPublishNotReadyAddresses(true).
+			WithPorts(corev1.ServicePort().WithName("http").WithPort(int32(IntFromIntLabel(PodPort)))))
+	applyOpts := metav1.ApplyOptions{
+		FieldManager: kFieldManager,
+		Force:        true,
+	}
+	err := withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.CoreV1().Services(ns).Apply(ctx, req, applyOpts)
+		return err
+	})
+	return name, err
+}
+
+// deleteNodeServices deletes the headless services whose labels match; those are only labeled with the group, so only
+// deleting a whole group deletes its service.
+func (c *Client) deleteNodeServices(ctx context.Context, ns string, labels map[string]string) error {
+	var list *v1.ServiceList
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		list, err = c.CoreV1().Services(ns).List(ctx, metav1.ListOptions{
+			LabelSelector: condenseLabelsMap(c.runLabels(labels)),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, svc := range list.Items {
+		err := deleteWithRetry(ctx, func(ctx context.Context) error {
+			return c.CoreV1().Services(ns).Delete(ctx, svc.Name, metav1.DeleteOptions{})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// retryBackoff is how long withRetry waits after the first failed attempt; every retry waits twice as long as the one
+// before, up to retryMaxWait, for at most retryAttempts attempts in all.
+const (
+	retryBackoff  = 200 * time.Millisecond
+	retryMaxWait  = 5 * time.Second
+	retryAttempts = 6
+)
+
+// withRetry runs op until it succeeds, fails for good, or ctx is done. Only ops that can safely run more than once
+// should be retried: gets, lists, applies and deletes. Since ops are calls to the Kubernetes API, the error they fail
+// for good with is an InfraError; ctx being done is not.
+func withRetry(ctx context.Context, op func(ctx context.Context) error) error {
+	wait := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt == retryAttempts || !isTransient(err) {
+			return apiError(err)
+		}
+		// Jitter keeps clients that failed together from retrying together.
+		timer := time.NewTimer(wait/2 + time.Duration(rand.Int63n(int64(wait))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if wait *= 2; wait > retryMaxWait {
+			wait = retryMaxWait
+		}
+	}
+}
+
+// deleteWithRetry is withRetry for deleting a single object. An object that is already gone counts as deleted, since
+// that is what a retry sees after an attempt that went through but whose response was lost.
+func deleteWithRetry(ctx context.Context, del func(ctx context.Context) error) error {
+	return withRetry(ctx, func(ctx context.Context) error {
+		if err := del(ctx); !apierrors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// apiError makes err, which the Kubernetes API failed with, an InfraError, unless it already is one.
+func apiError(err error) error {
+	if err == nil || IsInfraError(err) {
+		return err
+	}
+	return &InfraError{Err: err}
+}
+
+// isTransient reports whether err may go away on its own: conflicts, throttling, timeouts (including etcd's, which
+// come as internal errors), an API server that is not available, or a connection that was refused or reset. Other
+// network errors, such as a host that does not resolve or a bad certificate, are not retried.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch {
+	case apierrors.IsConflict(err), apierrors.IsTooManyRequests(err), apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err), apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err):
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,77 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestIsTransient(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	dial := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"conflict", apierrors.NewConflict(pods, "p", errors.New("changed")), true},
+		{"throttled", apierrors.NewTooManyRequests("slow down", 1), true},
+		{"not found", apierrors.NewNotFound(pods, "p"), false},
+		{"forbidden", apierrors.NewForbidden(pods, "p", errors.New("no")), false},
+		{"refused", dial(syscall.ECONNREFUSED), true},
+		{"reset", fmt.Errorf("read: %w", dial(syscall.ECONNRESET)), true},
+		{"timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{"no such host", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"unreachable", dial(syscall.EHOSTUNREACH), false},
+		{"canceled", context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%s: %v) = %t, want %t", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWithRetryErrors(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		err       error
+		wantInfra bool
+	}{
+		{name: "succeeded", ctx: context.Background()},
+		{
+			name:      "failed for good",
+			ctx:       context.Background(),
+			err:       apierrors.NewForbidden(pods, "p", errors.New("no")),
+			wantInfra: true,
+		},
+		{name: "already infra", ctx: context.Background(), err: &InfraError{Err: errors.New("broken")}, wantInfra: true},
+		{name: "cancelled", ctx: cancelled, err: context.Canceled},
+	}
+	for _, tt := range tests {
+		err := withRetry(tt.ctx, func(ctx context.Context) error { return tt.err })
+		if !errors.Is(err, tt.err) {
+			t.Errorf("withRetry(%s) = %v, want it to wrap %v", tt.name, err, tt.err)
+		}
+		if got := IsInfraError(err); got != tt.wantInfra {
+			t.Errorf("IsInfraError(withRetry(%s)) = %t, want %t", tt.name, got, tt.wantInfra)
+		}
+		var ie *InfraError
+		if errors.As(err, &ie) && IsInfraError(ie.Err) {
+			t.Errorf("withRetry(%s) = %v, wrapped as an InfraError twice", tt.name, err)
+		}
+	}
+}
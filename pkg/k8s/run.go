@@ -0,0 +1,73 @@
+package k8s
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corev1 "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// NewRunId returns a random ID for a grader run, short enough to fit in the names of the pods.
+func NewRunId() string {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// runLabels returns labels plus the run label, if the client has a run ID.
+func (c *Client) runLabels(labels map[string]string) map[string]string {
+	if c.RunId == "" {
+		return labels
+	}
+	res := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		res[k] = v
+	}
+	res[RunKey] = c.RunId
+	return res
+}
+
+// runName returns name suffixed with the run ID, if the client has one.
+func (c *Client) runName(name string) string {
+	if c.RunId == "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%s", name, c.RunId)
+}
+
+// CreateRunNamespace creates a namespace for this run alone, named prefix followed by the run ID.
+func (c *Client) CreateRunNamespace(ctx context.Context, prefix string) (string, error) {
+	c.LazyInit()
+	if c.RunId == "" {
+		return "", fmt.Errorf("a namespace per run needs a run ID")
+	}
+	name := c.runName(prefix)
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return "", fmt.Errorf("bad namespace name %q: %s", name, strings.Join(errs, "; "))
+	}
+	req := corev1.Namespace(name).WithLabels(ownedLabels(c.runLabels(nil))).WithAnnotations(c.ownerAnnotations())
+	applyOpts := metav1.ApplyOptions{
+		FieldManager: kFieldManager,
+		Force:        true,
+	}
+	err := withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.CoreV1().Namespaces().Apply(ctx, req, applyOpts)
+		return err
+	})
+	return name, err
+}
+
+// DeleteNamespace deletes ns with everything in it, without waiting for that to finish.
+func (c *Client) DeleteNamespace(ctx context.Context, ns string) error {
+	c.LazyInit()
+	return deleteWithRetry(ctx, func(ctx context.Context) error {
+		return c.CoreV1().Namespaces().Delete(ctx, ns, metav1.DeleteOptions{})
+	})
+}
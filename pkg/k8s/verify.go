@@ -0,0 +1,200 @@
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const probePort = "18080"
+const probeListenerName = "probe-listener"
+
+// InfraError is a failure of the grading environment rather than of the code under test.
+type InfraError struct {
+	Err error
+}
+
+func (e *InfraError) Error() string {
+	return fmt.Sprintf("infrastructure error (not caused by the tested code): %v", e.Err)
+}
+
+func (e *InfraError) Unwrap() error {
+	return e.Err
+}
+
+// IsInfraError tells whether err is, or wraps, an InfraError.
+func IsInfraError(err error) bool {
+	var ie *InfraError
+	return errors.As(err, &ie)
+}
+
+// Reachability tells whether the node at address from should be able to open connections to the node at address to.
+type Reachability func(from, to string) bool
+
+// PartitionVerifier is implemented by backends that can check whether a partition is really in effect.
+type PartitionVerifier interface {
+	VerifyReachability(ctx context.Context, ns, groupName string, reaches Reachability, m map[string]PodMetaDetails) error
+}
+
+var _ PartitionVerifier = &Client{}
+
+// VerifyReachability checks from inside every pod in m that it can connect to exactly the other pods in m it reaches.
+// Every pod gets a listener container on probePort (added once, then reused) and a short-lived prober container that
+// tries to connect to all other pods' listeners. Policies can take a moment to be enforced, so each connection is
+// retried a few times until it has the expected outcome. Partitions between proxied pods are enforced by the grader
+// itself, so there is nothing to check.
+func (c *Client) VerifyReachability(
+	ctx context.Context, ns, groupName string, reaches Reachability, m map[string]PodMetaDetails,
+) error {
+	c.LazyInit()
+	if c.Proxied {
+		return nil
+	}
+	pods, err := c.ListPods(ctx, ns, GroupLabels(groupName))
+	if err != nil {
+		return err
+	}
+	podNames := make(map[string]string)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil {
+			podNames[pod.Status.PodIP] = pod.Name
+		}
+	}
+	for addr, details := range m {
+		if _, ok := podNames[details.Ip]; !ok {
+			return fmt.Errorf("no running pod for node %s", addr)
+		}
+	}
+
+	if err := c.forEachPod(m, func(addr string, details PodMetaDetails) error {
+		return c.ensureProbeListener(ctx, ns, podNames[details.Ip])
+	}); err != nil {
+		return err
+	}
+
+	return c.forEachPod(m, func(addr string, details PodMetaDetails) error {
+		reachable := make(map[string]bool)
+		for peerAddr := range m {
+			reachable[peerAddr] = reaches(addr, peerAddr)
+		}
+		var script strings.Builder
+		var targets []string
+		for peerAddr, peer := range m {
+			if peerAddr == addr {
+				continue
+			}
+			want := "1"
+			if reachable[peerAddr] {
+				want = "0"
+			}
+			targets = append(targets, peer.Ip)
+			script.WriteString(fmt.Sprintf(
+				"for i in 1 2 3 4 5; do nc -z -w 2 %[1]s %[2]s; r=$?; [ $r = %[3]s ] && break; sleep 1; done; "+
+					"echo %[1]s $r; ", peer.Ip, probePort, want))
+		}
+		if len(targets) == 0 {
+			return nil
+		}
+
+		podName := podNames[details.Ip]
+		name := ephemeralName("probe")
+		if err := c.addEphemeralContainer(ctx, ns, podName, v1.EphemeralContainer{
+			EphemeralContainerCommon: v1.EphemeralContainerCommon{
+				Name:    name,
+				Image:   ProbeImage,
+				Command: []string{"sh", "-c", script.String()},
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to add prober to pod %s: %w", podName, err)
+		}
+		if err := c.awaitEphemeralContainer(ctx, ns, podName, name, true, 2*time.Minute); err != nil {
+			return err
+		}
+		logs, err := c.containerLogs(ctx, ns, podName, name)
+		if err != nil {
+			return fmt.Errorf("failed to get prober logs from pod %s: %w", podName, err)
+		}
+
+		results := make(map[string]bool)
+		scanner := bufio.NewScanner(strings.NewReader(logs))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 {
+				results[fields[0]] = fields[1] == "0"
+			}
+		}
+		for peerAddr, peer := range m {
+			if peerAddr == addr {
+				continue
+			}
+			got, ok := results[peer.Ip]
+			if !ok {
+				return fmt.Errorf("prober in pod %s did not report on %s; output: %q", podName, peer.Ip, logs)
+			}
+			if got != reachable[peerAddr] {
+				return fmt.Errorf("expected %s to reach %s: %t, but it did: %t", details.Ip, peer.Ip, reachable[peerAddr], got)
+			}
+		}
+		return nil
+	})
+}
+
+// ensureProbeListener adds the listener container to the pod unless it already has it, and waits for it to run.
+func (c *Client) ensureProbeListener(ctx context.Context, ns, podName string) error {
+	var pod *v1.Pod
+	err := withRetry(ctx, func(ctx context.Context) (err error) {
+		pod, err = c.CoreV1().Pods(ns).Get(ctx, podName, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, ec := range pod.Spec.EphemeralContainers {
+		if ec.Name == probeListenerName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		if err := c.addEphemeralContainer(ctx, ns, podName, v1.EphemeralContainer{
+			EphemeralContainerCommon: v1.EphemeralContainerCommon{
+				Name:    probeListenerName,
+				Image:   ProbeImage,
+				Command: []string{"httpd", "-f", "-p", probePort, "-h", "/tmp"},
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to add probe listener to pod %s: %w", podName, err)
+		}
+	}
+	return c.awaitEphemeralContainer(ctx, ns, podName, probeListenerName, false, 2*time.Minute)
+}
+
+// forEachPod runs f for every node in m concurrently and returns one of the errors, if any.
+func (c *Client) forEachPod(m map[string]PodMetaDetails, f func(addr string, details PodMetaDetails) error) error {
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(m))
+	for addr, details := range m {
+		wg.Add(1)
+		go func(addr string, details PodMetaDetails) {
+			defer wg.Done()
+			errChan <- f(addr, details)
+		}(addr, details)
+	}
+	wg.Wait()
+	close(errChan)
+	var err error
+	for e := range errChan {
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -2,12 +2,15 @@ package kvs3client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
 )
 
 // CausalMetadata is like json.RawMessage, except its zero-value (nil) marshals to "{}"
@@ -43,9 +46,7 @@ type KeyListBody struct {
 	Keys     []string `json:"keys"`
 }
 
-var dataHttpClient = http.Client{
-	Timeout: 23 * time.Second,
-}
+var dataHttpClient = transport.NewHttpClient(23 * time.Second)
 
 func KvsDataKeyUrl(addr, key string) string {
 	return fmt.Sprintf("http://%s/kvs/data/%s", addr, strings.ReplaceAll(key, " ", "-"))
@@ -61,7 +62,7 @@ func parseBaseBody(r *http.Response) (BaseBody, error) {
 	return res, err
 }
 
-func PutKeyVal(dest, key, val string, cm CausalMetadata) (CausalMetadata, int, error) {
+func PutKeyVal(ctx context.Context, dest, key, val string, cm CausalMetadata) (CausalMetadata, int, error) {
 	data, err := json.Marshal(ValBody{
 		BaseBody: BaseBody{CM: cm},
 		Val:      val,
@@ -70,7 +71,7 @@ func PutKeyVal(dest, key, val string, cm CausalMetadata) (CausalMetadata, int, e
 		panic(err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodPut, KvsDataKeyUrl(dest, key), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, KvsDataKeyUrl(dest, key), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err.Error())
 	}
@@ -90,13 +91,13 @@ func PutKeyVal(dest, key, val string, cm CausalMetadata) (CausalMetadata, int, e
 	return res.CM, resp.StatusCode, nil
 }
 
-func GetKey(dest, key string, cm CausalMetadata) (string, CausalMetadata, int, error) {
+func GetKey(ctx context.Context, dest, key string, cm CausalMetadata) (string, CausalMetadata, int, error) {
 	data, err := json.Marshal(BaseBody{CM: cm})
 	if err != nil {
 		panic(err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodGet, KvsDataKeyUrl(dest, key), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, KvsDataKeyUrl(dest, key), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err.Error())
 	}
@@ -117,13 +118,13 @@ func GetKey(dest, key string, cm CausalMetadata) (string, CausalMetadata, int, e
 	return res.Val, res.CM, resp.StatusCode, nil
 }
 
-func DeleteKey(dest, key string, cm CausalMetadata) (CausalMetadata, int, error) {
+func DeleteKey(ctx context.Context, dest, key string, cm CausalMetadata) (CausalMetadata, int, error) {
 	data, err := json.Marshal(BaseBody{CM: cm})
 	if err != nil {
 		panic(err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodDelete, KvsDataKeyUrl(dest, key), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, KvsDataKeyUrl(dest, key), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err.Error())
 	}
@@ -143,13 +144,13 @@ func DeleteKey(dest, key string, cm CausalMetadata) (CausalMetadata, int, error)
 	return res.CM, resp.StatusCode, nil
 }
 
-func GetKeyList(dest string, cm CausalMetadata) (int, []string, CausalMetadata, int, error) {
+func GetKeyList(ctx context.Context, dest string, cm CausalMetadata) (int, []string, CausalMetadata, int, error) {
 	data, err := json.Marshal(BaseBody{CM: cm})
 	if err != nil {
 		panic(err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodGet, KvsDataUrl(dest), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, KvsDataUrl(dest), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err.Error())
 	}
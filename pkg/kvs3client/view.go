@@ -2,28 +2,31 @@ package kvs3client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
 )
 
 type View struct {
 	Nodes []string `json:"view"`
 }
 
-var ViewHttpClient = http.DefaultClient
+var ViewHttpClient = transport.NewHttpClient(0)
 
 func KvsAdminViewUrl(addr string) string {
 	return fmt.Sprintf("http://%s/kvs/admin/view", addr)
 }
 
-func PutView(dest string, nodes []string) (int, error) {
+func PutView(ctx context.Context, dest string, nodes []string) (int, error) {
 	data, err := json.Marshal(View{Nodes: nodes})
 	if err != nil {
 		panic(err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodPut, KvsAdminViewUrl(dest), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, KvsAdminViewUrl(dest), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err.Error())
 	}
@@ -37,8 +40,12 @@ func PutView(dest string, nodes []string) (int, error) {
 	return resp.StatusCode, nil
 }
 
-func GetView(dest string) ([]string, int, error) {
-	resp, err := ViewHttpClient.Get(KvsAdminViewUrl(dest))
+func GetView(ctx context.Context, dest string) ([]string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, KvsAdminViewUrl(dest), nil)
+	if err != nil {
+		panic(err.Error())
+	}
+	resp, err := ViewHttpClient.Do(req)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -48,8 +55,8 @@ func GetView(dest string) ([]string, int, error) {
 	return res.Nodes, resp.StatusCode, err
 }
 
-func DeleteView(dest string) (int, error) {
-	req, err := http.NewRequest(http.MethodDelete, KvsAdminViewUrl(dest), nil)
+func DeleteView(ctx context.Context, dest string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, KvsAdminViewUrl(dest), nil)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -2,11 +2,13 @@ package kvs4client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"time"
 
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs3client"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
 )
 
 type CausalMetadata = kvs3client.CausalMetadata
@@ -21,17 +23,15 @@ var GetKey = kvs3client.GetKey
 var DeleteKey = kvs3client.DeleteKey
 var KvsDataUrl = kvs3client.KvsDataUrl
 
-var dataHttpClient = http.Client{
-	Timeout: 25 * time.Second,
-}
+var dataHttpClient = transport.NewHttpClient(25 * time.Second)
 
-func GetKeyList(dest string, cm CausalMetadata) (KeyListBody, int, error) {
+func GetKeyList(ctx context.Context, dest string, cm CausalMetadata) (KeyListBody, int, error) {
 	data, err := json.Marshal(BaseBody{CM: cm})
 	if err != nil {
 		panic(err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodGet, KvsDataUrl(dest), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, KvsDataUrl(dest), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err.Error())
 	}
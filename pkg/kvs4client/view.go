@@ -2,12 +2,14 @@ package kvs4client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"sort"
 	"time"
 
 	"github.com/AKarbas/cse138-kuber-grader/pkg/kvs3client"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
 )
 
 type ViewReq struct {
@@ -24,19 +26,17 @@ type ViewRespShard struct {
 	Nodes   []string `json:"nodes"`
 }
 
-var viewHttpClient = http.Client{
-	Timeout: 25 * time.Second,
-}
+var viewHttpClient = transport.NewHttpClient(25 * time.Second)
 
 var KvsAdminViewUrl = kvs3client.KvsAdminViewUrl
 
-func PutView(dest string, view ViewReq) (int, error) {
+func PutView(ctx context.Context, dest string, view ViewReq) (int, error) {
 	data, err := json.Marshal(view)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	req, err := http.NewRequest(http.MethodPut, KvsAdminViewUrl(dest), bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, KvsAdminViewUrl(dest), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err.Error())
 	}
@@ -50,9 +50,13 @@ func PutView(dest string, view ViewReq) (int, error) {
 	return resp.StatusCode, nil
 }
 
-func GetView(dest string) (ViewResp, int, error) {
+func GetView(ctx context.Context, dest string) (ViewResp, int, error) {
 	res := ViewResp{}
-	resp, err := viewHttpClient.Get(KvsAdminViewUrl(dest))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, KvsAdminViewUrl(dest), nil)
+	if err != nil {
+		panic(err.Error())
+	}
+	resp, err := viewHttpClient.Do(req)
 	if err != nil {
 		return res, 0, err
 	}
@@ -67,8 +71,8 @@ func GetView(dest string) (ViewResp, int, error) {
 	return res, resp.StatusCode, nil
 }
 
-func DeleteView(dest string) (int, error) {
-	req, err := http.NewRequest(http.MethodDelete, KvsAdminViewUrl(dest), nil)
+func DeleteView(ctx context.Context, dest string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, KvsAdminViewUrl(dest), nil)
 	if err != nil {
 		panic(err.Error())
 	}
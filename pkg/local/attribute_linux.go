@@ -0,0 +1,127 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/faultproxy"
+)
+
+// sourceResolver attributes the connections to a proxy to the node whose processes opened them, so partitions work
+// whether or not the nodes bind their outgoing connections to their own IPs (see faultproxy.Injector.Resolve).
+func (c *Cluster) sourceResolver() func(remote, local net.Addr) string {
+	return c.resolveSource
+}
+
+// resolveSource finds the socket on the other end of a proxied connection in /proc/net, and then the node process
+// group holding it.
+func (c *Cluster) resolveSource(remote, local net.Addr) string {
+	r, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return faultproxy.Anyone
+	}
+	l, ok := local.(*net.TCPAddr)
+	if !ok {
+		return faultproxy.Anyone
+	}
+	inode := socketInode(r.Port, l.Port)
+	if inode == "" {
+		return faultproxy.Anyone
+	}
+
+	c.mu.Lock()
+	groups := make(map[string]string)
+	for key, n := range c.nodes {
+		select {
+		case <-n.exited:
+			continue
+		default: // Fall through
+		}
+		groups[strconv.Itoa(n.cmd.Process.Pid)] = key
+	}
+	c.mu.Unlock()
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return faultproxy.Anyone
+	}
+	for _, p := range procs {
+		key, ok := groups[processGroup(p.Name())]
+		if !ok {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == "socket:["+inode+"]" {
+				return key
+			}
+		}
+	}
+	return faultproxy.Anyone
+}
+
+// socketInode returns the inode of the TCP socket with local port localPort that is connected to remotePort, or ""
+// if there is none.
+func socketInode(localPort, remotePort int) string {
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // The header.
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[9] == "0" {
+				continue
+			}
+			if hexPort(fields[1]) == localPort && hexPort(fields[2]) == remotePort {
+				_ = f.Close()
+				return fields[9]
+			}
+		}
+		_ = f.Close()
+	}
+	return ""
+}
+
+// hexPort returns the port of an address as /proc/net/tcp prints it (e.g. "0100007F:1F90"), or -1.
+func hexPort(addr string) int {
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 {
+		return -1
+	}
+	port, err := strconv.ParseUint(addr[i+1:], 16, 16)
+	if err != nil {
+		return -1
+	}
+	return int(port)
+}
+
+// processGroup returns the process group ID of the process with the given ID, or "" if it can't be read.
+func processGroup(pid string) string {
+	stat, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return ""
+	}
+	// pid (comm) state ppid pgrp ...; comm may contain anything, including spaces and parentheses.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
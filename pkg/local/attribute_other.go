@@ -0,0 +1,11 @@
+//go:build !linux
+
+package local
+
+import "net"
+
+// sourceResolver returns nil: other systems have no /proc to find the process behind a connection in, so connections
+// are only attributed by the node IPs they come from.
+func (c *Cluster) sourceResolver() func(remote, local net.Addr) string {
+	return nil
+}
@@ -0,0 +1,693 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/faultproxy"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+	"github.com/AKarbas/cse138-kuber-grader/pkg/transport"
+)
+
+// loopback is the IP of every node on systems where only 127.0.0.1 is usable, like macOS.
+const loopback = "127.0.0.1"
+
+// errNoPartitions and errNoAttribution are InfraErrors: the test can't be run as configured, which is no fault of the
+// tested code.
+var errNoPartitions = &k8s.InfraError{Err: errors.New(
+	"network partitions need the local backend to run with Proxied set")}
+var errNoAttribution = &k8s.InfraError{Err: errors.New("the local backend can't tell which node a connection comes " +
+	"from, so it can only isolate single nodes from all of their peers")}
+
+// Cluster runs every node as a process on the grader's machine, each with its own loopback IP (127.0.0.2 and up)
+// where the system has them, or else its own port on 127.0.0.1. Nodes get the same POD_IP and ADDRESS environment
+// variables as they would in a pod, and are expected to listen on the address in ADDRESS.
+//
+// With Proxied set, every node also gets a fault-injecting proxy: ADDRESS (and so the view) holds the proxy's address
+// and the node has to listen on LISTEN_ADDRESS instead. The grader itself bypasses the proxies. Connections are
+// attributed to the nodes that open them by their source IPs, so nodes should bind their outgoing connections to
+// POD_IP; on Linux, connections from 127.0.0.1 are attributed by the process that opened them instead.
+type Cluster struct {
+	// Command starts a single node, e.g. []string{"python3", "server.py"}. When empty, the image passed to CreatePods
+	// is executed as the command instead.
+	Command []string
+	// Dir is the working directory of the node processes.
+	Dir     string
+	Proxied bool
+	// ReadyTimeout bounds how long nodes get to start answering; k8s.DefaultReadyTimeout is used when zero.
+	ReadyTimeout time.Duration
+
+	mu    sync.Mutex
+	nodes map[string]*node
+	// ips holds the IPs of the nodes; distinctIps tells whether there are more than one to go around.
+	ips         map[string]bool
+	ipsProbed   bool
+	distinctIps bool
+
+	injector    faultproxy.Injector
+	resolveOnce sync.Once
+}
+
+var _ k8s.ClusterBackend = &Cluster{}
+
+type node struct {
+	ns     string
+	name   string
+	labels map[string]string
+	args   []string
+	ip     string
+	addr   string
+	listen string
+	cmd    *exec.Cmd
+	logs   *syncBuffer
+	exited chan struct{}
+	// exitedAt is set before exited is closed.
+	exitedAt time.Time
+	deleted  bool
+}
+
+func (c *Cluster) CreatePods(ctx context.Context, ns, groupName, image string, batches, perBatch int) error {
+	for i := 1; i <= batches; i++ {
+		for j := 1; j <= perBatch; j++ {
+			err := c.startNode(
+				ns,
+				fmt.Sprintf("%s-b%d-p%d", groupName, i, j),
+				image, k8s.PodLabels(groupName, i, k8s.NodeIndex(i, perBatch, j)),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) startNode(ns, name, image string, labels map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes == nil {
+		c.nodes = make(map[string]*node)
+	}
+	key := ns + "/" + name
+	if _, ok := c.nodes[key]; ok {
+		return &k8s.InfraError{Err: fmt.Errorf("node %s already exists", key)}
+	}
+
+	ip, err := c.allocateIp()
+	if err != nil {
+		return &k8s.InfraError{Err: fmt.Errorf("failed to find an IP for node %s: %w", name, err)}
+	}
+	port, err := freePort(ip)
+	if err != nil {
+		c.releaseIp(ip)
+		return &k8s.InfraError{Err: fmt.Errorf("failed to find a free port for node %s: %w", name, err)}
+	}
+	args := c.Command
+	if len(args) == 0 {
+		args = []string{image}
+	}
+	n := &node{
+		ns:     ns,
+		name:   name,
+		labels: labels,
+		args:   args,
+		ip:     ip,
+		addr:   net.JoinHostPort(ip, strconv.Itoa(port)),
+		logs:   &syncBuffer{},
+	}
+	n.listen = n.addr
+	if c.Proxied {
+		c.resolveOnce.Do(func() { c.injector.Resolve = c.sourceResolver() })
+		if n.addr, err = c.injector.Start(key, n.listen); err != nil {
+			c.releaseIp(ip)
+			return &k8s.InfraError{Err: fmt.Errorf("failed to start proxy for node %s: %w", name, err)}
+		}
+		c.injector.SetSource(ip, key)
+		transport.Dialer.Rewrite(n.addr, n.listen)
+	}
+	if err := c.launch(n); err != nil {
+		c.stopProxy(n)
+		c.releaseIp(ip)
+		return err
+	}
+	c.nodes[key] = n
+	return nil
+}
+
+// launch starts the node's process; the caller must hold c.mu.
+func (c *Cluster) launch(n *node) error {
+	cmd := exec.Command(n.args[0], n.args[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(), "POD_IP="+n.ip, "ADDRESS="+n.addr, "LISTEN_ADDRESS="+n.listen)
+	cmd.Stdout = n.logs
+	cmd.Stderr = n.logs
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return &k8s.InfraError{Err: fmt.Errorf("failed to start node %s: %w", n.name, err)}
+	}
+	exited := make(chan struct{})
+	n.cmd, n.exited = cmd, exited
+
+	go func() {
+		_ = cmd.Wait()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		n.exitedAt = time.Now()
+		close(exited)
+		if n.deleted {
+			c.remove(n)
+		}
+	}()
+	return nil
+}
+
+// remove forgets a deleted node; the caller must hold c.mu.
+func (c *Cluster) remove(n *node) {
+	c.stopProxy(n)
+	c.releaseIp(n.ip)
+	delete(c.nodes, n.key())
+}
+
+func (c *Cluster) stopProxy(n *node) {
+	if c.Proxied {
+		c.injector.Stop(n.key())
+		c.injector.Heal(n.key())
+		c.injector.Unshape(n.key())
+		c.injector.ForgetSource(n.key())
+		transport.Dialer.Forget(n.addr)
+	}
+}
+
+func (n *node) key() string {
+	return n.ns + "/" + n.name
+}
+
+// allocateIp picks an unused loopback IP for a node, or 127.0.0.1 if the system only has that one; the caller must
+// hold c.mu.
+func (c *Cluster) allocateIp() (string, error) {
+	if !c.ipsProbed {
+		c.ipsProbed = true
+		// Linux and Windows route all of 127.0.0.0/8 to the loopback interface, macOS only 127.0.0.1.
+		if l, err := net.Listen("tcp", "127.0.0.2:0"); err == nil {
+			_ = l.Close()
+			c.distinctIps = true
+		}
+	}
+	if !c.distinctIps {
+		return loopback, nil
+	}
+	if c.ips == nil {
+		c.ips = make(map[string]bool)
+	}
+	for i := 2; i < 1<<16; i++ {
+		if i&0xff == 0 || i&0xff == 0xff {
+			continue
+		}
+		ip := fmt.Sprintf("127.0.%d.%d", i>>8, i&0xff)
+		if !c.ips[ip] {
+			c.ips[ip] = true
+			return ip, nil
+		}
+	}
+	return "", errors.New("out of loopback IPs")
+}
+
+// releaseIp makes a node's IP available again; the caller must hold c.mu.
+func (c *Cluster) releaseIp(ip string) {
+	delete(c.ips, ip)
+}
+
+func freePort(ip string) (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// matching returns the nodes in ns whose labels match; the caller must hold c.mu.
+func (c *Cluster) matching(ns string, labels map[string]string) []*node {
+	var res []*node
+	for _, n := range c.nodes {
+		if n.ns == ns && !n.deleted && k8s.MatchLabels(labels, n.labels) {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func (c *Cluster) ListAddressGroupIndexMappings(
+	ctx context.Context, ns string, labels map[string]string,
+) (map[string]k8s.PodMetaDetails, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make(map[string]k8s.PodMetaDetails)
+	for _, n := range c.matching(ns, labels) {
+		select {
+		case <-n.exited:
+			return nil, fmt.Errorf("node %s exited: %v", n.name, n.cmd.ProcessState)
+		default: // Fall through
+		}
+		for _, l := range []string{k8s.BatchKey, k8s.IndexKey} {
+			if _, ok := n.labels[l]; !ok {
+				return nil, fmt.Errorf("node has no label with key=%s", l)
+			}
+		}
+		res[n.addr] = k8s.PodMetaDetails{
+			Ip:    n.ip,
+			Batch: k8s.IntFromIntLabel(n.labels[k8s.BatchKey]),
+			Index: k8s.IntFromIntLabel(n.labels[k8s.IndexKey]),
+		}
+	}
+	return res, nil
+}
+
+func (c *Cluster) AwaitReady(ctx context.Context, ns string, labels map[string]string) error {
+	timeout := c.ReadyTimeout
+	if timeout == 0 {
+		timeout = k8s.DefaultReadyTimeout
+	}
+	addrs, err := c.ListPodAddresses(ctx, ns, labels)
+	if err != nil {
+		return err
+	}
+	if err := transport.AwaitHttp(ctx, addrs, timeout); err != nil {
+		// Say so if the node is not up because it exited.
+		if _, exitErr := c.ListPodAddresses(ctx, ns, labels); exitErr != nil {
+			return exitErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Cluster) ListPodAddresses(ctx context.Context, ns string, labels map[string]string) ([]string, error) {
+	m, err := c.ListAddressGroupIndexMappings(ctx, ns, labels)
+	if err != nil {
+		return nil, err
+	}
+	return k8s.PodAddrsFromMappings(m), nil
+}
+
+// IsolateBatch cuts the batch off from the rest of the group.
+func (c *Cluster) IsolateBatch(ctx context.Context, ns string, groupName string, batch int) error {
+	return c.isolate(ns, groupName, k8s.BatchLabels(groupName, batch), nil)
+}
+
+// IsolatePodByIps cuts the node off from every node whose IP is not in ips.
+func (c *Cluster) IsolatePodByIps(ctx context.Context, ns string, groupName string, idx int, ips []string) error {
+	return c.isolate(ns, groupName, k8s.PodLabelsNoBatch(groupName, idx), ips)
+}
+
+func (c *Cluster) IsolatePod(ctx context.Context, ns string, groupName string, idx int) error {
+	return c.isolate(ns, groupName, k8s.PodLabelsNoBatch(groupName, idx), nil)
+}
+
+// BlockOneWay holds the connections the nodes in from open to the nodes in to.
+func (c *Cluster) BlockOneWay(ctx context.Context, ns, groupName string, from, to []k8s.PodMetaDetails) error {
+	if !c.Proxied {
+		return errNoPartitions
+	}
+	if !c.injector.CanAttribute() {
+		return errNoAttribution
+	}
+	var toIps []string
+	for _, p := range to {
+		toIps = append(toIps, p.Ip)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := c.proxyNodes(ns, groupName)
+	for _, p := range from {
+		k8s.BlockProxied(&c.injector, nodes, k8s.PodLabelsNoBatch(groupName, p.Index), toIps)
+	}
+	return nil
+}
+
+// isolate cuts the group's nodes matching labels off from the group's other nodes, except for those with extraIps.
+// Without a way to tell the nodes apart, that only works for single nodes that nobody may reach.
+func (c *Cluster) isolate(ns, groupName string, labels map[string]string, extraIps []string) error {
+	if !c.Proxied {
+		return errNoPartitions
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.injector.CanAttribute() {
+		targets := c.matching(ns, labels)
+		if len(targets) > 1 || len(extraIps) > 1 {
+			return errNoAttribution
+		}
+		for _, n := range targets {
+			c.injector.Isolate(n.key())
+		}
+		return nil
+	}
+	k8s.IsolateProxied(&c.injector, c.proxyNodes(ns, groupName), labels, extraIps)
+	return nil
+}
+
+// proxyNodes returns the group's nodes; the caller must hold c.mu.
+func (c *Cluster) proxyNodes(ns, groupName string) []k8s.ProxyNode {
+	var res []k8s.ProxyNode
+	for _, n := range c.matching(ns, k8s.GroupLabels(groupName)) {
+		res = append(res, k8s.ProxyNode{Key: n.key(), Ip: n.ip, Labels: n.labels})
+	}
+	return res
+}
+
+func (c *Cluster) DeleteNetPolicies(ctx context.Context, ns string, labels map[string]string) error {
+	if !c.Proxied {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var nodes []k8s.ProxyNode
+	for _, n := range c.matching(ns, labels) {
+		nodes = append(nodes, k8s.ProxyNode{Key: n.key(), Ip: n.ip, Labels: n.labels})
+	}
+	k8s.HealProxied(&c.injector, nodes, labels)
+	return nil
+}
+
+// SetLinkProfiles replaces the group's link profiles with links, which the proxies apply to the connections each node
+// opens to another (see k8s.ShapeProxied), leaving the grader's own connections alone. Loss applies to whole
+// connections rather than packets: a lost connection never gets through.
+func (c *Cluster) SetLinkProfiles(
+	ctx context.Context, ns, groupName string, links map[k8s.NodeLink]k8s.LinkProfile,
+) error {
+	if !c.Proxied {
+		return errNoPartitions
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.injector.CanAttribute() && len(links) > 0 {
+		return &k8s.InfraError{Err: errors.New("the local backend can't tell which node a connection comes from, so " +
+			"it can't shape the links between nodes")}
+	}
+	return k8s.ShapeProxied(&c.injector, c.proxyNodes(ns, groupName), links)
+}
+
+func (c *Cluster) ClearLinkProfiles(ctx context.Context, ns, groupName string) error {
+	if !c.Proxied {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.matching(ns, k8s.GroupLabels(groupName)) {
+		c.injector.Unshape(n.key())
+	}
+	return nil
+}
+
+func (c *Cluster) DeletePods(ctx context.Context, ns string, labels map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.matching(ns, labels) {
+		n.deleted = true
+		select {
+		case <-n.exited:
+			c.remove(n)
+			continue
+		default: // Fall through
+		}
+		if err := killProcess(n.cmd); err != nil {
+			return &k8s.InfraError{Err: fmt.Errorf("failed to kill node %s: %w", n.name, err)}
+		}
+	}
+	return nil
+}
+
+// KillPods is DeletePods, which kills the node processes right away anyway.
+func (c *Cluster) KillPods(ctx context.Context, ns string, labels map[string]string) error {
+	return c.DeletePods(ctx, ns, labels)
+}
+
+// RestartPods kills the selected nodes and starts them again on the same addresses. Their logs carry on where they
+// left off.
+func (c *Cluster) RestartPods(ctx context.Context, ns string, labels map[string]string) error {
+	c.mu.Lock()
+	nodes := c.matching(ns, labels)
+	for _, n := range nodes {
+		select {
+		case <-n.exited:
+			continue
+		default: // Fall through
+		}
+		if err := killProcess(n.cmd); err != nil {
+			c.mu.Unlock()
+			return &k8s.InfraError{Err: fmt.Errorf("failed to kill node %s: %w", n.name, err)}
+		}
+	}
+	c.mu.Unlock()
+	if len(nodes) == 0 {
+		return fmt.Errorf("no nodes to restart; ns=%s; labels=%v", ns, labels)
+	}
+
+	deadline := time.NewTimer(20 * time.Second)
+	defer deadline.Stop()
+	for _, n := range nodes {
+		c.mu.Lock()
+		exited := n.exited
+		c.mu.Unlock()
+		select {
+		case <-deadline.C:
+			return &k8s.InfraError{Err: fmt.Errorf("node %s did not stop within 20s", n.name)}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-exited:
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range nodes {
+		if n.deleted {
+			continue
+		}
+		if err := c.launch(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FreezePods stops the selected nodes, and anything they forked, with SIGSTOP.
+func (c *Cluster) FreezePods(ctx context.Context, ns string, labels map[string]string) error {
+	return c.signal(ns, labels, stopProcess)
+}
+
+// ThawPods lets frozen nodes carry on with SIGCONT.
+func (c *Cluster) ThawPods(ctx context.Context, ns string, labels map[string]string) error {
+	return c.signal(ns, labels, continueProcess)
+}
+
+func (c *Cluster) signal(ns string, labels map[string]string, send func(cmd *exec.Cmd) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := c.matching(ns, labels)
+	if len(nodes) == 0 {
+		return fmt.Errorf("no nodes to signal; ns=%s; labels=%v", ns, labels)
+	}
+	for _, n := range nodes {
+		select {
+		case <-n.exited:
+			return fmt.Errorf("node %s exited: %v", n.name, n.cmd.ProcessState)
+		default: // Fall through
+		}
+		if err := send(n.cmd); err != nil {
+			return &k8s.InfraError{Err: fmt.Errorf("failed to signal node %s: %w", n.name, err)}
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) AwaitDeletion(ctx context.Context, ns string, labels map[string]string) error {
+	deadline := time.NewTimer(20 * time.Second)
+	defer deadline.Stop()
+
+	c.mu.Lock()
+	var pending []*node
+	for _, n := range c.nodes {
+		if n.ns == ns && k8s.MatchLabels(labels, n.labels) {
+			pending = append(pending, n)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, n := range pending {
+		select {
+		case <-deadline.C:
+			return &k8s.InfraError{Err: fmt.Errorf("deadline for node deletion exceeded; ns=%s; labels=%v", ns, labels)}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.exited:
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) GetPodLogs(ctx context.Context, ns string, labels map[string]string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var res []string
+	for _, n := range c.matching(ns, labels) {
+		res = append(res, n.logs.String())
+	}
+	return res, nil
+}
+
+// FollowPodLogs copies what the nodes wrote so far, and from then on everything they write with a timestamp in front
+// of every line, into writers from open. A restarted node keeps its logs, so each node is followed as a single run.
+func (c *Cluster) FollowPodLogs(
+	ctx context.Context, ns string, labels map[string]string, open k8s.LogOpener,
+) (func() error, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var followed []*node
+	var writers []io.WriteCloser
+	for _, n := range c.matching(ns, labels) {
+		details := k8s.PodMetaDetails{
+			Ip:    n.ip,
+			Batch: k8s.IntFromIntLabel(n.labels[k8s.BatchKey]),
+			Index: k8s.IntFromIntLabel(n.labels[k8s.IndexKey]),
+		}
+		w, err := open(n.name, details, 0)
+		if err != nil {
+			for i, f := range followed {
+				f.logs.follow(nil)
+				_ = writers[i].Close()
+			}
+			return nil, err
+		}
+		n.logs.follow(w)
+		followed = append(followed, n)
+		writers = append(writers, w)
+	}
+	return func() error {
+		var firstErr error
+		for i, n := range followed {
+			if err := n.logs.follow(nil); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if err := writers[i].Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}, nil
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	// tee, if set, gets a timestamped copy of everything written.
+	tee     io.Writer
+	teeErr  error
+	midLine bool
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tee != nil && b.teeErr == nil {
+		b.teeErr = b.writeTee(p)
+	}
+	return b.buf.Write(p)
+}
+
+// writeTee writes p to the tee, starting every line with the time, like the logs of a pod with timestamps.
+func (b *syncBuffer) writeTee(p []byte) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for len(p) > 0 {
+		if !b.midLine {
+			if _, err := io.WriteString(b.tee, now+" "); err != nil {
+				return err
+			}
+		}
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		if _, err := b.tee.Write(line); err != nil {
+			return err
+		}
+		b.midLine = line[len(line)-1] != '\n'
+		p = p[len(line):]
+	}
+	return nil
+}
+
+// follow makes w the tee, after copying what was written so far to it. It returns the error the previous tee hit.
+func (b *syncBuffer) follow(w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.teeErr
+	b.tee, b.teeErr = w, nil
+	if w != nil {
+		_, b.teeErr = w.Write(b.buf.Bytes())
+		b.midLine = b.buf.Len() > 0 && b.buf.Bytes()[b.buf.Len()-1] != '\n'
+	}
+	return err
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type monitor struct {
+	k8s.StepLog
+	c      *Cluster
+	ns     string
+	labels map[string]string
+}
+
+// MonitorPods reports nodes that exit without being deleted.
+func (c *Cluster) MonitorPods(ctx context.Context, ns string, labels map[string]string) (k8s.PodMonitor, error) {
+	return &monitor{c: c, ns: ns, labels: labels}, nil
+}
+
+func (m *monitor) Events() []k8s.PodEvent {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	var res []k8s.PodEvent
+	for _, n := range m.c.matching(m.ns, m.labels) {
+		select {
+		case <-n.exited:
+		default:
+			continue
+		}
+		index := -1
+		if idx, ok := n.labels[k8s.IndexKey]; ok {
+			index = k8s.IntFromIntLabel(idx)
+		}
+		res = append(res, k8s.PodEvent{
+			Time:    n.exitedAt,
+			Pod:     n.name,
+			Index:   index,
+			Message: fmt.Sprintf("exited (%v)", n.cmd.ProcessState),
+			Step:    m.At(n.exitedAt),
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res
+}
+
+// ClusterEvents returns nothing; there is no cluster to report anything.
+func (m *monitor) ClusterEvents() []k8s.ClusterEvent {
+	return nil
+}
+
+func (m *monitor) Stop() {}
@@ -0,0 +1,166 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AKarbas/cse138-kuber-grader/pkg/k8s"
+)
+
+// nodeEnv makes the test binary act as a node instead of running the tests.
+const nodeEnv = "LOCAL_TEST_NODE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(nodeEnv) != "" {
+		// Answer every request with the node's address, so the tests can tell which node they reached.
+		fmt.Println("node starting")
+		err := http.ListenAndServe(os.Getenv("LISTEN_ADDRESS"), http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(os.Getenv("ADDRESS"))) },
+		))
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// newCluster returns a cluster whose nodes run the test binary, and deletes them when the test ends.
+func newCluster(t *testing.T) *Cluster {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("failed to find the test binary: %v", err)
+	}
+	t.Setenv(nodeEnv, "1")
+	c := &Cluster{Command: []string{exe}, ReadyTimeout: 10 * time.Second}
+	t.Cleanup(func() {
+		_ = c.DeletePods(context.Background(), "ns", map[string]string{})
+		_ = c.AwaitDeletion(context.Background(), "ns", map[string]string{})
+	})
+	return c
+}
+
+func TestClusterLifecycle(t *testing.T) {
+	ctx := context.Background()
+	c := newCluster(t)
+	labels := k8s.GroupLabels("g1")
+
+	if err := c.CreatePods(ctx, "ns", "g1", "", 2, 2); err != nil {
+		t.Fatalf("CreatePods() error = %v", err)
+	}
+	if err := c.AwaitReady(ctx, "ns", labels); err != nil {
+		t.Fatalf("AwaitReady() error = %v", err)
+	}
+	mappings, err := c.ListAddressGroupIndexMappings(ctx, "ns", labels)
+	if err != nil {
+		t.Fatalf("ListAddressGroupIndexMappings() error = %v", err)
+	}
+	indexes := make(map[int]int)
+	for addr, m := range mappings {
+		indexes[m.Index] = m.Batch
+		if got := get(t, addr); got != addr {
+			t.Errorf("node at %s answered as %s", addr, got)
+		}
+	}
+	if want := map[int]int{1: 1, 2: 1, 3: 2, 4: 2}; fmt.Sprint(indexes) != fmt.Sprint(want) {
+		t.Errorf("batches by index = %v, want %v", indexes, want)
+	}
+
+	if err := c.RestartPods(ctx, "ns", k8s.PodLabelsNoBatch("g1", 1)); err != nil {
+		t.Fatalf("RestartPods() error = %v", err)
+	}
+	if err := c.AwaitReady(ctx, "ns", labels); err != nil {
+		t.Fatalf("AwaitReady() after restart error = %v", err)
+	}
+	restarted, err := c.ListAddressGroupIndexMappings(ctx, "ns", labels)
+	if err != nil {
+		t.Fatalf("ListAddressGroupIndexMappings() after restart error = %v", err)
+	}
+	if fmt.Sprint(restarted) != fmt.Sprint(mappings) {
+		t.Errorf("addresses after restart = %v, want %v", restarted, mappings)
+	}
+	logs, err := c.GetPodLogs(ctx, "ns", k8s.PodLabelsNoBatch("g1", 1))
+	if err != nil || len(logs) != 1 || strings.Count(logs[0], "node starting") != 2 {
+		t.Errorf("GetPodLogs() = %q, %v, want the logs of both runs", logs, err)
+	}
+
+	if err := c.DeletePods(ctx, "ns", labels); err != nil {
+		t.Fatalf("DeletePods() error = %v", err)
+	}
+	if err := c.AwaitDeletion(ctx, "ns", labels); err != nil {
+		t.Fatalf("AwaitDeletion() error = %v", err)
+	}
+	if addrs, err := c.ListPodAddresses(ctx, "ns", labels); err != nil || len(addrs) != 0 {
+		t.Errorf("ListPodAddresses() after deletion = %v, %v, want none", addrs, err)
+	}
+}
+
+// get returns the body of a GET to addr, failing the test if the request fails.
+func get(t *testing.T, addr string) string {
+	t.Helper()
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", addr, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read the response from %s: %v", addr, err)
+	}
+	return string(body)
+}
+
+func TestSyncBufferFollow(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []string
+		after  []string
+		// want is the tee's content with the timestamps replaced by "T".
+		want string
+	}{
+		{name: "nothing", want: ""},
+		{name: "copies what came before", before: []string{"a\n", "b\n"}, want: "a\nb\n"},
+		{name: "stamps new lines", after: []string{"a\nb\n"}, want: "T a\nT b\n"},
+		{name: "stamps once per line", after: []string{"a", "b\n", "c"}, want: "T ab\nT c"},
+		{name: "carries on a line", before: []string{"a"}, after: []string{"b\nc\n"}, want: "ab\nT c\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &syncBuffer{}
+			for _, s := range tt.before {
+				_, _ = b.Write([]byte(s))
+			}
+			var tee strings.Builder
+			if err := b.follow(&tee); err != nil {
+				t.Fatalf("follow() error = %v", err)
+			}
+			for _, s := range tt.after {
+				_, _ = b.Write([]byte(s))
+			}
+			if got := stripTimes(tee.String()); got != tt.want {
+				t.Errorf("tee = %q, want %q", got, tt.want)
+			}
+			if got, want := b.String(), strings.Join(append(tt.before, tt.after...), ""); got != want {
+				t.Errorf("buffer = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// stripTimes replaces the RFC 3339 timestamps at the start of lines with "T".
+func stripTimes(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if ts, rest, ok := strings.Cut(l, " "); ok {
+			if _, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+				lines[i] = "T " + rest
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,258 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+const defaultRegistry = "registry-1.docker.io"
+
+var manifestAccept = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ", ")
+
+var httpClient = http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// Reference is an image reference split into the parts the registry API needs.
+type Reference struct {
+	Registry   string
+	Repository string
+	// Tag is either a tag or a digest.
+	Tag string
+}
+
+// ParseReference splits an image like localhost:32000/team:cse138-hw4-v1.0 into its parts.
+func ParseReference(image string) (Reference, error) {
+	res := Reference{Registry: defaultRegistry, Tag: "latest"}
+	rest := image
+	if i := strings.Index(rest, "/"); i >= 0 {
+		if first := rest[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			res.Registry = first
+			rest = rest[i+1:]
+		}
+	}
+	if i := strings.Index(rest, "@"); i >= 0 {
+		res.Repository, res.Tag = rest[:i], rest[i+1:]
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 {
+		res.Repository, res.Tag = rest[:i], rest[i+1:]
+	} else {
+		res.Repository = rest
+	}
+	if res.Repository == "" || res.Tag == "" {
+		return Reference{}, fmt.Errorf("invalid image reference %q", image)
+	}
+	if res.Registry == defaultRegistry && !strings.Contains(res.Repository, "/") {
+		res.Repository = "library/" + res.Repository
+	}
+	return res, nil
+}
+
+func (r Reference) manifestPath() string {
+	return fmt.Sprintf("%s/v2/%s/manifests/%s", r.Registry, r.Repository, r.Tag)
+}
+
+// ErrUnauthorized is returned when the registry does not let the grader see the image, e.g. because it is private.
+var ErrUnauthorized = errors.New("the registry did not authorize the request")
+
+// headManifest asks the registry for the image's manifest over https, falling back to plain http for insecure
+// registries such as the MicroK8s one.
+func headManifest(r Reference) (*http.Response, error) {
+	return requestManifest(http.MethodHead, r)
+}
+
+// requestManifest is headManifest with any method. Registries that ask for a bearer token, as Docker Hub does even for
+// public images, get the request again with an anonymous one (see anonymousToken).
+func requestManifest(method string, r Reference) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for _, scheme := range []string{"https", "http"} {
+		url := fmt.Sprintf("%s://%s", scheme, r.manifestPath())
+		resp, err = doManifest(method, url, "")
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			token, err := anonymousToken(challenge)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+			}
+			if resp, err = doManifest(method, url, token); err != nil {
+				return nil, err
+			}
+		}
+		if method == http.MethodHead {
+			resp.Body.Close()
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+func doManifest(method, url, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return httpClient.Do(req)
+}
+
+// anonymousToken gets a token from the realm of a bearer challenge (a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull")
+// without credentials.
+func anonymousToken(challenge string) (string, error) {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	params := challengeParams(rest)
+	if params["realm"] == "" {
+		return "", fmt.Errorf("no realm in authentication challenge %q", challenge)
+	}
+	u, err := neturl.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("bad realm in authentication challenge %q: %w", challenge, err)
+	}
+	query := u.Query()
+	for _, key := range []string{"service", "scope"} {
+		if v := params[key]; v != "" {
+			query.Set(key, v)
+		}
+	}
+	u.RawQuery = query.Encode()
+	resp, err := httpClient.Get(u.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to get a token from %s: %w", params["realm"], err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d getting a token from %s", resp.StatusCode, params["realm"])
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("bad token from %s: %w", params["realm"], err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token from %s", params["realm"])
+}
+
+// challengeParams parses the comma-separated key=value pairs of an authentication challenge. Quoted values may contain
+// commas, as scopes with several actions do.
+func challengeParams(s string) map[string]string {
+	res := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return res
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		res[strings.ToLower(strings.TrimSpace(key))] = value
+		s = rest
+	}
+}
+
+// checkStatus turns a registry's answer about the image into an error, unless the image is there.
+func checkStatus(resp *http.Response, image string, ref Reference) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("image %s not found in registry %s", image, ref.Registry)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: status code %d from registry %s for image %s",
+			ErrUnauthorized, resp.StatusCode, ref.Registry, image)
+	default:
+		return fmt.Errorf("unexpected status code %d from registry %s for image %s", resp.StatusCode, ref.Registry, image)
+	}
+}
+
+// ManifestExists returns nil if the registry has the image.
+func ManifestExists(image string) error {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return err
+	}
+	resp, err := headManifest(ref)
+	if err != nil {
+		return fmt.Errorf("failed to reach registry %s: %w", ref.Registry, err)
+	}
+	return checkStatus(resp, image, ref)
+}
+
+// ResolveDigest returns the digest (e.g. sha256:...) of the manifest the registry has for the image. Registries that
+// leave out the Docker-Content-Digest header get the manifest hashed instead.
+func ResolveDigest(image string) (string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	resp, err := headManifest(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach registry %s: %w", ref.Registry, err)
+	}
+	if err := checkStatus(resp, image, ref); err != nil {
+		return "", err
+	}
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" {
+		return d, nil
+	}
+	resp, err = requestManifest(http.MethodGet, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach registry %s: %w", ref.Registry, err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, image, ref); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", fmt.Errorf("failed to read the manifest of image %s: %w", image, err)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// Pin replaces the tag of image with digest, so that it always refers to the same build.
+func Pin(image, digest string) string {
+	rest := image
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	name := image
+	if i := strings.Index(rest, "@"); i >= 0 {
+		name = image[:len(image)-len(rest)+i]
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 {
+		name = image[:len(image)-len(rest)+i]
+	}
+	return name + "@" + digest
+}
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		image   string
+		want    Reference
+		wantErr bool
+	}{
+		{image: "nginx", want: Reference{Registry: defaultRegistry, Repository: "library/nginx", Tag: "latest"}},
+		{image: "nginx:1.25", want: Reference{Registry: defaultRegistry, Repository: "library/nginx", Tag: "1.25"}},
+		{image: "team/kvs:v1", want: Reference{Registry: defaultRegistry, Repository: "team/kvs", Tag: "v1"}},
+		{
+			image: "localhost:32000/team:cse138-hw4-v1.0",
+			want:  Reference{Registry: "localhost:32000", Repository: "team", Tag: "cse138-hw4-v1.0"},
+		},
+		{image: "localhost/team", want: Reference{Registry: "localhost", Repository: "team", Tag: "latest"}},
+		{
+			image: "ghcr.io/org/team@sha256:abc",
+			want:  Reference{Registry: "ghcr.io", Repository: "org/team", Tag: "sha256:abc"},
+		},
+		{image: "team:", wantErr: true},
+		{image: "localhost:32000/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseReference(tt.image)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseReference(%q) error = %v, wantErr %t", tt.image, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseReference(%q) = %+v, want %+v", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestPin(t *testing.T) {
+	tests := []struct {
+		image, want string
+	}{
+		{"team", "team@sha256:1"},
+		{"team:v1", "team@sha256:1"},
+		{"localhost:32000/team:v1", "localhost:32000/team@sha256:1"},
+		{"localhost:32000/team", "localhost:32000/team@sha256:1"},
+		{"localhost:32000/team@sha256:0", "localhost:32000/team@sha256:1"},
+	}
+	for _, tt := range tests {
+		if got := Pin(tt.image, "sha256:1"); got != tt.want {
+			t.Errorf("Pin(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+// registryImage returns the image of team:v1 in the registry at url.
+func registryImage(url string) string {
+	return strings.TrimPrefix(url, "http://") + "/team:v1"
+}
+
+func TestResolveDigestHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/team/manifests/v1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", "sha256:abc")
+	}))
+	defer srv.Close()
+
+	got, err := ResolveDigest(registryImage(srv.URL))
+	if err != nil {
+		t.Fatalf("ResolveDigest() error = %v", err)
+	}
+	if got != "sha256:abc" {
+		t.Errorf("ResolveDigest() = %q, want %q", got, "sha256:abc")
+	}
+}
+
+func TestResolveDigestHashesManifest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("manifest"))
+	}))
+	defer srv.Close()
+
+	got, err := ResolveDigest(registryImage(srv.URL))
+	if err != nil {
+		t.Fatalf("ResolveDigest() error = %v", err)
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("manifest"))); got != want {
+		t.Errorf("ResolveDigest() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveDigestNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	if _, err := ResolveDigest(registryImage(srv.URL)); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("ResolveDigest() error = %v, want not found", err)
+	}
+}
+
+func TestResolveDigestAnonymousToken(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.URL.Query().Get("scope") != "repository:team:pull,push" || r.URL.Query().Get("service") != "test" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token": "anonymous"}`))
+		case "/v2/team/manifests/v1":
+			if r.Header.Get("Authorization") != "Bearer anonymous" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+					`Bearer realm="%s/token",service="test",scope="repository:team:pull,push"`, srv.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:abc")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	got, err := ResolveDigest(registryImage(srv.URL))
+	if err != nil {
+		t.Fatalf("ResolveDigest() error = %v", err)
+	}
+	if got != "sha256:abc" {
+		t.Errorf("ResolveDigest() = %q, want %q", got, "sha256:abc")
+	}
+}
+
+func TestResolveDigestUnauthorized(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			_, _ = w.Write([]byte(`{"access_token": "anonymous"}`))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token"`, srv.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	if _, err := ResolveDigest(registryImage(srv.URL)); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("ResolveDigest() error = %v, want ErrUnauthorized", err)
+	}
+}